@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"time"
 
 	"photomato/internal/api"
 	"photomato/internal/config"
 	"photomato/internal/provider"
+	"photomato/internal/store"
+	"photomato/internal/thumb"
+	"photomato/internal/tus"
 )
 
 func main() {
@@ -30,41 +33,53 @@ func main() {
 		}
 	}
 
+	formats := make([]thumb.Format, len(cfg.Thumbnails.Formats))
+	for i, f := range cfg.Thumbnails.Formats {
+		formats[i] = thumb.Format(f)
+	}
+	thumb.Configure(cfg.Thumbnails.Sizes, cfg.Thumbnails.DefaultSize, cfg.Thumbnails.Quality, formats)
+	thumb.SetWorkers(cfg.Thumbnails.Workers)
+	err = thumb.ConfigureCache(cfg.Thumbnails.CacheDir, cfg.Thumbnails.CacheMaxMB<<20,
+		time.Duration(cfg.Thumbnails.CacheMaxAgeDays)*24*time.Hour)
+	if err != nil {
+		log.Fatalf("Failed to open thumbnail cache: %v", err)
+	}
+	go thumb.JanitorLoop(10 * time.Minute)
+
+	st, err := store.Open(cfg.Database)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer st.Close()
+
 	// Initialize Providers
+	env := provider.NewEnv(cfg, st)
+	go env.Warmer.Run()
 	providers := make(api.ProviderMap)
 	for _, alias := range cfg.Aliases {
-		switch alias.Type {
-		case config.AliasTypeLocal:
-			p, err := provider.NewLocalProvider(alias.Path)
-			if err != nil {
-				log.Printf("Failed to create local provider for '%s': %v", alias.Name, err)
-				continue
-			}
-			providers[alias.Name] = p
-		case config.AliasTypeS3:
-			useSSL := strings.HasPrefix(alias.Endpoint, "https://")
-			endpoint := strings.TrimPrefix(strings.TrimPrefix(alias.Endpoint, "https://"), "http://")
-			
-			p, err := provider.NewS3Provider(provider.S3ProviderConfig{
-				Endpoint:  endpoint,
-				AccessKey: alias.AccessKey,
-				SecretKey: alias.SecretKey,
-				UseSSL:    useSSL,
-				Bucket:    alias.Bucket,
-				Prefix:    alias.Path, // Path is used as prefix
-				Region:    alias.Region,
-			})
-			if err != nil {
-				log.Printf("Failed to create S3 provider for '%s': %v", alias.Name, err)
-				continue
-			}
-			providers[alias.Name] = p
+		p, err := provider.New(alias, env)
+		if err != nil {
+			log.Printf("Failed to create %s provider for '%s': %v", alias.Type, alias.Name, err)
+			continue
+		}
+		providers[alias.Name] = p
+		if alias.Type == config.AliasTypeS3 {
 			log.Printf("S3 provider '%s' connected to %s/%s", alias.Name, alias.Endpoint, alias.Bucket)
 		}
 	}
 
+	// Partial resumable uploads live on local disk whatever the target alias is
+	staging, err := tus.NewStore(cfg.UploadDir, time.Duration(cfg.UploadExpiryHours)*time.Hour)
+	if err != nil {
+		log.Fatalf("Failed to open upload dir: %v", err)
+	}
+	go staging.ExpireLoop(time.Hour)
+
 	// Initialize Handlers
-	h := api.NewHandler(cfg, providers)
+	h, err := api.NewHandler(cfg, env, providers, staging)
+	if err != nil {
+		log.Fatalf("Failed to create handler: %v", err)
+	}
 	mux := http.NewServeMux()
 	h.RegisterRoutes(mux)
 
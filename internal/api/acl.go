@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+
+	"photomato/internal/config"
+	"photomato/internal/provider"
+	"photomato/internal/store"
+)
+
+// can reports whether the user of r has perm on an alias, see config.AccessRule.
+// Admins have every permission, others none on unknown aliases, e.g. removed ones.
+func (h *Handler) can(r *http.Request, aliasName, perm string) bool {
+	return h.userCan(currentUser(r), aliasName, perm)
+}
+
+// userCan is can for any user
+func (h *Handler) userCan(u *store.User, aliasName, perm string) bool {
+	if u.Role == RoleAdmin {
+		return true
+	}
+	for _, a := range h.Config.Aliases {
+		if a.Name == aliasName {
+			return a.Allows(u.Username, u.Groups, perm)
+		}
+	}
+	return false
+}
+
+// aliasProvider returns the provider of an alias if the user of r has perm
+// on it, otherwise it writes the error. Aliases the user may not read are
+// not found, as they are hidden from the alias list.
+func (h *Handler) aliasProvider(w http.ResponseWriter, r *http.Request, aliasName, perm string) (provider.Provider, bool) {
+	p, ok := h.Providers[aliasName]
+	if !ok || (!h.can(r, aliasName, perm) && !h.can(r, aliasName, config.PermRead)) {
+		http.Error(w, "Alias not found", http.StatusNotFound)
+		return nil, false
+	}
+	if !h.can(r, aliasName, perm) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return p, true
+}
+
+// cleanPhotoPath normalizes the path of a photo in a request. Paths leaving
+// the alias root are refused with 400, they would get around the access rules.
+func cleanPhotoPath(w http.ResponseWriter, photoPath string) (string, bool) {
+	cleaned, err := provider.CleanPath(photoPath)
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return "", false
+	}
+	return cleaned, true
+}
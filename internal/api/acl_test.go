@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"photomato/internal/config"
+	"photomato/internal/store"
+)
+
+// requestAs returns a request passed by AuthMiddleware as u
+func requestAs(u *store.User) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	return r.WithContext(context.WithValue(r.Context(), userKey, u))
+}
+
+func aclHandler() *Handler {
+	return &Handler{
+		Config: &config.Config{Aliases: []config.Alias{
+			{Name: "open", Type: config.AliasTypeLocal},
+			{Name: "family", Type: config.AliasTypeLocal, Access: []config.AccessRule{
+				{Groups: []string{"family"}, Permissions: []string{config.PermList, config.PermRead, config.PermUpload}},
+				{Users: []string{"Bob"}, Permissions: []string{config.PermRead}},
+			}},
+		}},
+		Providers: ProviderMap{"open": nil, "family": nil},
+	}
+}
+
+func TestCan(t *testing.T) {
+	admin := &store.User{Username: "root", Role: RoleAdmin}
+	ann := &store.User{Username: "ann", Role: RoleEditor, Groups: []string{"family"}}
+	bob := &store.User{Username: "bob", Role: RoleViewer}
+	eve := &store.User{Username: "eve", Role: RoleEditor}
+
+	tests := []struct {
+		name  string
+		user  *store.User
+		alias string
+		perm  string
+		want  bool
+	}{
+		{"admin ignores rules", admin, "family", config.PermDelete, true},
+		{"admin on unknown alias", admin, "gone", config.PermRead, true},
+		{"no rules allow everyone", eve, "open", config.PermDelete, true},
+		{"group rule", ann, "family", config.PermUpload, true},
+		{"group rule lacks perm", ann, "family", config.PermDelete, false},
+		{"user rule ignores case", bob, "family", config.PermRead, true},
+		{"user rule lacks perm", bob, "family", config.PermList, false},
+		{"no matching rule", eve, "family", config.PermRead, false},
+		{"unknown alias", eve, "gone", config.PermRead, false},
+	}
+	h := aclHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.can(requestAs(tt.user), tt.alias, tt.perm); got != tt.want {
+				t.Errorf("can(%s, %s, %s) = %v, want %v", tt.user.Username, tt.alias, tt.perm, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAliasProvider(t *testing.T) {
+	ann := &store.User{Username: "ann", Role: RoleEditor, Groups: []string{"family"}}
+	eve := &store.User{Username: "eve", Role: RoleEditor}
+
+	tests := []struct {
+		name   string
+		user   *store.User
+		alias  string
+		perm   string
+		status int // 0 if the provider is returned
+	}{
+		{"allowed", ann, "family", config.PermUpload, 0},
+		{"readable but not allowed", ann, "family", config.PermDelete, http.StatusForbidden},
+		{"hidden", eve, "family", config.PermRead, http.StatusNotFound},
+		{"hidden for other perms too", eve, "family", config.PermDelete, http.StatusNotFound},
+		{"unknown", ann, "gone", config.PermRead, http.StatusNotFound},
+	}
+	h := aclHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			_, ok := h.aliasProvider(w, requestAs(tt.user), tt.alias, tt.perm)
+			if ok != (tt.status == 0) || (!ok && w.Code != tt.status) {
+				t.Errorf("aliasProvider = %v with %d, want status %d", ok, w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestCleanPhotoPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string // "" if rejected
+	}{
+		{"a.jpg", "a.jpg"},
+		{"2024/01/a.jpg", "2024/01/a.jpg"},
+		{"/2024/./01//a.jpg", "2024/01/a.jpg"},
+		{"2024/../a.jpg", "a.jpg"},
+		{`2024\01\a.jpg`, "2024/01/a.jpg"},
+		{"", ""},
+		{"/", ""},
+		{".", ""},
+		{"..", ""},
+		{"../other/a.jpg", ""},
+		{"/../other/a.jpg", ""},
+		{"2024/../../other/a.jpg", ""},
+		{`..\other\a.jpg`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			got, ok := cleanPhotoPath(w, tt.path)
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("cleanPhotoPath(%q) = %q, %v, want %q", tt.path, got, ok, tt.want)
+			}
+			if !ok && w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
@@ -1,78 +1,212 @@
 package api
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"photomato/internal/store"
+)
+
+// AuthCookieName is the cookie holding the session ID
+const AuthCookieName = "auth_token"
+
+// Roles of a user, each one may do everything the ones before it may
+const (
+	RoleViewer = "viewer" // Browse and download photos
+	RoleEditor = "editor" // Upload, edit, move and delete photos
+	RoleAdmin  = "admin"  // Manage aliases, caches and users
 )
 
+var roleRank = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3}
+
+// dummyHash is compared against when a user does not exist, so a login takes
+// as long whether the name is right or not
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("photomato"), bcrypt.DefaultCost)
+
+// publicUser is everyone while logging in is not required
+var publicUser = &store.User{Role: RoleAdmin}
+
+type ctxKey int
+
 const (
-	AuthCookieName = "auth_token"
-	// A simple salt to prevent rainbow table attacks on the cookie value if leaked, 
-	// though for this simple implementation it's just a basic meaningful string.
-	AuthSalt       = "photomato_secure_salt_" 
+	userKey ctxKey = iota
+	sessionKey
+	tokenKey
 )
 
-// getPassword returns the configured password from env
-func getPassword() string {
-	if os.Getenv("PHOTOMATO_AUTH_ENABLED") != "true" {
-		return ""
+// authEnabled reports whether PHOTOMATO_AUTH_ENABLED asks for logins
+func authEnabled() bool {
+	return os.Getenv("PHOTOMATO_AUTH_ENABLED") == "true"
+}
+
+// defaultUsername is the account created from PHOTOMATO_PASSWORD, and the one
+// logged into when a login names no user
+func defaultUsername() string {
+	if name := os.Getenv("PHOTOMATO_USER"); name != "" {
+		return name
 	}
-	return os.Getenv("PHOTOMATO_PASSWORD")
+	return "admin"
 }
 
-// generateToken creates a simple token based on the password
-// In a real app, this should be a proper session ID or JWT. 
-// For this simple single-password app, a hash of the password suffices to verify knowledge.
-func generateToken(password string) string {
-	hash := sha256.Sum256([]byte(AuthSalt + password))
-	return hex.EncodeToString(hash[:])
+// initAuth sets up the session store. The first start with auth enabled
+// turns the old shared PHOTOMATO_PASSWORD into an admin account.
+func (h *Handler) initAuth() error {
+	h.sessions = newSessionStore(h.Config.Sessions, h.Env.Store)
+	if err := h.pruneSessions(); err != nil {
+		return err
+	}
+
+	if !authEnabled() {
+		return nil
+	}
+	if err := h.countUsers(); err != nil || h.hasUsers.Load() {
+		return err
+	}
+	password := os.Getenv("PHOTOMATO_PASSWORD")
+	if password == "" {
+		log.Printf("Auth is enabled but there are no users, set PHOTOMATO_PASSWORD to create the first admin. Access stays open until then.")
+		return nil
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := h.Env.Store.AddUser(store.User{Username: defaultUsername(), PasswordHash: hash, Role: RoleAdmin}); err != nil {
+		return err
+	}
+	h.hasUsers.Store(true)
+	log.Printf("Created admin user '%s' from PHOTOMATO_PASSWORD", defaultUsername())
+	return nil
 }
 
-// AuthMiddleware wraps a handler and checks for authentication if a password is set
+// countUsers updates whether any account exists, after accounts were added
+// or deleted. On errors they are assumed to exist, which keeps access closed.
+func (h *Handler) countUsers() error {
+	n, err := h.Env.Store.CountUsers("")
+	h.hasUsers.Store(err != nil || n > 0)
+	return err
+}
+
+// authRequired reports whether requests must come from a logged in user.
+// Without any account there is nobody to log in as, so access stays open.
+func (h *Handler) authRequired() bool {
+	return authEnabled() && h.hasUsers.Load()
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// requestUser returns the user logged in by the session cookie of r. The
+// account is read on every request, so role changes and deletions apply right away.
+func (h *Handler) requestUser(r *http.Request) (*store.User, store.Session, bool) {
+	s, ok := h.requestSession(r)
+	if !ok {
+		return nil, s, false
+	}
+	u, ok, err := h.Env.Store.User(s.Username)
+	if err != nil || !ok {
+		return nil, s, false
+	}
+	return &u, s, true
+}
+
+// currentUser returns the user a request passed AuthMiddleware as
+func currentUser(r *http.Request) *store.User {
+	if u, ok := r.Context().Value(userKey).(*store.User); ok {
+		return u
+	}
+	return publicUser
+}
+
+// currentSession returns the session a request passed AuthMiddleware with
+func currentSession(r *http.Request) (store.Session, bool) {
+	s, ok := r.Context().Value(sessionKey).(store.Session)
+	return s, ok
+}
+
+// AuthMiddleware wraps a handler and rejects requests without a logged in
+// user, if logging in is required. The user is available through currentUser.
 func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		password := getPassword()
-		
-		// If no password configured, everything is public
-		if password == "" {
+		// Everything is public without accounts
+		if !h.authRequired() {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Check for cookie
-		cookie, err := r.Cookie(AuthCookieName)
-		if err != nil || cookie.Value != generateToken(password) {
-			// Allow public access to auth endpoints and maybe static assets if needed,
-			// but usually the frontend static assets are served differently.
-			// Here we are wrapping API routes.
-			// We must allow /api/v1/auth/* explicitly, but since we register them separately
-			// and wrap the *mux*, we can't easily distinguish inside middleware unless checking path.
-			// BETTER APPROACH: Only wrap specific routes or check path here.
-			
-			path := r.URL.Path
-			if strings.HasPrefix(path, "/api/v1/auth/") || strings.HasPrefix(path, "/api/v1/file") || strings.HasPrefix(path, "/api/v1/thumb") {
-				// Wait, file and thumb should probably be protected too? 
-				// The prompt says "verify password". Usually that means viewing photos too.
-				// But let's allow auth endpoints.
-				if strings.HasPrefix(path, "/api/v1/auth/") {
-					next.ServeHTTP(w, r)
-					return
-				}
-			}
-
+		r, ok := h.authenticate(r)
+		if !ok {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticate returns r with its user in the context, logged in by the API
+// token of the Authorization header or else by the session cookie
+func (h *Handler) authenticate(r *http.Request) (*http.Request, bool) {
+	ctx := r.Context()
+	if header := r.Header.Get("Authorization"); header != "" {
+		u, t, ok := h.requestToken(header)
+		if !ok {
+			return r, false
+		}
+		ctx = context.WithValue(ctx, userKey, u)
+		ctx = context.WithValue(ctx, tokenKey, t)
+	} else {
+		u, s, ok := h.requestUser(r)
+		if !ok {
+			return r, false
+		}
+		ctx = context.WithValue(ctx, userKey, u)
+		ctx = context.WithValue(ctx, sessionKey, s)
+	}
+	return r.WithContext(ctx), true
+}
+
+// RequireRole is AuthMiddleware that also rejects users below role, and API
+// tokens without scope
+func (h *Handler) RequireRole(role, scope string, next http.Handler) http.Handler {
+	return h.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if roleRank[currentUser(r).Role] < roleRank[role] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if t, ok := currentToken(r); ok && !tokenAllows(t, scope) {
+			http.Error(w, "Token lacks the scope", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// RequireSession is AuthMiddleware for managing the account itself, which
+// needs a logged in user and is out of reach of API tokens
+func (h *Handler) RequireSession(next http.Handler) http.Handler {
+	return h.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r) == publicUser {
+			http.Error(w, "Not logged in", http.StatusBadRequest)
+			return
+		}
+		if _, ok := currentToken(r); ok {
+			http.Error(w, "Not available to API tokens", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
 // handleLogin handles the login request
 func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -81,6 +215,7 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
+		Username string `json:"username"` // The default user if empty, as before accounts
 		Password string `json:"password"`
 	}
 
@@ -89,54 +224,93 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	configuredPass := getPassword()
-	if configuredPass == "" {
-		// If no password set, login is always successful (or unnecessary)
-		// but techincally we shouldn't be here if checks are correct.
+	if !h.authRequired() {
+		// Nothing to log into
 		w.WriteHeader(http.StatusOK)
 		return
 	}
+	if req.Username == "" {
+		req.Username = defaultUsername()
+	}
 
-	if req.Password != configuredPass {
-		// Artificial delay to prevent timing attacks / brute force
+	u, ok, err := h.Env.Store.User(req.Username)
+	if err != nil {
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	hash := dummyHash
+	if ok {
+		hash = []byte(u.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || !ok {
+		// Artificial delay to slow down brute force
 		time.Sleep(500 * time.Millisecond)
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	// Set cookie
-	token := generateToken(configuredPass)
-	http.SetCookie(w, &http.Cookie{
-		Name:     AuthCookieName,
-		Value:    token,
-		Path:     "/",
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-		MaxAge:   86400 * 30, // 30 days
-	})
-
+	// A new session every time, one a client was handed before logging in is useless
+	if s, ok := h.requestSession(r); ok {
+		h.sessions.DeleteSession(s.ID)
+	}
+	if err := h.pruneSessions(); err != nil {
+		log.Printf("Failed to prune sessions: %v", err)
+	}
+	if err := h.startSession(w, r, u); err != nil {
+		log.Printf("Failed to start session for %s: %v", u.Username, err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "user": u})
 }
 
 // handleAuthCheck checks if the user is authenticated
 func (h *Handler) handleAuthCheck(w http.ResponseWriter, r *http.Request) {
-	// Logic is similar to middleware but returns JSON status
-	password := getPassword()
-	if password == "" {
-		// No password needed
+	if !h.authRequired() {
+		// No login needed
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]bool{"authenticated": true, "public": true})
+		json.NewEncoder(w).Encode(map[string]interface{}{"authenticated": true, "public": true, "user": publicUser})
 		return
 	}
 
-	cookie, err := r.Cookie(AuthCookieName)
-	if err != nil || cookie.Value != generateToken(password) {
+	r, ok := h.authenticate(r)
+	if !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]bool{"authenticated": false})
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]bool{"authenticated": true})
+	json.NewEncoder(w).Encode(map[string]interface{}{"authenticated": true, "user": currentUser(r)})
+}
+
+// handleLogout ends the session of the request. It works without a valid
+// session too, the cookie is cleared either way.
+func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if s, ok := h.requestSession(r); ok {
+		if err := h.sessions.DeleteSession(s.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Failed to end session of %s: %v", s.Username, err)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+	}
+	clearSessionCookie(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged_out"})
+}
+
+// handleLogoutAll ends every session of the user, including this one
+func (h *Handler) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if err := h.sessions.DeleteSessions(u.Username, ""); err != nil {
+		log.Printf("Failed to end sessions of %s: %v", u.Username, err)
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	clearSessionCookie(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged_out"})
 }
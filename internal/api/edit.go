@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"photomato/internal/config"
+	"photomato/internal/provider"
+	"photomato/internal/thumb"
+)
+
+// editQuality is the JPEG and WebP quality of full size edited photos
+const editQuality = 92
+
+func (h *Handler) handleGetEdit(w http.ResponseWriter, r *http.Request) {
+	aliasName := r.URL.Query().Get("alias")
+	photoPath := r.URL.Query().Get("path")
+
+	if aliasName == "" || photoPath == "" {
+		http.Error(w, "Missing alias or path", http.StatusBadRequest)
+		return
+	}
+
+	p, ok := h.aliasProvider(w, r, aliasName, config.PermRead)
+	if !ok {
+		return
+	}
+	photoPath, ok = cleanPhotoPath(w, photoPath)
+	if !ok {
+		return
+	}
+
+	edit, err := p.GetEdit(photoPath)
+	if err != nil {
+		log.Printf("Edit error for %s/%s: %v", aliasName, photoPath, err)
+		http.Error(w, "Failed to read edit", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"alias": aliasName,
+		"path":  photoPath,
+		"edit":  edit,
+	})
+}
+
+// handleSaveEdit records the edit of a photo in its sidecar, an empty edit
+// reverts to the original. With bake set, the edit is rendered into a new
+// file next to the photo instead and the photo is left as it is.
+func (h *Handler) handleSaveEdit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Alias string     `json:"alias"`
+		Path  string     `json:"path"`
+		Edit  thumb.Edit `json:"edit"`
+		Bake  bool       `json:"bake"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Alias == "" || req.Path == "" {
+		http.Error(w, "Missing alias or path", http.StatusBadRequest)
+		return
+	}
+	if err := req.Edit.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, ok := h.aliasProvider(w, r, req.Alias, config.PermUpload)
+	if !ok {
+		return
+	}
+	if req.Path, ok = cleanPhotoPath(w, req.Path); !ok {
+		return
+	}
+	key, err := h.renditionKey(req.Alias, req.Path)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+
+	if req.Bake {
+		if req.Edit.IsZero() {
+			http.Error(w, "Nothing to bake, the edit is empty", http.StatusBadRequest)
+			return
+		}
+		key.Edit = req.Edit
+		savedName, err := bakeEdit(p, key)
+		if err != nil {
+			log.Printf("Bake error for %s/%s: %v", req.Alias, req.Path, err)
+			http.Error(w, fmt.Sprintf("Failed to bake edit: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "baked", "path": savedName})
+		return
+	}
+
+	if err := p.SetEdit(req.Path, req.Edit); err != nil {
+		log.Printf("Edit error for %s/%s: %v", req.Alias, req.Path, err)
+		http.Error(w, fmt.Sprintf("Failed to save edit: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "saved",
+		"edit":   req.Edit,
+	})
+}
+
+// bakeEdit renders the photo of key with its edit and uploads the result as
+// <name>_edited next to it. It returns the name of the new file.
+func bakeEdit(p provider.Provider, key thumb.Key) (string, error) {
+	format, ext := editedFormat(key.Path)
+
+	// Streamed into the upload, a failed render fails the upload too
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(thumb.Bake(key, format, editQuality, func() (io.ReadCloser, error) {
+			return p.GetFileReader(key.Path)
+		}, pw))
+	}()
+	defer pr.Close()
+
+	name := strings.TrimSuffix(key.Path, path.Ext(key.Path)) + "_edited" + ext
+	return p.Upload(name, pr)
+}
+
+// renderEdited returns the full size rendering of the photo of key with its edit
+func renderEdited(p provider.Provider, key thumb.Key) (string, error) {
+	format, _ := editedFormat(key.Path)
+	return thumb.Render(key, thumb.Transform{Format: format, Quality: editQuality}, func() (io.ReadCloser, error) {
+		return p.GetFileReader(key.Path)
+	})
+}
+
+// editedFormat returns the format an edited photo is rendered in and the
+// extension of its file. Formats that can't be written become JPEG.
+func editedFormat(photoPath string) (thumb.Format, string) {
+	ext := path.Ext(photoPath)
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		return thumb.JPEG, ext
+	case ".png":
+		return thumb.PNG, ext
+	case ".webp":
+		return thumb.WebP, ext
+	}
+	return thumb.JPEG, ".jpg"
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"photomato/internal/config"
+)
+
+// eventsKeepAlive is how often an idle stream sends a comment, so proxies
+// don't close it. The login of the stream is checked again as often.
+const eventsKeepAlive = 30 * time.Second
+
+// handleEvents streams library changes as Server-Sent Events.
+// The optional alias parameter limits the stream to one alias. Reconnecting
+// clients send Last-Event-ID (or last_event_id) to receive what they missed.
+func (h *Handler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	aliasName := r.URL.Query().Get("alias")
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	after, _ := strconv.ParseUint(lastID, 10, 64)
+
+	stream, cancel := h.Env.Bus.Subscribe(after)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-stream:
+			if !ok {
+				// Fell too far behind, the client reconnects and catches up
+				return
+			}
+			if aliasName != "" && e.Alias != "" && e.Alias != aliasName {
+				continue
+			}
+			if e.Alias != "" && !h.can(r, e.Alias, config.PermRead) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			// Logged out, revoked or deleted users stop receiving
+			if h.authRequired() {
+				if r, ok = h.authenticate(r); !ok {
+					return
+				}
+			}
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
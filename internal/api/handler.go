@@ -6,27 +6,49 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"photomato/internal/config"
+	"photomato/internal/events"
 	"photomato/internal/provider"
+	"photomato/internal/store"
 	"photomato/internal/thumb"
+	"photomato/internal/tus"
 )
 
 type ProviderMap map[string]provider.Provider
 
 type Handler struct {
 	Config    *config.Config
+	Env       provider.Env
 	Providers ProviderMap
+
+	uploads       *uploadTracker
+	tus           *tus.Store
+	sessions      sessionStore
+	shareFailures *shareThrottle
+	hasUsers      atomic.Bool // Whether any account exists, see authRequired
 }
 
-func NewHandler(cfg *config.Config, providers ProviderMap) *Handler {
-	return &Handler{
-		Config:    cfg,
-		Providers: providers,
+// NewHandler creates the API handler, staging stores the resumable uploads
+func NewHandler(cfg *config.Config, env provider.Env, providers ProviderMap, staging *tus.Store) (*Handler, error) {
+	h := &Handler{
+		Config:        cfg,
+		Env:           env,
+		Providers:     providers,
+		uploads:       newUploadTracker(),
+		tus:           staging,
+		shareFailures: newShareThrottle(),
+	}
+	if err := h.initAuth(); err != nil {
+		return nil, fmt.Errorf("failed to set up accounts: %w", err)
 	}
+	return h, nil
 }
 
 // RegisterRoutes registers all API routes to the given mux
@@ -34,23 +56,71 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	// Public Auth Routes
 	mux.HandleFunc("POST /api/v1/auth/login", h.handleLogin)
 	mux.HandleFunc("GET /api/v1/auth/check", h.handleAuthCheck)
-
-	// Protected Routes
-	// We wrap these with AuthMiddleware
-	protect := h.AuthMiddleware
-
-	mux.Handle("GET /api/v1/aliases", protect(http.HandlerFunc(h.handleGetAliases)))
-	mux.Handle("GET /api/v1/photos", protect(http.HandlerFunc(h.handleGetPhotos)))
-	mux.Handle("GET /api/v1/file", protect(http.HandlerFunc(h.handleServeFile)))
-	mux.Handle("GET /api/v1/thumb", protect(http.HandlerFunc(h.handleGetThumbnail)))
-	mux.Handle("DELETE /api/v1/photo", protect(http.HandlerFunc(h.handleDeletePhoto)))
-	mux.Handle("POST /api/v1/upload", protect(http.HandlerFunc(h.handleUpload)))
-	mux.Handle("POST /api/v1/alias", protect(http.HandlerFunc(h.handleAddAlias)))
-	mux.Handle("PUT /api/v1/alias", protect(http.HandlerFunc(h.handleUpdateAlias)))
-	mux.Handle("DELETE /api/v1/alias", protect(http.HandlerFunc(h.handleDeleteAlias)))
-	mux.Handle("POST /api/v1/cache/clear", protect(http.HandlerFunc(h.handleClearCache)))
-	mux.Handle("POST /api/v1/s3/test", protect(http.HandlerFunc(h.handleTestS3Connection)))
-	mux.Handle("POST /api/v1/photos/move", protect(http.HandlerFunc(h.handleMovePhotos)))
+	mux.HandleFunc("POST /api/v1/auth/logout", h.handleLogout)
+
+	// Public share links, scoped by the share token
+	mux.HandleFunc("GET /api/v1/public/shares/{token}", h.handlePublicShare)
+	mux.HandleFunc("POST /api/v1/public/shares/{token}/open", h.handleOpenShare)
+	mux.HandleFunc("GET /api/v1/public/shares/{token}/photos", h.handleSharePhotos)
+	mux.HandleFunc("GET /api/v1/public/shares/{token}/thumb", h.handleShareThumbnail)
+	mux.HandleFunc("GET /api/v1/public/shares/{token}/file", h.handleShareFile)
+
+	// Account routes, not for API tokens
+	account := func(f http.HandlerFunc) http.Handler { return h.RequireSession(f) }
+
+	mux.Handle("POST /api/v1/auth/logout-all", account(h.handleLogoutAll))
+	mux.Handle("GET /api/v1/auth/sessions", account(h.handleListSessions))
+	mux.Handle("DELETE /api/v1/auth/sessions", account(h.handleDeleteSession))
+	mux.Handle("PUT /api/v1/auth/password", account(h.handleChangePassword))
+	mux.Handle("GET /api/v1/tokens", account(h.handleListTokens))
+	mux.Handle("POST /api/v1/tokens", account(h.handleCreateToken))
+	mux.Handle("DELETE /api/v1/tokens", account(h.handleDeleteToken))
+
+	// Protected Routes, by the least role allowed and the scope API tokens need
+	viewer := func(f http.HandlerFunc) http.Handler { return h.RequireRole(RoleViewer, ScopeRead, f) }
+	uploader := func(f http.HandlerFunc) http.Handler { return h.RequireRole(RoleEditor, ScopeUpload, f) }
+	editor := func(f http.HandlerFunc) http.Handler { return h.RequireRole(RoleEditor, ScopeEdit, f) }
+	admin := func(f http.HandlerFunc) http.Handler { return h.RequireRole(RoleAdmin, ScopeAdmin, f) }
+
+	mux.Handle("GET /api/v1/aliases", viewer(h.handleGetAliases))
+	mux.Handle("GET /api/v1/events", viewer(h.handleEvents))
+	mux.Handle("GET /api/v1/photos", viewer(h.handleGetPhotos))
+	mux.Handle("GET /api/v1/file", viewer(h.handleServeFile))
+	mux.Handle("GET /api/v1/thumb", viewer(h.handleGetThumbnail))
+	mux.HandleFunc("GET /api/v1/image", h.handleImage) // Checks auth itself, signed URLs are public
+	mux.Handle("GET /api/v1/image/sign", viewer(h.handleSignImage))
+	mux.Handle("GET /api/v1/photo/meta", viewer(h.handleGetPhotoMeta))
+	mux.Handle("GET /api/v1/photo/edit", viewer(h.handleGetEdit))
+	mux.Handle("POST /api/v1/photo/edit", editor(h.handleSaveEdit))
+	mux.Handle("DELETE /api/v1/photo", editor(h.handleDeletePhoto))
+	mux.Handle("POST /api/v1/upload", uploader(h.handleUpload))
+	mux.Handle("GET /api/v1/upload/progress", uploader(h.handleUploadProgress))
+	mux.HandleFunc("OPTIONS /api/v1/tus/", h.handleTusOptions)
+	mux.Handle("POST /api/v1/tus/{$}", uploader(h.handleTusCreate))
+	mux.Handle("HEAD /api/v1/tus/{id}", uploader(h.handleTusHead))
+	mux.Handle("PATCH /api/v1/tus/{id}", uploader(h.handleTusPatch))
+	mux.Handle("DELETE /api/v1/tus/{id}", uploader(h.handleTusDelete))
+	mux.Handle("GET /api/v1/alias", admin(h.handleListAliasConfigs))
+	mux.Handle("POST /api/v1/alias", admin(h.handleAddAlias))
+	mux.Handle("PUT /api/v1/alias", admin(h.handleUpdateAlias))
+	mux.Handle("DELETE /api/v1/alias", admin(h.handleDeleteAlias))
+	mux.Handle("POST /api/v1/cache/clear", admin(h.handleClearCache))
+	mux.Handle("GET /api/v1/cache/stats", admin(h.handleCacheStats))
+	mux.Handle("POST /api/v1/cache/purge/alias", admin(h.handlePurgeAliasCache))
+	mux.Handle("POST /api/v1/cache/purge/photo", editor(h.handlePurgePhotoCache))
+	mux.Handle("GET /api/v1/cache/warm", admin(h.handleWarmStatus))
+	mux.Handle("POST /api/v1/cache/warm/pause", admin(h.handlePauseWarm))
+	mux.Handle("POST /api/v1/cache/warm/resume", admin(h.handleResumeWarm))
+	mux.Handle("POST /api/v1/s3/test", admin(h.handleTestS3Connection))
+	mux.Handle("POST /api/v1/photos/move", editor(h.handleMovePhotos))
+	mux.Handle("POST /api/v1/download/zip", viewer(h.handleDownloadZip))
+	mux.Handle("GET /api/v1/shares", editor(h.handleListShares))
+	mux.Handle("POST /api/v1/shares", editor(h.handleCreateShare))
+	mux.Handle("DELETE /api/v1/shares", editor(h.handleDeleteShare))
+	mux.Handle("GET /api/v1/users", admin(h.handleListUsers))
+	mux.Handle("POST /api/v1/users", admin(h.handleAddUser))
+	mux.Handle("PUT /api/v1/users", admin(h.handleUpdateUser))
+	mux.Handle("DELETE /api/v1/users", admin(h.handleDeleteUser))
 
 	// 静态文件服务 (SPA)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -92,16 +162,40 @@ func (h *Handler) handleMovePhotos(w http.ResponseWriter, r *http.Request) {
 	}
 
 	srcProvider, ok := h.Providers[req.Alias]
-	if !ok {
+	if !ok || !h.can(r, req.Alias, config.PermRead) {
 		http.Error(w, fmt.Sprintf("Source alias '%s' not found", req.Alias), http.StatusNotFound)
 		return
 	}
+	if !h.can(r, req.Alias, config.PermMove) {
+		http.Error(w, fmt.Sprintf("Not allowed to move photos out of '%s'", req.Alias), http.StatusForbidden)
+		return
+	}
 
 	destProvider, ok := h.Providers[req.DestAlias]
-	if !ok {
+	if !ok || !h.can(r, req.DestAlias, config.PermRead) {
 		http.Error(w, fmt.Sprintf("Destination alias '%s' not found", req.DestAlias), http.StatusNotFound)
 		return
 	}
+	// Within an alias it is a move, into another one an upload
+	destPerm := config.PermUpload
+	if req.Alias == req.DestAlias {
+		destPerm = config.PermMove
+	}
+	if !h.can(r, req.DestAlias, destPerm) {
+		http.Error(w, fmt.Sprintf("Not allowed to move photos into '%s'", req.DestAlias), http.StatusForbidden)
+		return
+	}
+
+	destDir, err := provider.CleanDir(req.DestPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i, path := range req.Paths {
+		if req.Paths[i], ok = cleanPhotoPath(w, path); !ok {
+			return
+		}
+	}
 
 	moved := []string{}
 	failed := []string{}
@@ -112,9 +206,8 @@ func (h *Handler) handleMovePhotos(w http.ResponseWriter, r *http.Request) {
 		// Note: "path" might be "folder/file.jpg" or "file.jpg"
 		filename := filepath.Base(path)
 		destFilePath := filename
-		if req.DestPath != "" {
-			// Ensure destPath ends with separator or join correctly
-			destFilePath = filepath.Join(req.DestPath, filename)
+		if destDir != "" {
+			destFilePath = filepath.ToSlash(filepath.Join(destDir, filename))
 		}
 
 		var err error
@@ -129,11 +222,17 @@ func (h *Handler) handleMovePhotos(w http.ResponseWriter, r *http.Request) {
 				err = fmt.Errorf("failed to read source: %v", rErr)
 			} else {
 				// Upload to dest
-				_, uErr := destProvider.Upload(destFilePath, reader)
+				savedName, uErr := destProvider.Upload(destFilePath, reader)
 				reader.Close()
 				if uErr != nil {
 					err = fmt.Errorf("failed to upload to dest: %v", uErr)
 				} else {
+					// The edit follows the photo
+					if edit, eErr := srcProvider.GetEdit(path); eErr == nil && !edit.IsZero() {
+						if eErr := destProvider.SetEdit(savedName, edit); eErr != nil {
+							log.Printf("Failed to copy edit of %s: %v", path, eErr)
+						}
+					}
 					// Delete from source
 					if dErr := srcProvider.Delete(path); dErr != nil {
 						// This is tricky, we copied but failed to delete. 
@@ -162,20 +261,69 @@ func (h *Handler) handleMovePhotos(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// aliasInfo is what everyone is told about an alias. Credentials and access
+// rules are only listed to admins, by handleListAliasConfigs.
+type aliasInfo struct {
+	Name   string           `json:"name"`
+	Type   config.AliasType `json:"type"`
+	Path   string           `json:"path,omitempty"`
+	Bucket string           `json:"bucket,omitempty"`
+}
+
+// handleGetAliases lists the aliases the caller may read
 func (h *Handler) handleGetAliases(w http.ResponseWriter, r *http.Request) {
+	aliases := []aliasInfo{}
+	for _, a := range h.Config.Aliases {
+		if h.can(r, a.Name, config.PermRead) {
+			aliases = append(aliases, aliasInfo{Name: a.Name, Type: a.Type, Path: a.Path, Bucket: a.Bucket})
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(h.Config.Aliases)
+	json.NewEncoder(w).Encode(aliases)
+}
+
+// handleListAliasConfigs lists the aliases as configured, for the settings
+func (h *Handler) handleListAliasConfigs(w http.ResponseWriter, r *http.Request) {
+	aliases := h.Config.Aliases
+	if aliases == nil {
+		aliases = []config.Alias{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases)
 }
 
 func (h *Handler) handleServeFile(w http.ResponseWriter, r *http.Request) {
 	aliasName := r.URL.Query().Get("alias")
 	path := r.URL.Query().Get("path")
 
-	p, ok := h.Providers[aliasName]
+	p, ok := h.aliasProvider(w, r, aliasName, config.PermRead)
+	if !ok {
+		return
+	}
+	path, ok = cleanPhotoPath(w, path)
 	if !ok {
-		http.Error(w, "Alias not found", http.StatusNotFound)
 		return
 	}
+	h.serveFile(w, r, p, aliasName, path)
+}
+
+// serveFile serves a photo in full size. Edited photos are served as edited,
+// unless the original is asked for.
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, p provider.Provider, aliasName, path string) {
+	if r.URL.Query().Get("original") != "1" {
+		if key, err := h.renditionKey(aliasName, path); err == nil && !key.Edit.IsZero() {
+			cachePath, err := renderEdited(p, key)
+			if err != nil {
+				log.Printf("Edit error for %s/%s: %v", aliasName, path, err)
+				http.Error(w, "Failed to render edited photo", http.StatusInternalServerError)
+				return
+			}
+			http.ServeFile(w, r, cachePath)
+			return
+		}
+	}
 
 	originalURL, err := p.GetOriginalURL(path)
 	if err != nil {
@@ -193,31 +341,124 @@ func (h *Handler) handleServeFile(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) handleGetThumbnail(w http.ResponseWriter, r *http.Request) {
-    aliasName := r.URL.Query().Get("alias")
-    path := r.URL.Query().Get("path")
-
-    if aliasName == "" || path == "" {
-        http.Error(w, "Missing alias or path", http.StatusBadRequest)
-        return
-    }
-
-    p, ok := h.Providers[aliasName]
-    if !ok {
-        http.Error(w, "Alias not found", http.StatusNotFound)
-        return
-    }
-
-    reader, err := p.GetThumbnail(path)
-    if err != nil {
-        log.Printf("Thumbnail error for %s/%s: %v", aliasName, path, err)
-        http.Error(w, "Failed to get thumbnail", http.StatusInternalServerError)
-        return
-    }
-    defer reader.(io.Closer).Close()
-
-    w.Header().Set("Cache-Control", "public, max-age=86400")
-    w.Header().Set("Content-Type", "image/jpeg")
-    io.Copy(w, reader)
+	aliasName := r.URL.Query().Get("alias")
+	path := r.URL.Query().Get("path")
+
+	if aliasName == "" || path == "" {
+		http.Error(w, "Missing alias or path", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := thumbOptions(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, ok := h.aliasProvider(w, r, aliasName, config.PermRead)
+	if !ok {
+		return
+	}
+	path, ok = cleanPhotoPath(w, path)
+	if !ok {
+		return
+	}
+	serveThumbnail(w, p, aliasName, path, opts)
+}
+
+// serveThumbnail writes the thumbnail of a photo, or its preview while the
+// thumbnail is generated
+func serveThumbnail(w http.ResponseWriter, p provider.Provider, aliasName, path string, opts thumb.Options) {
+	reader, err := p.GetThumbnail(path, opts)
+	if err != nil {
+		log.Printf("Thumbnail error for %s/%s: %v", aliasName, path, err)
+		http.Error(w, "Failed to get thumbnail", http.StatusInternalServerError)
+		return
+	}
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	if _, ok := reader.(*thumb.Preview); ok {
+		// Stand-in until the thumbnail is generated, must not be cached
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", thumb.JPEG.ContentType())
+		io.Copy(w, reader)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Type", opts.Format.ContentType())
+	io.Copy(w, reader)
+}
+
+// thumbOptions reads the size and format of GET /api/v1/thumb. Without an
+// explicit format, WebP is served to clients that accept it. JPEG is always available.
+func thumbOptions(w http.ResponseWriter, r *http.Request) (thumb.Options, error) {
+	var opts thumb.Options
+
+	if v := r.URL.Query().Get("size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			return opts, fmt.Errorf("Invalid size '%s'", v)
+		}
+		opts.Size = size
+	}
+	opts.Size = thumb.NearestSize(opts.Size)
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "auto":
+		// The response depends on Accept, caches must key on it
+		w.Header().Add("Vary", "Accept")
+		opts.Format = thumb.JPEG
+		if thumb.Supports(thumb.WebP) && strings.Contains(r.Header.Get("Accept"), "image/webp") {
+			opts.Format = thumb.WebP
+		}
+	case "jpg", "jpeg":
+		opts.Format = thumb.JPEG
+	case "webp":
+		if !thumb.Supports(thumb.WebP) {
+			return opts, fmt.Errorf("Format '%s' is not enabled", format)
+		}
+		opts.Format = thumb.WebP
+	default:
+		return opts, fmt.Errorf("Unknown format '%s'", format)
+	}
+
+	return opts, nil
+}
+
+func (h *Handler) handleGetPhotoMeta(w http.ResponseWriter, r *http.Request) {
+	aliasName := r.URL.Query().Get("alias")
+	path := r.URL.Query().Get("path")
+
+	if aliasName == "" || path == "" {
+		http.Error(w, "Missing alias or path", http.StatusBadRequest)
+		return
+	}
+
+	p, ok := h.aliasProvider(w, r, aliasName, config.PermRead)
+	if !ok {
+		return
+	}
+	path, ok = cleanPhotoPath(w, path)
+	if !ok {
+		return
+	}
+
+	exif, err := p.GetExif(path)
+	if err != nil {
+		log.Printf("Metadata error for %s/%s: %v", aliasName, path, err)
+		http.Error(w, "Failed to read metadata", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"alias": aliasName,
+		"path":  path,
+		"exif":  exif,
+	})
 }
 
 func (h *Handler) handleDeletePhoto(w http.ResponseWriter, r *http.Request) {
@@ -234,9 +475,12 @@ func (h *Handler) handleDeletePhoto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p, ok := h.Providers[aliasName]
+	p, ok := h.aliasProvider(w, r, aliasName, config.PermDelete)
+	if !ok {
+		return
+	}
+	path, ok = cleanPhotoPath(w, path)
 	if !ok {
-		http.Error(w, "Alias not found", http.StatusNotFound)
 		return
 	}
 
@@ -256,55 +500,102 @@ func (h *Handler) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 32MB max memory
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
+	// Stream the form part by part instead of buffering it, so a large file
+	// goes straight into the provider
+	reader, err := r.MultipartReader()
+	if err != nil {
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 
-	aliasName := r.FormValue("alias")
-	if aliasName == "" {
-		http.Error(w, "Missing alias", http.StatusBadRequest)
-		return
-	}
-
-	p, ok := h.Providers[aliasName]
-	if !ok {
-		http.Error(w, "Alias not found", http.StatusNotFound)
-		return
-	}
+	// alias comes from the query, or from a form field sent before the files
+	aliasName := r.URL.Query().Get("alias")
+	progress := h.uploads.start(uploadOwner(r), r.URL.Query().Get("upload_id"))
+	defer h.uploads.finish(progress)
 
-	files := r.MultipartForm.File["files"]
 	uploaded := []string{}
 	failed := []string{}
 
-	for _, header := range files {
-		file, err := header.Open()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			failed = append(failed, header.Filename)
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "alias":
+			if aliasName == "" {
+				value, _ := io.ReadAll(io.LimitReader(part, 1024))
+				aliasName = string(value)
+			}
+			part.Close()
+			continue
+		case "files":
+		default:
+			part.Close()
 			continue
 		}
-		
-		savedName, err := p.Upload(header.Filename, file)
-		file.Close()
-		
+
+		filename := part.FileName()
+		if aliasName == "" {
+			part.Close()
+			http.Error(w, "Missing alias", http.StatusBadRequest)
+			return
+		}
+		p, ok := h.aliasProvider(w, r, aliasName, config.PermUpload)
+		if !ok {
+			part.Close()
+			return
+		}
+
+		file := progress.track(filename, part)
+		savedName, err := p.Upload(filename, file)
+		part.Close()
+		file.done(err)
+
 		if err != nil {
-			log.Printf("Upload error for %s: %v", header.Filename, err)
-			failed = append(failed, header.Filename)
+			log.Printf("Upload error for %s: %v", filename, err)
+			failed = append(failed, filename)
 		} else {
 			uploaded = append(uploaded, savedName)
 		}
 	}
 
+	if aliasName == "" {
+		http.Error(w, "Missing alias", http.StatusBadRequest)
+		return
+	}
+
 	response := map[string]interface{}{
 		"uploaded": uploaded,
 		"failed":   failed,
 	}
-	
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+func (h *Handler) handleUploadProgress(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	snapshot, ok := h.uploads.get(uploadOwner(r), id)
+	if !ok {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
 func (h *Handler) handleAddAlias(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -321,6 +612,10 @@ func (h *Handler) handleAddAlias(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing required fields (name, type)", http.StatusBadRequest)
 		return
 	}
+	if err := req.ValidateAccess(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Check for duplicates
 	for _, a := range h.Config.Aliases {
@@ -336,7 +631,7 @@ func (h *Handler) handleAddAlias(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Missing path for local alias", http.StatusBadRequest)
 			return
 		}
-		p, err := provider.NewLocalProvider(req.Path)
+		p, err := provider.New(req, h.Env)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Invalid path: %v", err), http.StatusBadRequest)
 			return
@@ -347,19 +642,7 @@ func (h *Handler) handleAddAlias(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Missing required S3 fields (bucket, endpoint, access_key, secret_key)", http.StatusBadRequest)
 			return
 		}
-		// Determine SSL usage from endpoint
-		useSSL := strings.HasPrefix(req.Endpoint, "https://")
-		endpoint := strings.TrimPrefix(strings.TrimPrefix(req.Endpoint, "https://"), "http://")
-		
-		p, err := provider.NewS3Provider(provider.S3ProviderConfig{
-			Endpoint:  endpoint,
-			AccessKey: req.AccessKey,
-			SecretKey: req.SecretKey,
-			UseSSL:    useSSL,
-			Bucket:    req.Bucket,
-			Prefix:    req.Path, // Path is used as prefix for S3
-			Region:    req.Region,
-		})
+		p, err := provider.New(req, h.Env)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Invalid S3 configuration: %v", err), http.StatusBadRequest)
 			return
@@ -377,6 +660,8 @@ func (h *Handler) handleAddAlias(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.Env.Bus.Publish(events.Event{Type: events.AliasAdded, Alias: req.Name})
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(req)
 }
@@ -396,6 +681,10 @@ func (h *Handler) handleUpdateAlias(w http.ResponseWriter, r *http.Request) {
 		Region    string `json:"region,omitempty"`
 		AccessKey string `json:"access_key,omitempty"`
 		SecretKey string `json:"secret_key,omitempty"`
+
+		ThumbPrefix    *string              `json:"thumb_prefix,omitempty"`
+		WarmThumbnails *bool                `json:"warm_thumbnails,omitempty"`
+		Access         *[]config.AccessRule `json:"access,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -407,6 +696,12 @@ func (h *Handler) handleUpdateAlias(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing old_name or new_name", http.StatusBadRequest)
 		return
 	}
+	if req.Access != nil {
+		if err := (config.Alias{Name: req.NewName, Access: *req.Access}).ValidateAccess(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Check if new name conflicts (except if same as old)
 	if req.OldName != req.NewName {
@@ -436,8 +731,27 @@ func (h *Handler) handleUpdateAlias(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Carry the index over to the new name so the new provider starts from it
+	if req.OldName != req.NewName {
+		if err := h.Env.Store.RenameAlias(req.OldName, req.NewName); err != nil {
+			log.Printf("Failed to rename index of %s: %v", req.OldName, err)
+			http.Error(w, "Failed to rename alias index", http.StatusInternalServerError)
+			return
+		}
+		// Thumbnails are cached per alias name
+		if err := thumb.EvictAlias(req.OldName); err != nil {
+			log.Printf("Failed to drop thumbnails of %s: %v", req.OldName, err)
+		}
+	}
+
 	// Update fields
 	h.Config.Aliases[aliasIndex].Name = req.NewName
+	if req.WarmThumbnails != nil {
+		h.Config.Aliases[aliasIndex].WarmThumbnails = *req.WarmThumbnails
+	}
+	if req.Access != nil {
+		h.Config.Aliases[aliasIndex].Access = *req.Access
+	}
 	if req.Path != "" || oldAlias.Type == config.AliasTypeLocal {
 		h.Config.Aliases[aliasIndex].Path = req.Path
 	}
@@ -457,34 +771,27 @@ func (h *Handler) handleUpdateAlias(w http.ResponseWriter, r *http.Request) {
 		if req.SecretKey != "" {
 			h.Config.Aliases[aliasIndex].SecretKey = req.SecretKey
 		}
+		if req.ThumbPrefix != nil {
+			h.Config.Aliases[aliasIndex].ThumbPrefix = *req.ThumbPrefix
+		}
 
 		// Re-create S3 provider with new settings
-		updatedAlias := h.Config.Aliases[aliasIndex]
-		useSSL := strings.HasPrefix(updatedAlias.Endpoint, "https://")
-		endpoint := strings.TrimPrefix(strings.TrimPrefix(updatedAlias.Endpoint, "https://"), "http://")
-
-		p, err := provider.NewS3Provider(provider.S3ProviderConfig{
-			Endpoint:  endpoint,
-			AccessKey: updatedAlias.AccessKey,
-			SecretKey: updatedAlias.SecretKey,
-			UseSSL:    useSSL,
-			Bucket:    updatedAlias.Bucket,
-			Prefix:    updatedAlias.Path,
-			Region:    updatedAlias.Region,
-		})
+		p, err := provider.New(h.Config.Aliases[aliasIndex], h.Env)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Invalid S3 configuration: %v", err), http.StatusBadRequest)
 			return
 		}
+		closeProvider(h.Providers[req.OldName])
 		delete(h.Providers, req.OldName)
 		h.Providers[req.NewName] = p
 	} else if oldAlias.Type == config.AliasTypeLocal {
 		// Re-create local provider
-		p, err := provider.NewLocalProvider(h.Config.Aliases[aliasIndex].Path)
+		p, err := provider.New(h.Config.Aliases[aliasIndex], h.Env)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Invalid path: %v", err), http.StatusBadRequest)
 			return
 		}
+		closeProvider(h.Providers[req.OldName])
 		delete(h.Providers, req.OldName)
 		h.Providers[req.NewName] = p
 	} else {
@@ -495,12 +802,25 @@ func (h *Handler) handleUpdateAlias(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Queued thumbnails go to the new provider, unless it holds other photos
+	updated := h.Config.Aliases[aliasIndex]
+	if updated.Path != oldAlias.Path || updated.Bucket != oldAlias.Bucket || updated.Endpoint != oldAlias.Endpoint {
+		h.Env.Warmer.Drop(req.OldName)
+	} else {
+		h.Env.Warmer.Handover(req.OldName, h.Providers[req.NewName])
+	}
+
 	if err := h.Config.Save("app-config.yaml"); err != nil {
 		log.Printf("Failed to save config: %v", err)
 		http.Error(w, "Failed to persist config", http.StatusInternalServerError)
 		return
 	}
 
+	if req.OldName != req.NewName {
+		h.Env.Bus.Publish(events.Event{Type: events.AliasRemoved, Alias: req.OldName})
+		h.Env.Bus.Publish(events.Event{Type: events.AliasAdded, Alias: req.NewName})
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(h.Config.Aliases[aliasIndex])
 }
@@ -533,7 +853,15 @@ func (h *Handler) handleDeleteAlias(w http.ResponseWriter, r *http.Request) {
 	}
 
 	h.Config.Aliases = newAliases
+	closeProvider(h.Providers[name])
 	delete(h.Providers, name)
+	if err := h.Env.Store.DeleteAlias(name); err != nil {
+		log.Printf("Failed to drop index of %s: %v", name, err)
+	}
+	if err := thumb.EvictAlias(name); err != nil {
+		log.Printf("Failed to drop thumbnails of %s: %v", name, err)
+	}
+	h.Env.Warmer.Drop(name)
 
 	if err := h.Config.Save("app-config.yaml"); err != nil {
 		log.Printf("Failed to save config: %v", err)
@@ -541,10 +869,19 @@ func (h *Handler) handleDeleteAlias(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.Env.Bus.Publish(events.Event{Type: events.AliasRemoved, Alias: name})
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
 }
 
+// closeProvider releases what a replaced or removed provider holds, e.g. its watcher
+func closeProvider(p provider.Provider) {
+	if c, ok := p.(io.Closer); ok {
+		c.Close()
+	}
+}
+
 func (h *Handler) handleClearCache(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -560,24 +897,106 @@ func (h *Handler) handleClearCache(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "cleared"})
 }
 
+func (h *Handler) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(thumb.Stats())
+}
+
+// handleWarmStatus reports the thumbnail pre-generation of every alias
+func (h *Handler) handleWarmStatus(w http.ResponseWriter, r *http.Request) {
+	paused, progress := h.Env.Warmer.Progress()
+
+	aliases := make(map[string]interface{})
+	for _, a := range h.Config.Aliases {
+		p := progress[a.Name]
+		aliases[a.Name] = map[string]interface{}{
+			"enabled": a.WarmThumbnails,
+			"total":   p.Total,
+			"done":    p.Done,
+			"failed":  p.Failed,
+			"current": p.Current,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"paused":  paused,
+		"aliases": aliases,
+	})
+}
+
+// handlePauseWarm stops thumbnail pre-generation until it is resumed
+func (h *Handler) handlePauseWarm(w http.ResponseWriter, r *http.Request) {
+	h.Env.Warmer.SetPaused(true)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "paused"})
+}
+
+func (h *Handler) handleResumeWarm(w http.ResponseWriter, r *http.Request) {
+	h.Env.Warmer.SetPaused(false)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "resumed"})
+}
+
+// handlePurgeAliasCache drops the cached thumbnails of one alias
+func (h *Handler) handlePurgeAliasCache(w http.ResponseWriter, r *http.Request) {
+	aliasName := r.URL.Query().Get("alias")
+	if aliasName == "" {
+		http.Error(w, "Missing alias", http.StatusBadRequest)
+		return
+	}
+
+	if err := thumb.EvictAlias(aliasName); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to purge cache: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "purged"})
+}
+
+// handlePurgePhotoCache drops the cached thumbnails of one photo
+func (h *Handler) handlePurgePhotoCache(w http.ResponseWriter, r *http.Request) {
+	aliasName := r.URL.Query().Get("alias")
+	path := r.URL.Query().Get("path")
+	if aliasName == "" || path == "" {
+		http.Error(w, "Missing alias or path", http.StatusBadRequest)
+		return
+	}
+
+	// Purging makes everyone regenerate, so it takes what writing does
+	if _, ok := h.aliasProvider(w, r, aliasName, config.PermUpload); !ok {
+		return
+	}
+	path, ok := cleanPhotoPath(w, path)
+	if !ok {
+		return
+	}
+
+	thumb.Evict(aliasName, path)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "purged"})
+}
+
 func (h *Handler) handleGetPhotos(w http.ResponseWriter, r *http.Request) {
 	aliasName := r.URL.Query().Get("alias")
-	cursor := r.URL.Query().Get("cursor")
-	limitStr := r.URL.Query().Get("limit")
-	limit := 50
-	if limitStr != "" {
-		if val, err := strconv.Atoi(limitStr); err == nil && val > 0 {
-			limit = val
-		}
+
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	p, ok := h.Providers[aliasName]
-	if !ok {
+	if !ok || !h.can(r, aliasName, config.PermList) {
 		http.Error(w, fmt.Sprintf("Alias '%s' not found", aliasName), http.StatusNotFound)
 		return
 	}
 
-	photos, nextCursor, err := p.List(cursor, limit)
+	photos, nextCursor, err := p.List(opts)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to list photos: %v", err), http.StatusInternalServerError)
 		return
@@ -591,6 +1010,10 @@ func (h *Handler) handleGetPhotos(w http.ResponseWriter, r *http.Request) {
 
 	response := map[string]interface{}{
 		"photos":      photos,
+		"dir":         opts.Dir,
+		"recursive":   opts.Recursive,
+		"sort":        opts.Sort,
+		"order":       opts.Order,
 		"next_cursor": nextCursor,
 		"total_count": totalCount,
 		"is_scanning": isScanning,
@@ -600,6 +1023,101 @@ func (h *Handler) handleGetPhotos(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// parseListOptions reads the listing parameters of GET /api/v1/photos:
+// dir (or prefix), recursive, sort, order, cursor, limit, ext, min_size, max_size, from and to
+func parseListOptions(q url.Values) (provider.ListOptions, error) {
+	opts := provider.ListOptions{
+		Cursor: q.Get("cursor"),
+		Limit:  50,
+	}
+	if val, err := strconv.Atoi(q.Get("limit")); err == nil && val > 0 {
+		opts.Limit = val
+	}
+
+	// "dir" selects the folder to browse, "prefix" is accepted as an alias for it
+	dirParam := q.Get("dir")
+	if dirParam == "" {
+		dirParam = q.Get("prefix")
+	}
+	dir, err := provider.CleanDir(dirParam)
+	if err != nil {
+		return opts, err
+	}
+	opts.Dir = dir
+	opts.Recursive, _ = strconv.ParseBool(q.Get("recursive"))
+
+	opts.Sort = q.Get("sort")
+	switch opts.Sort {
+	case "":
+		opts.Sort = store.SortModTime
+	case store.SortName, store.SortSize, store.SortModTime, store.SortTaken:
+	default:
+		return opts, fmt.Errorf("Unknown sort '%s'", opts.Sort)
+	}
+
+	opts.Order = q.Get("order")
+	switch opts.Order {
+	case "":
+		// Names read A-Z, everything else newest or largest first
+		opts.Order = store.OrderDesc
+		if opts.Sort == store.SortName {
+			opts.Order = store.OrderAsc
+		}
+	case store.OrderAsc, store.OrderDesc:
+	default:
+		return opts, fmt.Errorf("Unknown order '%s'", opts.Order)
+	}
+
+	// ext may be repeated or comma separated
+	for _, v := range q["ext"] {
+		for _, ext := range strings.Split(v, ",") {
+			ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+			if ext != "" {
+				opts.Exts = append(opts.Exts, ext)
+			}
+		}
+	}
+
+	if v := q.Get("min_size"); v != "" {
+		if opts.MinSize, err = strconv.ParseInt(v, 10, 64); err != nil || opts.MinSize < 0 {
+			return opts, fmt.Errorf("Invalid min_size '%s'", v)
+		}
+	}
+	if v := q.Get("max_size"); v != "" {
+		if opts.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil || opts.MaxSize < 0 {
+			return opts, fmt.Errorf("Invalid max_size '%s'", v)
+		}
+	}
+
+	if v := q.Get("from"); v != "" {
+		if opts.From, _, err = parseDateParam(v); err != nil {
+			return opts, fmt.Errorf("Invalid from '%s'", v)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		to, dateOnly, err := parseDateParam(v)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid to '%s'", v)
+		}
+		// A plain date includes the whole day
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		opts.To = to
+	}
+
+	return opts, nil
+}
+
+// parseDateParam accepts RFC 3339 timestamps or plain YYYY-MM-DD dates
+func parseDateParam(v string) (t time.Time, dateOnly bool, err error) {
+	if t, err = time.Parse(time.RFC3339, v); err == nil {
+		return t, false, nil
+	}
+	t, err = time.ParseInLocation(time.DateOnly, v, time.Local)
+	return t, true, err
+}
+
 // handleTestS3Connection tests S3 connection without saving
 func (h *Handler) handleTestS3Connection(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -625,19 +1143,15 @@ func (h *Handler) handleTestS3Connection(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Parse endpoint
-	useSSL := strings.HasPrefix(req.Endpoint, "https://")
-	endpoint := strings.TrimPrefix(strings.TrimPrefix(req.Endpoint, "https://"), "http://")
-
-	// Try to create S3 provider (this verifies the bucket exists)
-	_, err := provider.NewS3Provider(provider.S3ProviderConfig{
-		Endpoint:  endpoint,
+	// Verify the bucket exists without starting a provider
+	err := provider.TestS3Connection(provider.S3ConfigFromAlias(config.Alias{
+		Type:      config.AliasTypeS3,
+		Endpoint:  req.Endpoint,
 		AccessKey: req.AccessKey,
 		SecretKey: req.SecretKey,
-		UseSSL:    useSSL,
 		Bucket:    req.Bucket,
 		Region:    req.Region,
-	})
+	}))
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -0,0 +1,302 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"photomato/internal/config"
+	"photomato/internal/thumb"
+)
+
+// imageParams are the query parameters of GET /api/v1/image, all of them are
+// signed. user is the signer.
+var imageParams = []string{"alias", "path", "w", "h", "fit", "gravity", "q", "format", "rotate", "blur", "expires", "user"}
+
+// handleImage serves an arbitrary rendition of a photo. URLs signed with
+// GET /api/v1/image/sign work without logging in, e.g. when embedded elsewhere.
+func (h *Handler) handleImage(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.Query().Has("sig") {
+		h.RequireRole(RoleViewer, ScopeRead, http.HandlerFunc(h.serveImage)).ServeHTTP(w, r)
+		return
+	}
+	if err := h.verifyImageURL(r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	r, ok := h.signerRequest(w, r)
+	if !ok {
+		return
+	}
+	h.serveImage(w, r)
+}
+
+// signerRequest returns r as sent by the signer of its URL, so the access
+// rules apply to them as they are now. URLs of deleted signers are refused.
+func (h *Handler) signerRequest(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if !h.authRequired() {
+		return r, true
+	}
+	u, ok, err := h.Env.Store.User(r.URL.Query().Get("user"))
+	if err != nil {
+		http.Error(w, "Failed to check the signer", http.StatusInternalServerError)
+		return r, false
+	}
+	if !ok {
+		http.Error(w, "The signer of this URL no longer exists", http.StatusForbidden)
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), userKey, &u)), true
+}
+
+func (h *Handler) serveImage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	aliasName := q.Get("alias")
+	path := q.Get("path")
+	if aliasName == "" || path == "" {
+		http.Error(w, "Missing alias or path", http.StatusBadRequest)
+		return
+	}
+
+	t, err := h.imageTransform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format := q.Get("format"); format == "" || format == "auto" {
+		// The response depends on Accept, caches must key on it
+		w.Header().Add("Vary", "Accept")
+	}
+
+	// Signed requests run as their signer
+	p, ok := h.aliasProvider(w, r, aliasName, config.PermRead)
+	if !ok {
+		return
+	}
+	path, ok = cleanPhotoPath(w, path)
+	if !ok {
+		return
+	}
+	key, err := h.renditionKey(aliasName, path)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	cachePath, err := thumb.Render(key, t, func() (io.ReadCloser, error) {
+		return p.GetFileReader(path)
+	})
+	if err != nil {
+		log.Printf("Image error for %s/%s: %v", aliasName, path, err)
+		http.Error(w, "Failed to render image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Type", t.Format.ContentType())
+	http.ServeFile(w, r, cachePath)
+}
+
+// renditionKey identifies the renditions of a photo. Only indexed photos are
+// rendered, the index versions the cache and holds the edit.
+func (h *Handler) renditionKey(aliasName, path string) (thumb.Key, error) {
+	rec, ok, err := h.Env.Store.Get(aliasName, path)
+	if err != nil {
+		return thumb.Key{}, err
+	}
+	if !ok || rec.IsDir {
+		return thumb.Key{}, fmt.Errorf("%s/%s is not indexed", aliasName, path)
+	}
+	edit, err := thumb.ParseEdit(rec.Edit)
+	if err != nil {
+		return thumb.Key{}, err
+	}
+	return thumb.Key{
+		Alias:   aliasName,
+		Path:    path,
+		Version: fmt.Sprintf("%x-%x-%s", rec.ModTime.UnixNano(), rec.Size, rec.Hash),
+		Edit:    edit,
+	}, nil
+}
+
+// imageTransform reads the rendition parameters of GET /api/v1/image
+func (h *Handler) imageTransform(r *http.Request) (thumb.Transform, error) {
+	q := r.URL.Query()
+	var t thumb.Transform
+
+	maxSize := h.Config.Images.MaxSize
+	for name, dst := range map[string]*int{"w": &t.Width, "h": &t.Height} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > maxSize {
+				return t, fmt.Errorf("Invalid %s '%s', at most %d", name, v, maxSize)
+			}
+			*dst = n
+		}
+	}
+
+	switch fit := q.Get("fit"); fit {
+	case "", thumb.FitContain, thumb.FitCover, thumb.FitFill:
+		t.Fit = fit
+	default:
+		return t, fmt.Errorf("Invalid fit '%s'", fit)
+	}
+
+	if gravity := q.Get("gravity"); gravity != "" {
+		if _, ok := thumb.Gravities[gravity]; !ok {
+			return t, fmt.Errorf("Invalid gravity '%s'", gravity)
+		}
+		t.Gravity = gravity
+	}
+
+	if v := q.Get("q"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return t, fmt.Errorf("Invalid quality '%s'", v)
+		}
+		t.Quality = n
+	}
+
+	// WebP falls back to JPEG where it is not enabled, so signed URLs keep working
+	switch format := q.Get("format"); format {
+	case "", "auto":
+		t.Format = thumb.JPEG
+		if thumb.Supports(thumb.WebP) && strings.Contains(r.Header.Get("Accept"), "image/webp") {
+			t.Format = thumb.WebP
+		}
+	case "jpg", "jpeg":
+		t.Format = thumb.JPEG
+	case "webp":
+		t.Format = thumb.JPEG
+		if thumb.Supports(thumb.WebP) {
+			t.Format = thumb.WebP
+		}
+	case "png":
+		t.Format = thumb.PNG
+	default:
+		return t, fmt.Errorf("Unknown format '%s'", format)
+	}
+
+	if v := q.Get("rotate"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n%90 != 0 {
+			return t, fmt.Errorf("Invalid rotate '%s', must be a multiple of 90", v)
+		}
+		t.Rotate = n
+	}
+
+	if v := q.Get("blur"); v != "" {
+		sigma, err := strconv.ParseFloat(v, 64)
+		if err != nil || sigma < 0 || sigma > 100 {
+			return t, fmt.Errorf("Invalid blur '%s'", v)
+		}
+		t.Blur = sigma
+	}
+
+	return t, nil
+}
+
+// imageSignature returns the signature of the rendition parameters in q
+func (h *Handler) imageSignature(q url.Values) string {
+	signed := url.Values{}
+	for _, name := range imageParams {
+		if q.Has(name) {
+			signed.Set(name, q.Get(name))
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(h.Config.Images.Secret))
+	mac.Write([]byte(signed.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyImageURL checks the signature and expiry of a signed rendition URL.
+// Every URL expires, at the latest after the longest TTL configured now.
+func (h *Handler) verifyImageURL(q url.Values) error {
+	if h.Config.Images.Secret == "" {
+		return fmt.Errorf("Signed URLs are disabled")
+	}
+	// Unsigned parameters could change the rendition
+	for name := range q {
+		if name != "sig" && !slices.Contains(imageParams, name) {
+			return fmt.Errorf("Parameter '%s' is not signed", name)
+		}
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(h.imageSignature(q))) {
+		return fmt.Errorf("Invalid signature")
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("URL has no expiry")
+	}
+	now := time.Now()
+	if now.Unix() > expires || time.Unix(expires, 0).Sub(now) > h.maxImageTTL() {
+		return fmt.Errorf("URL expired")
+	}
+	return nil
+}
+
+func (h *Handler) maxImageTTL() time.Duration {
+	return time.Duration(h.Config.Images.MaxURLTTLHours) * time.Hour
+}
+
+// handleSignImage returns a signed URL for the rendition described by the
+// same parameters as GET /api/v1/image. The URL is served with the access the
+// signer has then. It expires after ttl seconds, by default after the
+// configured url_ttl_hours.
+func (h *Handler) handleSignImage(w http.ResponseWriter, r *http.Request) {
+	if h.Config.Images.Secret == "" {
+		http.Error(w, "Signed URLs are disabled, set images.secret", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("alias") == "" || q.Get("path") == "" {
+		http.Error(w, "Missing alias or path", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.aliasProvider(w, r, q.Get("alias"), config.PermRead); !ok {
+		return
+	}
+	if _, ok := cleanPhotoPath(w, q.Get("path")); !ok {
+		return
+	}
+	// Refuse to sign what would be rejected later
+	if _, err := h.imageTransform(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	signed := url.Values{}
+	for _, name := range imageParams {
+		if v := q.Get(name); v != "" && name != "expires" && name != "user" {
+			signed.Set(name, v)
+		}
+	}
+	if u := currentUser(r); u.Username != "" {
+		signed.Set("user", u.Username)
+	}
+	ttl := time.Duration(h.Config.Images.URLTTLHours) * time.Hour
+	if v := q.Get("ttl"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > int(h.maxImageTTL().Seconds()) {
+			http.Error(w, fmt.Sprintf("Invalid ttl '%s', at most %d seconds", v, int(h.maxImageTTL().Seconds())), http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(n) * time.Second
+	}
+	signed.Set("expires", strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	signed.Set("sig", h.imageSignature(signed))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": "/api/v1/image?" + signed.Encode()})
+}
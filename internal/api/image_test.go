@@ -0,0 +1,184 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"photomato/internal/config"
+	"photomato/internal/store"
+)
+
+var testImages = config.Images{Secret: "s3cret", MaxSize: 4096, URLTTLHours: 1, MaxURLTTLHours: 24}
+
+// signImage signs the rendition query as u and returns the query of the URL
+func signImage(t *testing.T, h *Handler, u *store.User, query string) url.Values {
+	t.Helper()
+	r := requestAs(u)
+	r.URL.RawQuery = query
+	w := httptest.NewRecorder()
+	h.handleSignImage(w, r)
+	var signed struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&signed); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("sign = %d %v", w.Code, err)
+	}
+	_, rawQuery, _ := strings.Cut(signed.URL, "?")
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// Signed URLs are served with the access their signer has now
+func TestSignedImageSigner(t *testing.T) {
+	ann := store.User{Username: "ann", Role: RoleEditor}
+	anyone := []config.AccessRule(nil)
+	onlyBob := []config.AccessRule{{Users: []string{"bob"}, Permissions: []string{config.PermRead}}}
+
+	tests := []struct {
+		name   string
+		users  []store.User // Besides an admin
+		access []config.AccessRule
+		status int // 0 if served
+	}{
+		{"signer may read", []store.User{ann}, anyone, 0},
+		{"demoted to viewer", []store.User{{Username: "ann", Role: RoleViewer}}, anyone, 0},
+		{"lost the alias", []store.User{ann}, onlyBob, http.StatusNotFound},
+		{"deleted", nil, anyone, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := sharerHandler(t, tt.users...)
+			h.Config.Images = testImages
+			q := signImage(t, h, &ann, "alias=a&path=p.jpg&w=200")
+			if q.Get("user") != "ann" {
+				t.Fatalf("signed URL %v names no signer", q)
+			}
+			h.Config.Aliases[0].Access = tt.access
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/image?"+q.Encode(), nil)
+			w := httptest.NewRecorder()
+			r, ok := h.signerRequest(w, r)
+			if ok {
+				_, ok = h.aliasProvider(w, r, "a", config.PermRead)
+			}
+			if ok != (tt.status == 0) || (!ok && w.Code != tt.status) {
+				t.Errorf("served = %v with %d, want status %d", ok, w.Code, tt.status)
+			}
+		})
+	}
+
+	t.Run("logins not required", func(t *testing.T) {
+		h := shareHandler(t)
+		h.Config.Images = testImages
+		q := signImage(t, h, publicUser, "alias=a&path=p.jpg")
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image?"+q.Encode(), nil)
+		if _, ok := h.signerRequest(httptest.NewRecorder(), r); !ok {
+			t.Error("URL refused without logins")
+		}
+	})
+}
+
+func TestVerifyImageURL(t *testing.T) {
+	h := &Handler{Config: &config.Config{Images: testImages}}
+	in := func(d time.Duration) string { return strconv.FormatInt(time.Now().Add(d).Unix(), 10) }
+
+	tests := []struct {
+		name   string
+		change func(q url.Values) // Of a valid URL
+		resign bool               // After the change
+		ok     bool
+	}{
+		{"valid", func(q url.Values) {}, false, true},
+		{"tampered width", func(q url.Values) { q.Set("w", "4000") }, false, false},
+		{"tampered signer", func(q url.Values) { q.Set("user", "root") }, false, false},
+		{"tampered expiry", func(q url.Values) { q.Set("expires", in(2*time.Hour)) }, false, false},
+		{"unsigned parameter", func(q url.Values) { q.Set("x", "1") }, false, false},
+		{"unsigned parameter signed along", func(q url.Values) { q.Set("x", "1") }, true, false},
+		{"no signature", func(q url.Values) { q.Del("sig") }, false, false},
+		{"expired", func(q url.Values) { q.Set("expires", in(-time.Second)) }, true, false},
+		{"no expiry", func(q url.Values) { q.Del("expires") }, true, false},
+		{"expires too late", func(q url.Values) { q.Set("expires", in(25*time.Hour)) }, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{"alias": {"a"}, "path": {"p.jpg"}, "w": {"200"}, "user": {"ann"}, "expires": {in(time.Hour)}}
+			q.Set("sig", h.imageSignature(q))
+			tt.change(q)
+			if tt.resign {
+				q.Set("sig", h.imageSignature(q))
+			}
+			if err := h.verifyImageURL(q); (err == nil) != tt.ok {
+				t.Errorf("verifyImageURL(%v) = %v, want ok %v", q, err, tt.ok)
+			}
+		})
+	}
+
+	q := url.Values{"alias": {"a"}, "path": {"p.jpg"}, "expires": {in(time.Hour)}}
+	q.Set("sig", h.imageSignature(q))
+	for _, secret := range []string{"other", ""} {
+		other := &Handler{Config: &config.Config{Images: testImages}}
+		other.Config.Images.Secret = secret
+		if err := other.verifyImageURL(q); err == nil {
+			t.Errorf("URL accepted with secret %q", secret)
+		}
+	}
+}
+
+// Signed URLs always expire, by default after url_ttl_hours
+func TestSignImageTTL(t *testing.T) {
+	tests := []struct {
+		ttl  string
+		want time.Duration // 0 if refused
+	}{
+		{"", time.Hour},
+		{"60", time.Minute},
+		{"86400", 24 * time.Hour},
+		{"86401", 0},
+		{"99999999999999999", 0},
+		{"0", 0},
+		{"-60", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ttl, func(t *testing.T) {
+			h := aclHandler()
+			h.Config.Images = testImages
+			r := requestAs(publicUser)
+			r.URL.RawQuery = url.Values{"alias": {"open"}, "path": {"p.jpg"}, "ttl": {tt.ttl}}.Encode()
+			w := httptest.NewRecorder()
+			h.handleSignImage(w, r)
+			if tt.want == 0 {
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("sign = %d, want %d", w.Code, http.StatusBadRequest)
+				}
+				return
+			}
+
+			var signed struct {
+				URL string `json:"url"`
+			}
+			json.NewDecoder(w.Body).Decode(&signed)
+			_, rawQuery, _ := strings.Cut(signed.URL, "?")
+			q, _ := url.ParseQuery(rawQuery)
+			expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+			if err != nil {
+				t.Fatalf("signed URL %q has no expiry", signed.URL)
+			}
+			if d := time.Until(time.Unix(expires, 0)) - tt.want; d < -5*time.Second || d > 5*time.Second {
+				t.Errorf("expires in %v, want %v", time.Until(time.Unix(expires, 0)), tt.want)
+			}
+			if err := h.verifyImageURL(q); err != nil {
+				t.Errorf("signed URL refused: %v", err)
+			}
+		})
+	}
+}
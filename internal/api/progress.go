@@ -0,0 +1,124 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// finishedUploadTTL is how long a finished upload stays queryable
+const finishedUploadTTL = time.Minute
+
+// uploadTracker keeps the server side progress of running uploads, keyed by
+// the upload_id the client sends along with POST /api/v1/upload and by the
+// login that sent it, so ids chosen by others can't be read or taken over.
+// The bytes of a file count as stored once the provider has consumed them.
+type uploadTracker struct {
+	mu      sync.Mutex
+	uploads map[string]*uploadProgress
+}
+
+type uploadProgress struct {
+	tracker  *uploadTracker
+	id       string
+	Files    []*fileProgress `json:"files"`
+	Done     bool            `json:"done"`
+	finished time.Time
+}
+
+type fileProgress struct {
+	progress *uploadProgress
+	reader   io.Reader
+	Name     string `json:"name"`
+	Bytes    int64  `json:"bytes"`
+	Done     bool   `json:"done"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newUploadTracker() *uploadTracker {
+	return &uploadTracker{uploads: make(map[string]*uploadProgress)}
+}
+
+// uploadOwner identifies the login of r, its session or API token
+func uploadOwner(r *http.Request) string {
+	if s, ok := currentSession(r); ok {
+		return "session:" + s.ID
+	}
+	if t, ok := currentToken(r); ok {
+		return "token:" + t.ID
+	}
+	return ""
+}
+
+// start registers an upload of owner. Uploads without an id are tracked but
+// not queryable.
+func (t *uploadTracker) start(owner, id string) *uploadProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Drop finished uploads nobody asked about
+	for key, u := range t.uploads {
+		if u.Done && time.Since(u.finished) > finishedUploadTTL {
+			delete(t.uploads, key)
+		}
+	}
+
+	u := &uploadProgress{tracker: t, id: id, Files: []*fileProgress{}}
+	if id != "" {
+		t.uploads[owner+"/"+id] = u
+	}
+	return u
+}
+
+func (t *uploadTracker) finish(u *uploadProgress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u.Done = true
+	u.finished = time.Now()
+}
+
+// get returns a copy of the progress of an upload of owner
+func (t *uploadTracker) get(owner, id string) (uploadProgress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.uploads[owner+"/"+id]
+	if !ok {
+		return uploadProgress{}, false
+	}
+	snapshot := uploadProgress{Done: u.Done, Files: make([]*fileProgress, len(u.Files))}
+	for i, f := range u.Files {
+		file := *f
+		snapshot.Files[i] = &file
+	}
+	return snapshot, true
+}
+
+// track wraps the reader of one file so every byte read counts as progress
+func (u *uploadProgress) track(name string, r io.Reader) *fileProgress {
+	u.tracker.mu.Lock()
+	defer u.tracker.mu.Unlock()
+
+	f := &fileProgress{progress: u, reader: r, Name: name}
+	u.Files = append(u.Files, f)
+	return f
+}
+
+func (f *fileProgress) Read(b []byte) (int, error) {
+	n, err := f.reader.Read(b)
+	f.progress.tracker.mu.Lock()
+	f.Bytes += int64(n)
+	f.progress.tracker.mu.Unlock()
+	return n, err
+}
+
+// done marks the file as finished, err is the result of the upload
+func (f *fileProgress) done(err error) {
+	f.progress.tracker.mu.Lock()
+	defer f.progress.tracker.mu.Unlock()
+	f.Done = true
+	if err != nil {
+		f.Error = err.Error()
+	}
+}
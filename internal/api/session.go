@@ -0,0 +1,277 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"photomato/internal/config"
+	"photomato/internal/store"
+)
+
+// activityInterval limits how often the last use of a session or token is written
+const activityInterval = time.Minute
+
+// sessionStore keeps the logins, see config.Sessions. *store.Store is the
+// persisted one.
+type sessionStore interface {
+	Session(id string) (store.Session, bool, error)
+	Sessions(username string) ([]store.Session, error)
+	AddSession(s store.Session) error
+	TouchSession(id string, lastSeen time.Time) error
+	DeleteSession(id string) error
+	DeleteSessions(username, except string) error
+	PruneSessions(idleSince, createdSince time.Time) error
+}
+
+// memorySessions is a sessionStore that forgets everything on restart
+type memorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]store.Session
+}
+
+func newMemorySessions() *memorySessions {
+	return &memorySessions{sessions: make(map[string]store.Session)}
+}
+
+func (m *memorySessions) Session(id string) (store.Session, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	return s, ok, nil
+}
+
+func (m *memorySessions) Sessions(username string) ([]store.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []store.Session
+	for _, s := range m.sessions {
+		if strings.EqualFold(s.Username, username) {
+			sessions = append(sessions, s)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b store.Session) int { return b.LastSeen.Compare(a.LastSeen) })
+	return sessions, nil
+}
+
+func (m *memorySessions) AddSession(s store.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID] = s
+	return nil
+}
+
+func (m *memorySessions) TouchSession(id string, lastSeen time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		s.LastSeen = lastSeen
+		m.sessions[id] = s
+	}
+	return nil
+}
+
+func (m *memorySessions) DeleteSession(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[id]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memorySessions) DeleteSessions(username, except string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if strings.EqualFold(s.Username, username) && id != except {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *memorySessions) PruneSessions(idleSince, createdSince time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if s.LastSeen.Before(idleSince) || s.CreatedAt.Before(createdSince) {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// newSessionStore returns the store configured in cfg
+func newSessionStore(cfg config.Sessions, db *store.Store) sessionStore {
+	if cfg.Store == config.SessionStoreMemory {
+		return newMemorySessions()
+	}
+	return db
+}
+
+// hashToken returns the hash a secret handed to clients is stored as, e.g.
+// the ID of the session of a cookie
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *Handler) idleTimeout() time.Duration {
+	return time.Duration(h.Config.Sessions.IdleTimeoutHours) * time.Hour
+}
+
+func (h *Handler) absoluteTimeout() time.Duration {
+	return time.Duration(h.Config.Sessions.AbsoluteTimeoutHours) * time.Hour
+}
+
+// startSession logs u in with a new random session and sets its cookie
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, u store.User) error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	now := time.Now()
+	err = h.sessions.AddSession(store.Session{
+		ID:        hashToken(token),
+		Username:  u.Username,
+		CreatedAt: now,
+		LastSeen:  now,
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     AuthCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(h.absoluteTimeout().Seconds()),
+	})
+	return nil
+}
+
+// clearSessionCookie removes the login cookie from the client
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     AuthCookieName,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   -1,
+	})
+}
+
+// requestSession returns the live session whose cookie came with r. Timed
+// out sessions are deleted on the way.
+func (h *Handler) requestSession(r *http.Request) (store.Session, bool) {
+	cookie, err := r.Cookie(AuthCookieName)
+	if err != nil || cookie.Value == "" {
+		return store.Session{}, false
+	}
+	s, ok, err := h.sessions.Session(hashToken(cookie.Value))
+	if err != nil || !ok {
+		return store.Session{}, false
+	}
+
+	now := time.Now()
+	if now.Sub(s.LastSeen) > h.idleTimeout() || now.Sub(s.CreatedAt) > h.absoluteTimeout() {
+		h.sessions.DeleteSession(s.ID)
+		return store.Session{}, false
+	}
+	if now.Sub(s.LastSeen) > activityInterval {
+		h.sessions.TouchSession(s.ID, now)
+		s.LastSeen = now
+	}
+	return s, true
+}
+
+// pruneSessions drops the timed out sessions of users who never came back
+func (h *Handler) pruneSessions() error {
+	now := time.Now()
+	return h.sessions.PruneSessions(now.Add(-h.idleTimeout()), now.Add(-h.absoluteTimeout()))
+}
+
+// handleListSessions lists the sessions of the user, marking the one of the request
+func (h *Handler) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	sessions, err := h.sessions.Sessions(u.Username)
+	if err != nil {
+		log.Printf("Failed to list sessions of %s: %v", u.Username, err)
+		http.Error(w, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	current, _ := currentSession(r)
+	type sessionInfo struct {
+		store.Session
+		ExpiresAt time.Time `json:"expires_at"`
+		Current   bool      `json:"current"`
+	}
+	list := []sessionInfo{}
+	for _, s := range sessions {
+		expires := s.LastSeen.Add(h.idleTimeout())
+		if absolute := s.CreatedAt.Add(h.absoluteTimeout()); absolute.Before(expires) {
+			expires = absolute
+		}
+		list = append(list, sessionInfo{Session: s, ExpiresAt: expires, Current: s.ID == current.ID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleDeleteSession ends one session of the user, e.g. on a lost device
+func (h *Handler) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r)
+	s, ok, err := h.sessions.Session(id)
+	if err != nil {
+		http.Error(w, "Failed to end session", http.StatusInternalServerError)
+		return
+	}
+	// Other users' sessions don't exist as far as this user is concerned
+	if !ok || !strings.EqualFold(s.Username, u.Username) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err := h.sessions.DeleteSession(id); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to end session of %s: %v", u.Username, err)
+		http.Error(w, "Failed to end session", http.StatusInternalServerError)
+		return
+	}
+	if current, _ := currentSession(r); current.ID == id {
+		clearSessionCookie(w)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
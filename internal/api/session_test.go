@@ -0,0 +1,112 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"photomato/internal/config"
+	"photomato/internal/store"
+)
+
+// sessionStores returns each kind of session store, empty
+func sessionStores(t *testing.T) map[string]sessionStore {
+	db, err := store.Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]sessionStore{config.SessionStoreDB: db, config.SessionStoreMemory: newMemorySessions()}
+}
+
+func requestWithCookie(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: AuthCookieName, Value: token})
+	return r
+}
+
+func TestRequestSession(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		createdAt time.Time
+		lastSeen  time.Time
+		revoke    bool
+		ok        bool
+	}{
+		{"active", now.Add(-time.Hour), now.Add(-time.Minute), false, true},
+		{"idle timeout", now.Add(-2 * time.Hour), now.Add(-90 * time.Minute), false, false},
+		{"absolute timeout", now.Add(-3 * time.Hour), now.Add(-time.Minute), false, false},
+		{"revoked", now.Add(-time.Hour), now.Add(-time.Minute), true, false},
+	}
+	for kind, sessions := range sessionStores(t) {
+		h := &Handler{
+			Config:   &config.Config{Sessions: config.Sessions{IdleTimeoutHours: 1, AbsoluteTimeoutHours: 2}},
+			sessions: sessions,
+		}
+		for _, tt := range tests {
+			t.Run(kind+"/"+tt.name, func(t *testing.T) {
+				token := kind + tt.name
+				s := store.Session{ID: hashToken(token), Username: "ann", CreatedAt: tt.createdAt, LastSeen: tt.lastSeen}
+				if err := sessions.AddSession(s); err != nil {
+					t.Fatal(err)
+				}
+				if tt.revoke {
+					if err := sessions.DeleteSession(s.ID); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				got, ok := h.requestSession(requestWithCookie(token))
+				if ok != tt.ok {
+					t.Fatalf("requestSession ok = %v, want %v", ok, tt.ok)
+				}
+				_, stored, err := sessions.Session(s.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored != ok {
+					t.Errorf("session stored = %v after the request, want %v", stored, ok)
+				}
+				if ok && !got.LastSeen.After(tt.lastSeen) {
+					t.Errorf("last seen not updated: %v", got.LastSeen)
+				}
+			})
+		}
+
+		t.Run(kind+"/unknown cookie", func(t *testing.T) {
+			if _, ok := h.requestSession(requestWithCookie("nobody")); ok {
+				t.Error("unknown session accepted")
+			}
+		})
+	}
+}
+
+// Logging out everywhere ends every other session of the user only
+func TestDeleteSessions(t *testing.T) {
+	now := time.Now()
+	for kind, sessions := range sessionStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			for _, s := range []store.Session{
+				{ID: "a1", Username: "ann", CreatedAt: now, LastSeen: now},
+				{ID: "a2", Username: "Ann", CreatedAt: now, LastSeen: now},
+				{ID: "a3", Username: "ann", CreatedAt: now, LastSeen: now},
+				{ID: "b1", Username: "bob", CreatedAt: now, LastSeen: now},
+			} {
+				if err := sessions.AddSession(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sessions.DeleteSessions("ann", "a1"); err != nil {
+				t.Fatal(err)
+			}
+			for id, want := range map[string]bool{"a1": true, "a2": false, "a3": false, "b1": true} {
+				if _, ok, _ := sessions.Session(id); ok != want {
+					t.Errorf("session %s kept = %v, want %v", id, ok, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,595 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"photomato/internal/config"
+	"photomato/internal/provider"
+	"photomato/internal/store"
+)
+
+// shareViewCookie holds the grant of an opened share, scoped to its path
+const shareViewCookie = "share_view"
+
+// shareViewTTL is how long opening a share lets the viewer load its photos
+const shareViewTTL = 12 * time.Hour
+
+// A share refuses passwords for shareLockout once shareMaxFailures wrong
+// ones were given within that time
+const (
+	shareMaxFailures = 5
+	shareLockout     = 15 * time.Minute
+)
+
+// shareThrottle counts the wrong passwords given per share
+type shareThrottle struct {
+	mu       sync.Mutex
+	failures map[string]*shareFailures
+}
+
+type shareFailures struct {
+	count int
+	first time.Time
+}
+
+func newShareThrottle() *shareThrottle {
+	return &shareThrottle{failures: make(map[string]*shareFailures)}
+}
+
+// locked reports how long a share still refuses passwords, 0 if it doesn't
+func (t *shareThrottle) locked(id string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.failures[id]
+	if !ok || f.count < shareMaxFailures {
+		return 0
+	}
+	return max(shareLockout-time.Since(f.first), 0)
+}
+
+// fail records a wrong password for a share
+func (t *shareThrottle) fail(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Forget failures too old to count
+	for key, f := range t.failures {
+		if time.Since(f.first) >= shareLockout {
+			delete(t.failures, key)
+		}
+	}
+
+	f, ok := t.failures[id]
+	if !ok {
+		f = &shareFailures{first: time.Now()}
+		t.failures[id] = f
+	}
+	f.count++
+}
+
+// reset forgets the failures of a share once its password was given
+func (t *shareThrottle) reset(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, id)
+}
+
+func (h *Handler) handleListShares(w http.ResponseWriter, r *http.Request) {
+	// Admins see every share, so they can revoke any of them
+	u := currentUser(r)
+	username := u.Username
+	if u.Role == RoleAdmin {
+		username = ""
+	}
+	shares, err := h.Env.Store.Shares(username)
+	if err != nil {
+		log.Printf("Failed to list shares: %v", err)
+		http.Error(w, "Failed to list shares", http.StatusInternalServerError)
+		return
+	}
+
+	type shareInfo struct {
+		store.Share
+		Kind             string `json:"kind"`
+		PasswordRequired bool   `json:"password_required"`
+	}
+	list := []shareInfo{}
+	for _, sh := range shares {
+		list = append(list, shareInfo{Share: sh, Kind: sh.Kind(), PasswordRequired: sh.PasswordHash != ""})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleCreateShare creates a public link to the given photos, or to a
+// folder of an alias, or to the whole alias if neither is given. Only the
+// hash of its token is kept, the response is the one chance to read the link.
+func (h *Handler) handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Alias          string   `json:"alias"`
+		Paths          []string `json:"paths"`
+		Dir            string   `json:"dir"`
+		Password       string   `json:"password"`         // Empty for none
+		ExpiresInHours int      `json:"expires_in_hours"` // 0 for a link that never expires
+		MaxViews       int      `json:"max_views"`        // 0 for no limit
+		AllowDownload  bool     `json:"allow_download"`
+		AllowOriginal  bool     `json:"allow_original"` // Download the original files instead of renderings
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Alias == "" {
+		http.Error(w, "Missing alias", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.aliasProvider(w, r, req.Alias, config.PermRead); !ok {
+		return
+	}
+	// The rule shares are checked against later, or they would die at once
+	if !h.mayShare(currentUser(r), req.Alias) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// Sharing a folder shares its listing too
+	if len(req.Paths) == 0 && !h.can(r, req.Alias, config.PermList) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	dir, err := provider.CleanDir(req.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Paths) > 0 {
+		dir = ""
+	}
+	for i := range req.Paths {
+		photoPath, ok := cleanPhotoPath(w, req.Paths[i])
+		if !ok {
+			return
+		}
+		req.Paths[i] = photoPath
+		rec, ok, err := h.Env.Store.Get(req.Alias, photoPath)
+		if err != nil {
+			http.Error(w, "Failed to create share", http.StatusInternalServerError)
+			return
+		}
+		if !ok || rec.IsDir {
+			http.Error(w, fmt.Sprintf("Photo '%s' not found", photoPath), http.StatusNotFound)
+			return
+		}
+	}
+	if req.AllowOriginal && !req.AllowDownload {
+		http.Error(w, "allow_original needs allow_download", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresInHours < 0 || req.MaxViews < 0 {
+		http.Error(w, "expires_in_hours and max_views must not be negative", http.StatusBadRequest)
+		return
+	}
+	// bcrypt ignores everything beyond
+	if len(req.Password) > 72 {
+		http.Error(w, "Password must have at most 72 bytes", http.StatusBadRequest)
+		return
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Failed to create share", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now()
+	sh := store.Share{
+		ID:            hashToken(token),
+		Username:      currentUser(r).Username,
+		Alias:         req.Alias,
+		Dir:           dir,
+		Paths:         req.Paths,
+		MaxViews:      req.MaxViews,
+		AllowDownload: req.AllowDownload,
+		AllowOriginal: req.AllowOriginal,
+		CreatedAt:     now,
+	}
+	if req.Password != "" {
+		if sh.PasswordHash, err = hashPassword(req.Password); err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.ExpiresInHours > 0 {
+		expires := now.Add(time.Duration(req.ExpiresInHours) * time.Hour)
+		sh.ExpiresAt = &expires
+	}
+	if err := h.Env.Store.AddShare(sh); err != nil {
+		log.Printf("Failed to create share of %s: %v", req.Alias, err)
+		http.Error(w, "Failed to create share", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "created",
+		"share":  sh,
+		"kind":   sh.Kind(),
+		"url":    "/api/v1/public/shares/" + token,
+	})
+}
+
+// handleDeleteShare revokes a share. Users revoke their own, admins any.
+func (h *Handler) handleDeleteShare(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r)
+	sh, ok, err := h.Env.Store.Share(id)
+	if err != nil {
+		http.Error(w, "Failed to delete share", http.StatusInternalServerError)
+		return
+	}
+	if !ok || (u.Role != RoleAdmin && !strings.EqualFold(sh.Username, u.Username)) {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+	if err := h.Env.Store.DeleteShare(id); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to delete share %s: %v", id, err)
+		http.Error(w, "Failed to delete share", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// mayShare reports whether u may share photos of an alias: u is an editor
+// at least and may read the alias
+func (h *Handler) mayShare(u *store.User, aliasName string) bool {
+	return roleRank[u.Role] >= roleRank[RoleEditor] && h.userCan(u, aliasName, config.PermRead)
+}
+
+// sharerCan reports whether the creator of a share may still share it, see
+// mayShare. Shares of deleted accounts are dead.
+func (h *Handler) sharerCan(sh store.Share) bool {
+	if !h.authRequired() {
+		return true
+	}
+	u, ok, err := h.Env.Store.User(sh.Username)
+	if err != nil || !ok {
+		return false
+	}
+	return h.mayShare(&u, sh.Alias)
+}
+
+// publicShare returns the live share of the {token} of r, otherwise it
+// writes the error. Expired and revoked shares look the same, as do shares
+// whose creator lost the access.
+func (h *Handler) publicShare(w http.ResponseWriter, r *http.Request) (store.Share, provider.Provider, bool) {
+	sh, ok, err := h.Env.Store.Share(hashToken(r.PathValue("token")))
+	if err != nil {
+		http.Error(w, "Failed to open share", http.StatusInternalServerError)
+		return sh, nil, false
+	}
+	if !ok || sh.Expired() {
+		http.Error(w, "Share not found or expired", http.StatusNotFound)
+		return sh, nil, false
+	}
+	p, ok := h.Providers[sh.Alias]
+	if !ok || !h.sharerCan(sh) {
+		http.Error(w, "Share not found or expired", http.StatusNotFound)
+		return sh, nil, false
+	}
+	return sh, p, true
+}
+
+// viewedShare is publicShare for requests that load photos, which need the
+// grant of opening the share as cookie or view parameter
+func (h *Handler) viewedShare(w http.ResponseWriter, r *http.Request) (store.Share, provider.Provider, bool) {
+	sh, p, ok := h.publicShare(w, r)
+	if !ok {
+		return sh, nil, false
+	}
+	grant := r.URL.Query().Get("view")
+	if cookie, err := r.Cookie(shareViewCookie); grant == "" && err == nil {
+		grant = cookie.Value
+	}
+	if grant == "" {
+		http.Error(w, "Open the share first", http.StatusUnauthorized)
+		return sh, nil, false
+	}
+	ok, err := h.Env.Store.ShareView(sh.ID, hashToken(grant))
+	if err != nil {
+		http.Error(w, "Failed to open share", http.StatusInternalServerError)
+		return sh, nil, false
+	}
+	if !ok {
+		http.Error(w, "Open the share first", http.StatusUnauthorized)
+		return sh, nil, false
+	}
+	return sh, p, true
+}
+
+// sharedPath returns the alias path of a photo of the public API, where
+// paths are relative to the shared folder, and whether the share includes it
+func sharedPath(sh store.Share, rel string) (string, bool) {
+	if rel == "" {
+		return "", false
+	}
+	if sh.Kind() == store.ShareKindPhotos {
+		return rel, slices.Contains(sh.Paths, rel)
+	}
+	clean, err := provider.CleanDir(rel)
+	if err != nil || clean == "" {
+		return "", false
+	}
+	return path.Join(sh.Dir, clean), true
+}
+
+// shareDetails is what the public API tells about a share
+func shareDetails(sh store.Share) map[string]interface{} {
+	name := sh.Alias
+	if sh.Dir != "" {
+		name = path.Base(sh.Dir)
+	}
+	return map[string]interface{}{
+		"name":              name,
+		"kind":              sh.Kind(),
+		"password_required": sh.PasswordHash != "",
+		"allow_download":    sh.AllowDownload,
+		"allow_original":    sh.AllowOriginal,
+		"expires_at":        sh.ExpiresAt,
+	}
+}
+
+// handlePublicShare describes a share without counting a view, e.g. to ask
+// for the password first
+func (h *Handler) handlePublicShare(w http.ResponseWriter, r *http.Request) {
+	sh, _, ok := h.publicShare(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shareDetails(sh))
+}
+
+// handleOpenShare counts a view of a share and grants loading its photos for
+// a while. The grant is set as cookie and returned for clients without cookies.
+func (h *Handler) handleOpenShare(w http.ResponseWriter, r *http.Request) {
+	sh, _, ok := h.publicShare(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if sh.PasswordHash != "" {
+		// Guessing is throttled per share, whoever asks
+		if wait := h.shareFailures.locked(sh.ID); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "Too many wrong passwords, try again later", http.StatusTooManyRequests)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(sh.PasswordHash), []byte(req.Password)) != nil {
+			h.shareFailures.fail(sh.ID)
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+		h.shareFailures.reset(sh.ID)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Failed to open share", http.StatusInternalServerError)
+		return
+	}
+	grant := base64.RawURLEncoding.EncodeToString(buf)
+	expires := time.Now().Add(shareViewTTL)
+	if sh.ExpiresAt != nil && sh.ExpiresAt.Before(expires) {
+		expires = *sh.ExpiresAt
+	}
+
+	if err := h.Env.Store.PruneShareViews(); err != nil {
+		log.Printf("Failed to prune share views: %v", err)
+	}
+	ok, err := h.Env.Store.AddShareView(sh.ID, hashToken(grant), expires)
+	if err != nil {
+		log.Printf("Failed to open share %s: %v", sh.ID, err)
+		http.Error(w, "Failed to open share", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "The share has no views left", http.StatusGone)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareViewCookie,
+		Value:    grant,
+		Path:     "/api/v1/public/shares/" + r.PathValue("token"),
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	details := shareDetails(sh)
+	details["view"] = grant
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
+}
+
+// handleSharePhotos lists a share. Folders take the listing parameters of
+// GET /api/v1/photos with dir relative to the shared folder, shared photos
+// are listed at once.
+func (h *Handler) handleSharePhotos(w http.ResponseWriter, r *http.Request) {
+	sh, p, ok := h.viewedShare(w, r)
+	if !ok {
+		return
+	}
+
+	if sh.Kind() == store.ShareKindPhotos {
+		photos := []provider.Photo{}
+		for _, photoPath := range sh.Paths {
+			rec, ok, err := h.Env.Store.Get(sh.Alias, photoPath)
+			if err != nil || !ok || rec.IsDir {
+				continue
+			}
+			photos = append(photos, provider.Photo{
+				ID:       rec.Path,
+				Name:     rec.Name,
+				Path:     rec.Path,
+				Size:     rec.Size,
+				ModTime:  rec.ModTime,
+				TakenAt:  rec.TakenAt,
+				Width:    rec.Width,
+				Height:   rec.Height,
+				BlurHash: rec.BlurHash,
+				Color:    rec.Color,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"photos": photos, "next_cursor": ""})
+		return
+	}
+
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := opts.Dir
+	opts.Dir = path.Join(sh.Dir, opts.Dir)
+
+	photos, nextCursor, err := p.List(opts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list photos: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// Nothing above the shared folder is revealed
+	if sh.Dir != "" {
+		for i := range photos {
+			photos[i].Path = strings.TrimPrefix(photos[i].Path, sh.Dir+"/")
+			photos[i].ID = photos[i].Path
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"photos":      photos,
+		"dir":         dir,
+		"recursive":   opts.Recursive,
+		"sort":        opts.Sort,
+		"order":       opts.Order,
+		"next_cursor": nextCursor,
+	})
+}
+
+func (h *Handler) handleShareThumbnail(w http.ResponseWriter, r *http.Request) {
+	sh, p, ok := h.viewedShare(w, r)
+	if !ok {
+		return
+	}
+	photoPath, ok := sharedPath(sh, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	opts, err := thumbOptions(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveThumbnail(w, p, sh.Alias, photoPath, opts)
+}
+
+// handleShareFile serves a shared photo in full size, if the share allows
+// downloads. The photo is rendered anew, which leaves out the metadata of the
+// file. Only shares that allow it send the original file, with original=1.
+// With download=1 it is sent as an attachment.
+func (h *Handler) handleShareFile(w http.ResponseWriter, r *http.Request) {
+	sh, p, ok := h.viewedShare(w, r)
+	if !ok {
+		return
+	}
+	if !sh.AllowDownload {
+		http.Error(w, "Downloads are not allowed for this share", http.StatusForbidden)
+		return
+	}
+	photoPath, ok := sharedPath(sh, r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	key, err := h.renditionKey(sh.Alias, photoPath)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	download := r.URL.Query().Get("download") == "1"
+
+	// Never the URL of the original, it would outlive the share
+	if r.URL.Query().Get("original") == "1" {
+		if !sh.AllowOriginal {
+			http.Error(w, "Originals are not shared", http.StatusForbidden)
+			return
+		}
+		reader, err := p.GetFileReader(photoPath)
+		if err != nil {
+			http.Error(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+		defer reader.Close()
+		if download {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(photoPath)}))
+		}
+		if ct := mime.TypeByExtension(path.Ext(photoPath)); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		io.Copy(w, reader)
+		return
+	}
+
+	cachePath, err := renderEdited(p, key)
+	if err != nil {
+		log.Printf("Render error for %s/%s: %v", sh.Alias, photoPath, err)
+		http.Error(w, "Failed to render photo", http.StatusInternalServerError)
+		return
+	}
+	if download {
+		_, ext := editedFormat(photoPath)
+		name := strings.TrimSuffix(path.Base(photoPath), path.Ext(photoPath)) + ext
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+	http.ServeFile(w, r, cachePath)
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"photomato/internal/config"
+	"photomato/internal/provider"
+	"photomato/internal/store"
+)
+
+func shareHandler(t *testing.T) *Handler {
+	t.Setenv("PHOTOMATO_AUTH_ENABLED", "")
+	db, err := store.Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &Handler{
+		Config:        &config.Config{Aliases: []config.Alias{{Name: "a", Type: config.AliasTypeLocal}}},
+		Env:           provider.Env{Store: db},
+		Providers:     ProviderMap{"a": nil},
+		shareFailures: newShareThrottle(),
+	}
+}
+
+// addShare stores sh under a new token and returns the token
+func addShare(t *testing.T, h *Handler, sh store.Share) string {
+	t.Helper()
+	token := strings.ReplaceAll(t.Name(), "/", "_")
+	sh.ID = hashToken(token)
+	sh.Username = "ann"
+	sh.Alias = "a"
+	sh.CreatedAt = time.Now()
+	if err := h.Env.Store.AddShare(sh); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// serveShare runs a public share route for token and returns the recorder
+func serveShare(h *Handler, f http.HandlerFunc, method, token, query, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/v1/public/shares/"+token+"?"+query, strings.NewReader(body))
+	r.SetPathValue("token", token)
+	w := httptest.NewRecorder()
+	f(w, r)
+	return w
+}
+
+func TestOpenShare(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		share     store.Share
+		passwords []string // One open per password
+		want      []int
+	}{
+		{"open", store.Share{}, []string{"", ""}, []int{http.StatusOK, http.StatusOK}},
+		{"not expired yet", store.Share{ExpiresAt: &future}, []string{""}, []int{http.StatusOK}},
+		{"expired", store.Share{ExpiresAt: &past}, []string{""}, []int{http.StatusNotFound}},
+		{"password", store.Share{PasswordHash: hash}, []string{"", "wrong", "secret"},
+			[]int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusOK}},
+		{"view limit", store.Share{MaxViews: 2}, []string{"", "", ""},
+			[]int{http.StatusOK, http.StatusOK, http.StatusGone}},
+		{"wrong passwords use no views", store.Share{PasswordHash: hash, MaxViews: 1}, []string{"wrong", "secret", "secret"},
+			[]int{http.StatusUnauthorized, http.StatusOK, http.StatusGone}},
+		{"too many wrong passwords", store.Share{PasswordHash: hash}, []string{"1", "2", "3", "4", "5", "secret"},
+			[]int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized,
+				http.StatusTooManyRequests}},
+		{"right password forgets wrong ones", store.Share{PasswordHash: hash}, []string{"1", "2", "3", "4", "secret", "5", "secret"},
+			[]int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusOK,
+				http.StatusUnauthorized, http.StatusOK}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := shareHandler(t)
+			token := addShare(t, h, tt.share)
+			for i, password := range tt.passwords {
+				body, _ := json.Marshal(map[string]string{"password": password})
+				w := serveShare(h, h.handleOpenShare, http.MethodPost, token, "", string(body))
+				if w.Code != tt.want[i] {
+					t.Errorf("open %d = %d %s, want %d", i+1, w.Code, strings.TrimSpace(w.Body.String()), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// Photos load with the grant of opening the share, while the share lives
+func TestShareGrant(t *testing.T) {
+	h := shareHandler(t)
+	token := addShare(t, h, store.Share{Paths: []string{"x.jpg"}})
+
+	if w := serveShare(h, h.handleSharePhotos, http.MethodGet, token, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("photos before opening = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w := serveShare(h, h.handleOpenShare, http.MethodPost, token, "", "")
+	var opened struct {
+		View string `json:"view"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&opened); err != nil || opened.View == "" {
+		t.Fatalf("open returned no grant: %d %v", w.Code, err)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"grant", "view=" + opened.View, http.StatusOK},
+		{"other grant", "view=bogus", http.StatusUnauthorized},
+		{"no grant", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveShare(h, h.handleSharePhotos, http.MethodGet, token, tt.query, ""); w.Code != tt.want {
+				t.Errorf("photos = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	// The token is only stored hashed, its hash opens nothing
+	if w := serveShare(h, h.handlePublicShare, http.MethodGet, hashToken(token), "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("share by its hash = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if err := h.Env.Store.DeleteShare(hashToken(token)); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveShare(h, h.handleSharePhotos, http.MethodGet, token, "view="+opened.View, ""); w.Code != http.StatusNotFound {
+		t.Errorf("photos of a revoked share = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// sharerHandler is shareHandler with logins required, for the given
+// accounts and an admin
+func sharerHandler(t *testing.T, users ...store.User) *Handler {
+	h := shareHandler(t)
+	t.Setenv("PHOTOMATO_AUTH_ENABLED", "true")
+	for _, u := range append(users, store.User{Username: "root", Role: RoleAdmin}) {
+		if err := h.Env.Store.AddUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.countUsers(); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// Shares stop working once their creator could no longer create them
+func TestShareCreatorAccess(t *testing.T) {
+	tests := []struct {
+		name  string
+		users []store.User
+		want  int
+	}{
+		{"editor", []store.User{{Username: "ann", Role: RoleEditor}}, http.StatusOK},
+		{"demoted", []store.User{{Username: "ann", Role: RoleViewer}}, http.StatusNotFound},
+		{"deleted", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := sharerHandler(t, tt.users...)
+			token := addShare(t, h, store.Share{})
+			if w := serveShare(h, h.handlePublicShare, http.MethodGet, token, "", ""); w.Code != tt.want {
+				t.Errorf("share = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	t.Run("lost access to the alias", func(t *testing.T) {
+		h := sharerHandler(t, store.User{Username: "ann", Role: RoleEditor})
+		h.Config.Aliases[0].Access = []config.AccessRule{{Users: []string{"bob"}, Permissions: []string{config.PermRead}}}
+		token := addShare(t, h, store.Share{})
+		if w := serveShare(h, h.handlePublicShare, http.MethodGet, token, "", ""); w.Code != http.StatusNotFound {
+			t.Errorf("share = %d, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+}
+
+// Only those whose shares would work may create them
+func TestCreateShareAccess(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   store.User
+		access []config.AccessRule
+		want   int
+	}{
+		{"editor", store.User{Username: "ann", Role: RoleEditor}, nil, http.StatusCreated},
+		{"viewer", store.User{Username: "ann", Role: RoleViewer}, nil, http.StatusForbidden},
+		{"hidden alias", store.User{Username: "ann", Role: RoleEditor},
+			[]config.AccessRule{{Users: []string{"bob"}, Permissions: []string{config.PermRead}}}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := sharerHandler(t, tt.user)
+			h.Config.Aliases[0].Access = tt.access
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/shares", strings.NewReader(`{"alias":"a"}`))
+			r = r.WithContext(context.WithValue(r.Context(), userKey, &tt.user))
+			w := httptest.NewRecorder()
+			h.handleCreateShare(w, r)
+			if w.Code != tt.want {
+				t.Errorf("create = %d %s, want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"photomato/internal/store"
+)
+
+// tokenPrefix starts every API token, so they are easy to spot in scripts and logs
+const tokenPrefix = "pm_"
+
+// Scopes of an API token, each route needs one of them. Only admin includes
+// the others.
+const (
+	ScopeRead   = "read"   // Browse and download
+	ScopeUpload = "upload" // Upload photos
+	ScopeEdit   = "edit"   // Edit, move, delete and share photos
+	ScopeAdmin  = "admin"  // Everything
+)
+
+// scopeRole is the least role of a user to create a token with the scope
+var scopeRole = map[string]string{ScopeRead: RoleViewer, ScopeUpload: RoleEditor, ScopeEdit: RoleEditor, ScopeAdmin: RoleAdmin}
+
+// tokenAllows reports whether t may use the routes of scope. The user of the
+// token needs the role of the route too.
+func tokenAllows(t store.Token, scope string) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, ScopeAdmin)
+}
+
+// requestToken returns the token and its user of an Authorization header
+func (h *Handler) requestToken(header string) (*store.User, store.Token, bool) {
+	secret, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, store.Token{}, false
+	}
+	t, ok, err := h.Env.Store.TokenByHash(hashToken(secret))
+	if err != nil || !ok {
+		return nil, t, false
+	}
+
+	now := time.Now()
+	if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+		return nil, t, false
+	}
+	u, ok, err := h.Env.Store.User(t.Username)
+	if err != nil || !ok {
+		return nil, t, false
+	}
+	if t.LastUsed == nil || now.Sub(*t.LastUsed) > activityInterval {
+		h.Env.Store.TouchToken(t.ID, now)
+		t.LastUsed = &now
+	}
+	return &u, t, true
+}
+
+// currentToken returns the token a request passed AuthMiddleware with
+func currentToken(r *http.Request) (store.Token, bool) {
+	t, ok := r.Context().Value(tokenKey).(store.Token)
+	return t, ok
+}
+
+func (h *Handler) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	tokens, err := h.Env.Store.Tokens(u.Username)
+	if err != nil {
+		log.Printf("Failed to list tokens of %s: %v", u.Username, err)
+		http.Error(w, "Failed to list tokens", http.StatusInternalServerError)
+		return
+	}
+	if tokens == nil {
+		tokens = []store.Token{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// handleCreateToken creates a token of the user. The response holds the
+// secret, it can't be read again later.
+func (h *Handler) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"` // 0 for a token that never expires
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r)
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		http.Error(w, "Name must have 1 to 64 characters", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "Missing scopes", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		role, ok := scopeRole[scope]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Invalid scope '%s'", scope), http.StatusBadRequest)
+			return
+		}
+		if roleRank[role] > roleRank[u.Role] {
+			http.Error(w, fmt.Sprintf("Scope '%s' needs the %s role", scope, role), http.StatusForbidden)
+			return
+		}
+	}
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "expires_in_days must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	buf := make([]byte, 40)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(buf[8:])
+
+	now := time.Now()
+	t := store.Token{
+		ID:        hex.EncodeToString(buf[:8]),
+		Hash:      hashToken(secret),
+		Username:  u.Username,
+		Name:      req.Name,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		CreatedAt: now,
+	}
+	if req.ExpiresInDays > 0 {
+		expires := now.AddDate(0, 0, req.ExpiresInDays)
+		t.ExpiresAt = &expires
+	}
+	if err := h.Env.Store.AddToken(t); err != nil {
+		log.Printf("Failed to create token for %s: %v", u.Username, err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":  secret,
+		"info":   t,
+		"status": "created",
+	})
+}
+
+// handleDeleteToken revokes a token of the user
+func (h *Handler) handleDeleteToken(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r)
+	if err := h.Env.Store.DeleteToken(u.Username, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to revoke token %s of %s: %v", id, u.Username, err)
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
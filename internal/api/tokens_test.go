@@ -0,0 +1,53 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"photomato/internal/store"
+)
+
+func TestTokenAllows(t *testing.T) {
+	routes := []string{ScopeRead, ScopeUpload, ScopeEdit, ScopeAdmin}
+
+	tests := []struct {
+		scopes []string
+		allows []string // Of routes
+	}{
+		{[]string{ScopeRead}, []string{ScopeRead}},
+		{[]string{ScopeUpload}, []string{ScopeUpload}},
+		{[]string{ScopeEdit}, []string{ScopeEdit}},
+		{[]string{ScopeRead, ScopeUpload}, []string{ScopeRead, ScopeUpload}},
+		{[]string{ScopeAdmin}, routes},
+		{[]string{"unknown"}, nil},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.scopes, ","), func(t *testing.T) {
+			tok := store.Token{Scopes: tt.scopes}
+			for _, route := range routes {
+				want := false
+				for _, s := range tt.allows {
+					want = want || s == route
+				}
+				if got := tokenAllows(tok, route); got != want {
+					t.Errorf("tokenAllows(%v, %s) = %v, want %v", tt.scopes, route, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Every scope can be created by the role its routes need
+func TestScopeRole(t *testing.T) {
+	for scope, want := range map[string]string{
+		ScopeRead:   RoleViewer,
+		ScopeUpload: RoleEditor,
+		ScopeEdit:   RoleEditor,
+		ScopeAdmin:  RoleAdmin,
+	} {
+		if got := scopeRole[scope]; got != want {
+			t.Errorf("scopeRole[%s] = %s, want %s", scope, got, want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"photomato/internal/config"
+	"photomato/internal/provider"
+	"photomato/internal/tus"
+)
+
+// Resumable uploads following the tus 1.0 protocol (https://tus.io/protocols/resumable-upload).
+// Uploads are staged by tus.Store and handed to Provider.Upload once the last
+// byte arrived, so they end up wherever a regular upload of the alias would.
+// The Upload-Metadata of the creation request carries:
+//   alias    - target alias (required)
+//   filename - name of the file (required)
+//   dir      - folder inside the alias (optional)
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,creation-with-upload,termination,expiration"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// checkTusResumable rejects requests speaking another protocol version
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// tusTarget returns the provider and the file path a finished upload is saved to
+func (h *Handler) tusTarget(metadata map[string]string) (provider.Provider, string, error) {
+	p, ok := h.Providers[metadata["alias"]]
+	if !ok {
+		return nil, "", fmt.Errorf("Alias '%s' not found", metadata["alias"])
+	}
+
+	filename := path.Base(strings.ReplaceAll(metadata["filename"], "\\", "/"))
+	if filename == "." || filename == "/" || filename == ".." {
+		return nil, "", fmt.Errorf("Missing filename")
+	}
+
+	dir, err := provider.CleanDir(metadata["dir"])
+	if err != nil {
+		return nil, "", err
+	}
+	return p, path.Join(dir, filename), nil
+}
+
+// tusUpload returns an upload of the user of r, otherwise it writes the error.
+// Uploads of others are not found.
+func (h *Handler) tusUpload(w http.ResponseWriter, r *http.Request, id string) (*tus.Info, bool) {
+	info, err := h.tus.Get(id)
+	if err == nil && !strings.EqualFold(info.Owner, currentUser(r).Username) {
+		err = tus.ErrNotFound
+	}
+	if err != nil {
+		writeTusError(w, id, err)
+		return nil, false
+	}
+	// Access may have changed since the upload was created
+	if _, ok := h.aliasProvider(w, r, info.Metadata["alias"], config.PermUpload); !ok {
+		return nil, false
+	}
+	return info, true
+}
+
+// tusMaxSize is the largest Upload-Length accepted
+func (h *Handler) tusMaxSize() int64 {
+	return int64(h.Config.UploadMaxSizeMB) << 20
+}
+
+// writeTusState sets the headers describing the current state of an upload
+func writeTusState(w http.ResponseWriter, info *tus.Info) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	if info.SavedAs != "" {
+		w.Header().Set("Photomato-Saved-As", info.SavedAs)
+	}
+}
+
+// writeTusError maps errors of tus.Store to status codes
+func writeTusError(w http.ResponseWriter, id string, err error) {
+	switch {
+	case errors.Is(err, tus.ErrNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, tus.ErrOffsetMismatch):
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+	case errors.Is(err, tus.ErrLocked):
+		http.Error(w, "Upload is in use", http.StatusLocked)
+	case errors.Is(err, tus.ErrTooLarge):
+		http.Error(w, "Upload exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, tus.ErrCommitted):
+		http.Error(w, "Upload already saved", http.StatusGone)
+	default:
+		log.Printf("Resumable upload error for %s: %v", id, err)
+		http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+	}
+}
+
+// commitTusUpload saves a complete upload through the provider of its alias
+func (h *Handler) commitTusUpload(info *tus.Info) (*tus.Info, error) {
+	p, target, err := h.tusTarget(info.Metadata)
+	if err != nil {
+		return info, err
+	}
+	return h.tus.Commit(info.ID, func(r io.Reader) (string, error) {
+		return p.Upload(target, r)
+	})
+}
+
+// appendTusData writes the request body to an upload of the user of r and
+// commits it when complete
+func (h *Handler) appendTusData(w http.ResponseWriter, r *http.Request, id string) (*tus.Info, bool) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return nil, false
+	}
+	if _, ok := h.tusUpload(w, r, id); !ok {
+		return nil, false
+	}
+
+	info, err := h.tus.Append(id, offset, r.Body)
+	if err != nil {
+		if info != nil {
+			writeTusState(w, info)
+		}
+		writeTusError(w, id, err)
+		return nil, false
+	}
+
+	if info.Complete() {
+		if info, err = h.commitTusUpload(info); err != nil {
+			// The data stays staged, a PATCH at the final offset retries the commit
+			log.Printf("Failed to save resumable upload %s: %v", id, err)
+			writeTusState(w, info)
+			http.Error(w, fmt.Sprintf("Failed to save upload: %v", err), http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+	return info, true
+}
+
+func (h *Handler) handleTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.tusMaxSize(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > h.tusMaxSize() {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.tusMaxSize(), 10))
+		http.Error(w, "Upload-Length exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := tus.ParseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.aliasProvider(w, r, metadata["alias"], config.PermUpload); !ok {
+		return
+	}
+	if _, _, err := h.tusTarget(metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := h.tus.Create(length, currentUser(r).Username, metadata)
+	if err != nil {
+		log.Printf("Failed to create resumable upload: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/tus/"+info.ID)
+
+	// creation-with-upload: the body holds the first chunk. Empty uploads
+	// are complete already, no PATCH would ever commit them.
+	if r.Header.Get("Content-Type") == tusContentType || length == 0 {
+		r.Header.Set("Upload-Offset", "0")
+		var ok bool
+		if info, ok = h.appendTusData(w, r, info.ID); !ok {
+			return
+		}
+	}
+
+	writeTusState(w, info)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *Handler) handleTusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	info, ok := h.tusUpload(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	writeTusState(w, info)
+	// Saved uploads can't be resumed, the state still tells where they went
+	if info.SavedAs != "" {
+		writeTusError(w, info.ID, tus.ErrCommitted)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) handleTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	info, ok := h.appendTusData(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	writeTusState(w, info)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleTusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	if _, ok := h.tusUpload(w, r, r.PathValue("id")); !ok {
+		return
+	}
+	if err := h.tus.Terminate(r.PathValue("id")); err != nil {
+		writeTusError(w, r.PathValue("id"), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
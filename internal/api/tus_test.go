@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"photomato/internal/config"
+	"photomato/internal/store"
+	"photomato/internal/tus"
+)
+
+// tusHandler saves resumable uploads of at most 1 MB to m as alias "a".
+// ann may upload to it and bob only read it.
+func tusHandler(t *testing.T, m *memProvider, expiry time.Duration) *Handler {
+	staging, err := tus.NewStore(t.TempDir(), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Handler{
+		Config: &config.Config{UploadMaxSizeMB: 1, Aliases: []config.Alias{{Name: "a", Type: config.AliasTypeLocal, Access: []config.AccessRule{
+			{Users: []string{"ann"}, Permissions: []string{config.PermRead, config.PermUpload}},
+			{Users: []string{"bob"}, Permissions: []string{config.PermRead}},
+		}}}},
+		Providers: ProviderMap{"a": m},
+		tus:       staging,
+	}
+}
+
+// tusMetadata encodes key value pairs as an Upload-Metadata header
+func tusMetadata(pairs ...string) string {
+	var encoded []string
+	for i := 0; i < len(pairs); i += 2 {
+		encoded = append(encoded, pairs[i]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[i+1])))
+	}
+	return strings.Join(encoded, ",")
+}
+
+// serveTus runs the tus route for method as u. id is empty for creation,
+// where headers are Upload-Length and Upload-Metadata, otherwise
+// headers is the Upload-Offset of a PATCH.
+func serveTus(h *Handler, u *store.User, method, id, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/v1/tus/"+id, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), userKey, u))
+	r.SetPathValue("id", id)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	w := httptest.NewRecorder()
+
+	switch method {
+	case http.MethodPost:
+		r.Header.Set("Upload-Length", headers[0])
+		r.Header.Set("Upload-Metadata", headers[1])
+		h.handleTusCreate(w, r)
+	case http.MethodHead:
+		h.handleTusHead(w, r)
+	case http.MethodPatch:
+		r.Header.Set("Content-Type", tusContentType)
+		r.Header.Set("Upload-Offset", headers[0])
+		h.handleTusPatch(w, r)
+	case http.MethodDelete:
+		h.handleTusDelete(w, r)
+	}
+	return w
+}
+
+// createTus creates an upload of length bytes as u and returns its id
+func createTus(t *testing.T, h *Handler, u *store.User, length int) string {
+	t.Helper()
+	w := serveTus(h, u, http.MethodPost, "", "", strconv.Itoa(length), tusMetadata("alias", "a", "filename", "p.jpg", "dir", "x"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", w.Code, w.Body.String())
+	}
+	id, ok := strings.CutPrefix(w.Header().Get("Location"), "/api/v1/tus/")
+	if !ok {
+		t.Fatalf("created at %q", w.Header().Get("Location"))
+	}
+	return id
+}
+
+func TestTusCreate(t *testing.T) {
+	ann := &store.User{Username: "ann", Role: RoleEditor}
+	bob := &store.User{Username: "bob", Role: RoleEditor}
+	eve := &store.User{Username: "eve", Role: RoleEditor}
+
+	tests := []struct {
+		name     string
+		user     *store.User
+		length   string
+		metadata string
+		want     int
+	}{
+		{"uploader", ann, "10", tusMetadata("alias", "a", "filename", "p.jpg"), http.StatusCreated},
+		{"at the size cap", ann, "1048576", tusMetadata("alias", "a", "filename", "p.jpg"), http.StatusCreated},
+		{"over the size cap", ann, "1048577", tusMetadata("alias", "a", "filename", "p.jpg"), http.StatusRequestEntityTooLarge},
+		{"no length", ann, "", tusMetadata("alias", "a", "filename", "p.jpg"), http.StatusBadRequest},
+		{"no filename", ann, "10", tusMetadata("alias", "a"), http.StatusBadRequest},
+		{"folder outside the alias", ann, "10", tusMetadata("alias", "a", "filename", "p.jpg", "dir", "../x"), http.StatusBadRequest},
+		{"reader", bob, "10", tusMetadata("alias", "a", "filename", "p.jpg"), http.StatusForbidden},
+		{"hidden alias", eve, "10", tusMetadata("alias", "a", "filename", "p.jpg"), http.StatusNotFound},
+		{"unknown alias", ann, "10", tusMetadata("alias", "b", "filename", "p.jpg"), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tusHandler(t, &memProvider{photos: map[string]string{}}, time.Hour)
+			if w := serveTus(h, tt.user, http.MethodPost, "", "", tt.length, tt.metadata); w.Code != tt.want {
+				t.Errorf("create = %d %s, want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+		})
+	}
+}
+
+func TestTusResume(t *testing.T) {
+	ann := &store.User{Username: "ann", Role: RoleEditor}
+	m := &memProvider{photos: map[string]string{}}
+	h := tusHandler(t, m, time.Hour)
+	id := createTus(t, h, ann, 10)
+
+	steps := []struct {
+		method string
+		body   string
+		offset string
+		want   int
+		at     string // Upload-Offset afterwards
+	}{
+		{http.MethodPatch, "hello", "0", http.StatusNoContent, "5"},
+		{http.MethodHead, "", "", http.StatusOK, "5"},
+		{http.MethodPatch, "hello", "0", http.StatusConflict, "5"},
+		{http.MethodPatch, "world!", "5", http.StatusRequestEntityTooLarge, "10"},
+		{http.MethodPatch, "", "10", http.StatusNoContent, "10"},
+	}
+	for i, s := range steps {
+		w := serveTus(h, ann, s.method, id, s.body, s.offset)
+		if w.Code != s.want || w.Header().Get("Upload-Offset") != s.at {
+			t.Errorf("step %d %s = %d at %q, want %d at %q", i+1, s.method, w.Code, w.Header().Get("Upload-Offset"), s.want, s.at)
+		}
+	}
+
+	// What fit was kept, the last PATCH saved it
+	if m.photos["x/p.jpg"] != "helloworld" {
+		t.Errorf("saved %v", m.photos)
+	}
+	for _, method := range []string{http.MethodHead, http.MethodPatch} {
+		w := serveTus(h, ann, method, id, "", "10")
+		if w.Code != http.StatusGone || w.Header().Get("Photomato-Saved-As") != "x/p.jpg" {
+			t.Errorf("%s after saving = %d saved as %q, want %d", method, w.Code, w.Header().Get("Photomato-Saved-As"), http.StatusGone)
+		}
+	}
+}
+
+// Uploads of others and uploads that ended are not found
+func TestTusNotFound(t *testing.T) {
+	ann := &store.User{Username: "ann", Role: RoleEditor}
+	tests := []struct {
+		name   string
+		user   *store.User
+		expiry time.Duration
+		end    func(t *testing.T, h *Handler, id string)
+	}{
+		{"other user", &store.User{Username: "bob", Role: RoleEditor}, time.Hour, nil},
+		{"expired", ann, -time.Second, nil},
+		{"terminated", ann, time.Hour, func(t *testing.T, h *Handler, id string) {
+			if w := serveTus(h, ann, http.MethodDelete, id, ""); w.Code != http.StatusNoContent {
+				t.Fatalf("terminate = %d", w.Code)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &memProvider{photos: map[string]string{}}
+			h := tusHandler(t, m, tt.expiry)
+			id := createTus(t, h, ann, 10)
+			if tt.end != nil {
+				tt.end(t, h, id)
+			}
+
+			for _, method := range []string{http.MethodHead, http.MethodPatch, http.MethodDelete} {
+				if w := serveTus(h, tt.user, method, id, "helloworld", "0"); w.Code != http.StatusNotFound {
+					t.Errorf("%s = %d, want %d", method, w.Code, http.StatusNotFound)
+				}
+			}
+			if len(m.photos) > 0 {
+				t.Errorf("saved %v", m.photos)
+			}
+		})
+	}
+
+	// Losing access to the alias hides the uploads to it too
+	h := tusHandler(t, &memProvider{photos: map[string]string{}}, time.Hour)
+	id := createTus(t, h, ann, 10)
+	h.Config.Aliases[0].Access = []config.AccessRule{{Users: []string{"bob"}, Permissions: []string{config.PermRead}}}
+	if w := serveTus(h, ann, http.MethodHead, id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD without access = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,289 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"photomato/internal/store"
+)
+
+// minPasswordLength applies to passwords set through the API
+const minPasswordLength = 8
+
+// validRole reports whether role is one of the known roles
+func validRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+func validPassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("Password must have at least %d characters", minPasswordLength)
+	}
+	// bcrypt ignores everything beyond
+	if len(password) > 72 {
+		return fmt.Errorf("Password must have at most 72 bytes")
+	}
+	return nil
+}
+
+func validGroups(groups []string) error {
+	for _, g := range groups {
+		if strings.TrimSpace(g) == "" || strings.Contains(g, ",") {
+			return fmt.Errorf("Invalid group '%s'", g)
+		}
+	}
+	return nil
+}
+
+// lastAdmin reports whether username is the only admin left, who must not be
+// removed or demoted
+func (h *Handler) lastAdmin(username string) (bool, error) {
+	u, ok, err := h.Env.Store.User(username)
+	if err != nil || !ok || u.Role != RoleAdmin {
+		return false, err
+	}
+	n, err := h.Env.Store.CountUsers(RoleAdmin)
+	return n <= 1, err
+}
+
+func (h *Handler) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.Env.Store.Users()
+	if err != nil {
+		log.Printf("Failed to list users: %v", err)
+		http.Error(w, "Failed to list users", http.StatusInternalServerError)
+		return
+	}
+	if users == nil {
+		users = []store.User{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func (h *Handler) handleAddUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string   `json:"username"`
+		Password string   `json:"password"`
+		Role     string   `json:"role"`
+		Groups   []string `json:"groups"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" || len(req.Username) > 64 {
+		http.Error(w, "Username must have 1 to 64 characters", http.StatusBadRequest)
+		return
+	}
+	if !validRole(req.Role) {
+		http.Error(w, fmt.Sprintf("Invalid role '%s'", req.Role), http.StatusBadRequest)
+		return
+	}
+	if err := validPassword(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validGroups(req.Groups); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	u := store.User{Username: req.Username, PasswordHash: hash, Role: req.Role, Groups: req.Groups}
+	if err := h.Env.Store.AddUser(u); err != nil {
+		if errors.Is(err, store.ErrUserExists) {
+			http.Error(w, fmt.Sprintf("User '%s' already exists", req.Username), http.StatusConflict)
+			return
+		}
+		log.Printf("Failed to add user %s: %v", req.Username, err)
+		http.Error(w, "Failed to add user", http.StatusInternalServerError)
+		return
+	}
+	h.hasUsers.Store(true)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "created"})
+}
+
+// handleUpdateUser changes the role or groups, or resets the password of a
+// user, which logs them out everywhere
+func (h *Handler) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string    `json:"username"`
+		Password *string   `json:"password"`
+		Role     *string   `json:"role"`
+		Groups   *[]string `json:"groups"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" {
+		http.Error(w, "Missing username", http.StatusBadRequest)
+		return
+	}
+
+	if req.Role != nil {
+		if !validRole(*req.Role) {
+			http.Error(w, fmt.Sprintf("Invalid role '%s'", *req.Role), http.StatusBadRequest)
+			return
+		}
+		if *req.Role != RoleAdmin {
+			last, err := h.lastAdmin(req.Username)
+			if err != nil {
+				http.Error(w, "Failed to update user", http.StatusInternalServerError)
+				return
+			}
+			if last {
+				http.Error(w, "Cannot demote the last admin", http.StatusConflict)
+				return
+			}
+		}
+	}
+	if req.Groups != nil {
+		if err := validGroups(*req.Groups); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var hash string
+	if req.Password != nil {
+		if err := validPassword(*req.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if hash, err = hashPassword(*req.Password); err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var err error
+	if req.Role != nil {
+		err = h.Env.Store.SetRole(req.Username, *req.Role)
+	}
+	if err == nil && req.Groups != nil {
+		err = h.Env.Store.SetGroups(req.Username, *req.Groups)
+	}
+	if err == nil && req.Password != nil {
+		if err = h.Env.Store.SetPassword(req.Username, hash); err == nil {
+			err = h.sessions.DeleteSessions(req.Username, "")
+		}
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to update user %s: %v", req.Username, err)
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+}
+
+func (h *Handler) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "Missing username", http.StatusBadRequest)
+		return
+	}
+
+	last, err := h.lastAdmin(username)
+	if err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	if last {
+		http.Error(w, "Cannot delete the last admin", http.StatusConflict)
+		return
+	}
+
+	if err := h.Env.Store.DeleteUser(username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to delete user %s: %v", username, err)
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	if err := h.countUsers(); err != nil {
+		log.Printf("Failed to count users: %v", err)
+	}
+	// A new account of the same name must not inherit them
+	if err := h.sessions.DeleteSessions(username, ""); err != nil {
+		log.Printf("Failed to end sessions of %s: %v", username, err)
+	}
+	if err := h.Env.Store.DeleteTokens(username); err != nil {
+		log.Printf("Failed to revoke tokens of %s: %v", username, err)
+	}
+	if err := h.Env.Store.DeleteShares(username); err != nil {
+		log.Printf("Failed to delete shares of %s: %v", username, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// handleChangePassword lets any logged in user replace their own password
+func (h *Handler) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r)
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.OldPassword)) != nil {
+		http.Error(w, "Invalid password", http.StatusForbidden)
+		return
+	}
+	if err := validPassword(req.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err == nil {
+		err = h.Env.Store.SetPassword(u.Username, hash)
+	}
+	if err != nil {
+		log.Printf("Failed to change password of %s: %v", u.Username, err)
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	// Whoever knew the old password is logged out, this session stays
+	current, _ := currentSession(r)
+	if err := h.sessions.DeleteSessions(u.Username, current.ID); err != nil {
+		log.Printf("Failed to end sessions of %s: %v", u.Username, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+}
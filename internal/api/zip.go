@@ -0,0 +1,220 @@
+package api
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"photomato/internal/config"
+	"photomato/internal/provider"
+	"photomato/internal/store"
+)
+
+// zipManifest names the entry listing the files that could not be added
+const zipManifest = "FAILED.txt"
+
+// zipPageSize is how many photos of a folder are listed at a time
+const zipPageSize = 500
+
+// zipFile is one photo to add to the archive
+type zipFile struct {
+	path    string
+	name    string // Name in the archive, before duplicates are renamed
+	modTime time.Time
+}
+
+// handleDownloadZip streams the given photos, or every photo below a folder
+// of an alias, as a ZIP archive. The archive is written while the photos are
+// read, nothing is buffered on disk. The body is JSON or, for plain browser
+// downloads, a form with repeated path fields.
+func (h *Handler) handleDownloadZip(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Alias string   `json:"alias"`
+		Paths []string `json:"paths"` // Photos, flattened into the archive root
+		Dir   string   `json:"dir"`   // Folder to download without paths, "" for the whole alias
+	}
+
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Alias = r.PostForm.Get("alias")
+		req.Paths = r.PostForm["path"]
+		req.Dir = r.PostForm.Get("dir")
+	}
+
+	if req.Alias == "" {
+		http.Error(w, "Missing alias", http.StatusBadRequest)
+		return
+	}
+
+	p, ok := h.aliasProvider(w, r, req.Alias, config.PermRead)
+	if !ok {
+		return
+	}
+	// Downloading a folder reveals its listing too
+	if len(req.Paths) == 0 && !h.can(r, req.Alias, config.PermList) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	dir, err := provider.CleanDir(req.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var files []zipFile
+	archiveName := req.Alias
+	if len(req.Paths) > 0 {
+		for _, photoPath := range req.Paths {
+			photoPath, ok := cleanPhotoPath(w, photoPath)
+			if !ok {
+				return
+			}
+			// Only indexed photos, as for shares
+			rec, ok, err := h.Env.Store.Get(req.Alias, photoPath)
+			if err != nil {
+				http.Error(w, "Failed to list photos", http.StatusInternalServerError)
+				return
+			}
+			if !ok || rec.IsDir {
+				http.Error(w, fmt.Sprintf("Photo '%s' not found", photoPath), http.StatusNotFound)
+				return
+			}
+			files = append(files, zipFile{path: photoPath, name: path.Base(photoPath), modTime: rec.ModTime})
+		}
+	} else {
+		if files, err = zipFolder(p, dir); err != nil {
+			log.Printf("ZIP listing error for %s/%s: %v", req.Alias, dir, err)
+			http.Error(w, "Failed to list photos", http.StatusInternalServerError)
+			return
+		}
+		if dir != "" {
+			archiveName += "-" + path.Base(dir)
+		}
+	}
+	if len(files) == 0 {
+		http.Error(w, "No photos to download", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName + ".zip"}))
+
+	// From here on the status is sent, failures go into the manifest
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool)
+	var failed []string
+
+	for _, f := range files {
+		// Nobody reads the rest once the client is gone
+		if err := r.Context().Err(); err != nil {
+			log.Printf("ZIP of %s stopped: %v", req.Alias, err)
+			return
+		}
+		if err := addZipFile(zw, p, f, uniqueZipName(names, f.name)); err != nil {
+			log.Printf("ZIP error for %s/%s: %v", req.Alias, f.path, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", f.path, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		manifest, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     uniqueZipName(names, zipManifest),
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err == nil {
+			fmt.Fprintf(manifest, "%d of %d files could not be read:\n\n%s\n", len(failed), len(files), strings.Join(failed, "\n"))
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("ZIP error for %s: %v", req.Alias, err)
+	}
+}
+
+// zipFolder lists every photo below dir, named by their path relative to it
+func zipFolder(p provider.Provider, dir string) ([]zipFile, error) {
+	var files []zipFile
+	cursor := ""
+	for {
+		photos, next, err := p.List(provider.ListOptions{
+			Dir:       dir,
+			Recursive: true,
+			Sort:      store.SortName,
+			Order:     store.OrderAsc,
+			Cursor:    cursor,
+			Limit:     zipPageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, photo := range photos {
+			name := photo.Path
+			if dir != "" {
+				name = strings.TrimPrefix(name, dir+"/")
+			}
+			files = append(files, zipFile{path: photo.Path, name: name, modTime: photo.ModTime})
+		}
+		if next == "" {
+			return files, nil
+		}
+		cursor = next
+	}
+}
+
+// addZipFile copies one photo into the archive. The photo is read from before
+// its entry is created, so an unreadable one leaves no empty entry behind.
+func addZipFile(zw *zip.Writer, p provider.Provider, f zipFile, name string) error {
+	file, err := p.GetFileReader(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// S3 objects are only requested on the first read
+	reader := bufio.NewReader(file)
+	if _, err := reader.Peek(1); err != nil && err != io.EOF {
+		return err
+	}
+
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store, // Photos are compressed already
+		Modified: f.modTime,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(entry, reader); err != nil {
+		return fmt.Errorf("incomplete, %v", err)
+	}
+	return nil
+}
+
+// uniqueZipName returns name, or name with a counter if it is taken already
+func uniqueZipName(names map[string]bool, name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	unique := name
+	for i := 1; names[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	names[strings.ToLower(unique)] = true
+	return unique
+}
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"photomato/internal/config"
+	"photomato/internal/provider"
+	"photomato/internal/store"
+)
+
+// memProvider lists, reads and saves photos in memory, for the handlers that
+// only do that. Listed photos it holds no content of fail to read.
+type memProvider struct {
+	provider.Provider
+	listed []string
+	photos map[string]string // Content by path
+	opened []string
+	onOpen func(path string)
+}
+
+func (m *memProvider) List(opts provider.ListOptions) ([]provider.Photo, string, error) {
+	var photos []provider.Photo
+	for _, p := range m.listed {
+		if opts.Dir == "" || strings.HasPrefix(p, opts.Dir+"/") {
+			photos = append(photos, provider.Photo{ID: p, Name: path.Base(p), Path: p})
+		}
+	}
+	return photos, "", nil
+}
+
+func (m *memProvider) GetFileReader(p string) (io.ReadCloser, error) {
+	m.opened = append(m.opened, p)
+	if m.onOpen != nil {
+		m.onOpen(p)
+	}
+	content, ok := m.photos[p]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(strings.NewReader(content)), nil
+}
+
+func (m *memProvider) Upload(p string, data io.Reader) (string, error) {
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return "", err
+	}
+	m.photos[p] = string(content)
+	return p, nil
+}
+
+// zipHandler serves the listed photos, indexed, as alias "a". ann may only
+// read it and bob also list it.
+func zipHandler(t *testing.T, m *memProvider) *Handler {
+	db, err := store.Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, p := range m.listed {
+		if err := db.Put("a", store.Record{Path: p, Name: path.Base(p), ModTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Handler{
+		Config: &config.Config{Aliases: []config.Alias{{Name: "a", Type: config.AliasTypeLocal, Access: []config.AccessRule{
+			{Users: []string{"ann"}, Permissions: []string{config.PermRead}},
+			{Users: []string{"bob"}, Permissions: []string{config.PermList, config.PermRead}},
+		}}}},
+		Env:       provider.Env{Store: db},
+		Providers: ProviderMap{"a": m},
+	}
+}
+
+// downloadZip posts the JSON body to the ZIP route as u
+func downloadZip(h *Handler, u *store.User, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/download/zip", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(context.WithValue(r.Context(), userKey, u))
+	w := httptest.NewRecorder()
+	h.handleDownloadZip(w, r)
+	return w
+}
+
+// zipEntries returns the content of every entry of a ZIP archive by name
+func zipEntries(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[f.Name] = string(content)
+	}
+	return entries
+}
+
+// Downloading a folder lists it, which needs the list permission
+func TestZipPermissions(t *testing.T) {
+	ann := &store.User{Username: "ann", Role: RoleViewer}
+	bob := &store.User{Username: "bob", Role: RoleViewer}
+	eve := &store.User{Username: "eve", Role: RoleViewer}
+
+	tests := []struct {
+		name string
+		user *store.User
+		body string
+		want int
+	}{
+		{"photos with read", ann, `{"alias":"a","paths":["x/1.jpg"]}`, http.StatusOK},
+		{"folder with read", ann, `{"alias":"a","dir":"x"}`, http.StatusForbidden},
+		{"alias with read", ann, `{"alias":"a"}`, http.StatusForbidden},
+		{"folder with list", bob, `{"alias":"a","dir":"x"}`, http.StatusOK},
+		{"hidden alias", eve, `{"alias":"a","paths":["x/1.jpg"]}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &memProvider{listed: []string{"x/1.jpg"}, photos: map[string]string{"x/1.jpg": "one"}}
+			h := zipHandler(t, m)
+			if w := downloadZip(h, tt.user, tt.body); w.Code != tt.want {
+				t.Errorf("download = %d %s, want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+			if tt.want != http.StatusOK && len(m.opened) > 0 {
+				t.Errorf("photos read: %v", m.opened)
+			}
+		})
+	}
+}
+
+func TestZipContent(t *testing.T) {
+	bob := &store.User{Username: "bob", Role: RoleViewer}
+	photos := map[string]string{
+		"1.jpg":        "root",
+		"x/1.jpg":      "x one",
+		"x/2.JPG":      "x two",
+		"x/y/1.jpg":    "y one",
+		"z/1.jpg":      "z one",
+		"z/FAILED.txt": "not a manifest",
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want map[string]string
+	}{
+		{"folder", `{"alias":"a","dir":"x"}`, map[string]string{
+			"1.jpg": "x one", "2.JPG": "x two", "y/1.jpg": "y one",
+		}},
+		{"alias", `{"alias":"a","dir":"/"}`, map[string]string{
+			"1.jpg": "root", "x/1.jpg": "x one", "x/2.JPG": "x two", "x/y/1.jpg": "y one", "z/1.jpg": "z one", "z/FAILED.txt": "not a manifest",
+		}},
+		{"photos flattened, duplicates renamed", `{"alias":"a","paths":["x/1.jpg","z/1.jpg","/1.jpg","x/2.JPG"]}`, map[string]string{
+			"1.jpg": "x one", "1 (1).jpg": "z one", "1 (2).jpg": "root", "2.JPG": "x two",
+		}},
+		{"same photo twice", `{"alias":"a","paths":["x/2.JPG","x/y/../2.JPG"]}`, map[string]string{
+			"2.JPG": "x two", "2 (1).JPG": "x two",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &memProvider{photos: photos}
+			for p := range photos {
+				m.listed = append(m.listed, p)
+			}
+			w := downloadZip(zipHandler(t, m), bob, tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("download = %d %s", w.Code, w.Body.String())
+			}
+			got := zipEntries(t, w.Body.Bytes())
+			if len(got) != len(tt.want) {
+				t.Errorf("entries %v, want %v", got, tt.want)
+			}
+			for name, content := range tt.want {
+				if got[name] != content {
+					t.Errorf("entry %q = %q, want %q", name, got[name], content)
+				}
+			}
+		})
+	}
+}
+
+func TestZipRefused(t *testing.T) {
+	bob := &store.User{Username: "bob", Role: RoleViewer}
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"not indexed", `{"alias":"a","paths":["x/1.jpg","x/gone.jpg"]}`, http.StatusNotFound},
+		{"outside the alias", `{"alias":"a","paths":["../x/1.jpg"]}`, http.StatusBadRequest},
+		{"folder outside the alias", `{"alias":"a","dir":"../x"}`, http.StatusBadRequest},
+		{"empty folder", `{"alias":"a","dir":"empty"}`, http.StatusNotFound},
+		{"no alias", `{"paths":["x/1.jpg"]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &memProvider{listed: []string{"x/1.jpg"}, photos: map[string]string{"x/1.jpg": "one"}}
+			if w := downloadZip(zipHandler(t, m), bob, tt.body); w.Code != tt.want {
+				t.Errorf("download = %d %s, want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+			if len(m.opened) > 0 {
+				t.Errorf("photos read: %v", m.opened)
+			}
+		})
+	}
+}
+
+// Photos that fail to read are listed in a manifest instead, under a name
+// no photo has
+func TestZipManifest(t *testing.T) {
+	bob := &store.User{Username: "bob", Role: RoleViewer}
+	m := &memProvider{
+		listed: []string{"1.jpg", "2.jpg", "3.jpg", "FAILED.txt"},
+		photos: map[string]string{"1.jpg": "one", "3.jpg": "three", "FAILED.txt": "a photo"},
+	}
+	w := downloadZip(zipHandler(t, m), bob, `{"alias":"a"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download = %d %s", w.Code, w.Body.String())
+	}
+
+	got := zipEntries(t, w.Body.Bytes())
+	if got["1.jpg"] != "one" || got["3.jpg"] != "three" || got["FAILED.txt"] != "a photo" {
+		t.Errorf("entries %v", got)
+	}
+	if _, ok := got["2.jpg"]; ok {
+		t.Error("unreadable photo has an entry")
+	}
+	manifest := got["FAILED (1).txt"]
+	if !strings.HasPrefix(manifest, "1 of 4 files could not be read") || !strings.Contains(manifest, "2.jpg: ") {
+		t.Errorf("manifest = %q", manifest)
+	}
+
+	m = &memProvider{listed: []string{"1.jpg"}, photos: map[string]string{"1.jpg": "one"}}
+	w = downloadZip(zipHandler(t, m), bob, `{"alias":"a"}`)
+	if got := zipEntries(t, w.Body.Bytes()); len(got) != 1 {
+		t.Errorf("entries %v, want no manifest", got)
+	}
+}
+
+// A client that disconnects stops the download, the remaining photos are not read
+func TestZipClientGone(t *testing.T) {
+	m := &memProvider{
+		listed: []string{"1.jpg", "2.jpg", "3.jpg"},
+		photos: map[string]string{"1.jpg": "one", "2.jpg": "two", "3.jpg": "three"},
+	}
+	h := zipHandler(t, m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.onOpen = func(string) { cancel() }
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/download/zip", strings.NewReader(`{"alias":"a"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(context.WithValue(ctx, userKey, &store.User{Username: "bob", Role: RoleViewer}))
+	h.handleDownloadZip(httptest.NewRecorder(), r)
+
+	if len(m.opened) != 1 {
+		t.Errorf("read %v after the client left", m.opened)
+	}
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"slices"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -22,17 +25,169 @@ type Alias struct {
 	Region    string    `yaml:"region,omitempty" json:"region,omitempty"`
 	AccessKey string    `yaml:"access_key,omitempty" json:"access_key,omitempty"`
 	SecretKey string    `yaml:"secret_key,omitempty" json:"secret_key,omitempty"`
+
+	// ThumbPrefix keeps the thumbnails of an S3 alias in its bucket below this
+	// prefix, relative to path, so replicas share them. Scans skip it.
+	ThumbPrefix string `yaml:"thumb_prefix,omitempty" json:"thumb_prefix,omitempty"`
+
+	// WarmThumbnails pre-generates thumbnails of photos found by scans in the background
+	WarmThumbnails bool `yaml:"warm_thumbnails,omitempty" json:"warm_thumbnails,omitempty"`
+
+	// Access restricts the alias to the users and groups of its rules. Without
+	// rules everyone may use it as far as their role allows, admins always may.
+	Access []AccessRule `yaml:"access,omitempty" json:"access,omitempty"`
+}
+
+// Permissions on an alias
+const (
+	PermList   = "list"   // See the alias and browse its photos
+	PermRead   = "read"   // Open photos, thumbnails and metadata, download
+	PermUpload = "upload" // Add photos, edit them, and move photos in from other aliases
+	PermDelete = "delete" // Delete photos
+	PermMove   = "move"   // Move photos within or out of the alias
+)
+
+var permissions = []string{PermList, PermRead, PermUpload, PermDelete, PermMove}
+
+// AccessRule grants permissions on an alias to users and members of groups
+type AccessRule struct {
+	Users       []string `yaml:"users,omitempty" json:"users,omitempty"`
+	Groups      []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Permissions []string `yaml:"permissions" json:"permissions"`
+}
+
+// Allows reports whether the rules of a grant perm to username or one of its
+// groups. Usernames compare case-insensitively, as they log in.
+func (a Alias) Allows(username string, groups []string, perm string) bool {
+	if len(a.Access) == 0 {
+		return true
+	}
+	for _, rule := range a.Access {
+		if !slices.Contains(rule.Permissions, perm) {
+			continue
+		}
+		for _, u := range rule.Users {
+			if strings.EqualFold(u, username) {
+				return true
+			}
+		}
+		for _, g := range rule.Groups {
+			if slices.Contains(groups, g) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateAccess checks the permissions named by the access rules
+func (a Alias) ValidateAccess() error {
+	for _, rule := range a.Access {
+		if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+			return fmt.Errorf("access rule of alias %q names no users or groups", a.Name)
+		}
+		for _, perm := range rule.Permissions {
+			if !slices.Contains(permissions, perm) {
+				return fmt.Errorf("unknown permission %q on alias %q", perm, a.Name)
+			}
+		}
+	}
+	return nil
 }
 
 type Config struct {
-	Port    int     `yaml:"port" json:"port"`
-	Aliases []Alias `yaml:"aliases" json:"aliases"`
+	Port     int     `yaml:"port" json:"port"`
+	Database string  `yaml:"database,omitempty" json:"database,omitempty"` // SQLite metadata index
+	Aliases  []Alias `yaml:"aliases" json:"aliases"`
+
+	// UploadPartSizeMB is the S3 multipart part size, one part is buffered per upload.
+	// S3 requires at least 5, 0 uses the client default of 16.
+	UploadPartSizeMB int `yaml:"upload_part_size_mb,omitempty" json:"upload_part_size_mb,omitempty"`
+
+	// UploadDir stages resumable (tus) uploads until they are complete.
+	// Unfinished uploads are dropped after UploadExpiryHours without activity.
+	UploadDir         string `yaml:"upload_dir,omitempty" json:"upload_dir,omitempty"`
+	UploadExpiryHours int    `yaml:"upload_expiry_hours,omitempty" json:"upload_expiry_hours,omitempty"`
+	UploadMaxSizeMB   int    `yaml:"upload_max_size_mb,omitempty" json:"upload_max_size_mb,omitempty"` // Largest resumable upload
+
+	Thumbnails Thumbnails `yaml:"thumbnails,omitempty" json:"thumbnails,omitempty"`
+	Images     Images     `yaml:"images,omitempty" json:"images,omitempty"`
+	Sessions   Sessions   `yaml:"sessions,omitempty" json:"sessions,omitempty"`
+}
+
+// Session stores
+const (
+	SessionStoreDB     = "db"     // In the database, logins survive restarts
+	SessionStoreMemory = "memory" // In memory, a restart logs everyone out
+)
+
+// Sessions configures logins
+type Sessions struct {
+	Store string `yaml:"store,omitempty" json:"store,omitempty"`
+
+	// A session ends after IdleTimeoutHours without requests, and
+	// AbsoluteTimeoutHours after logging in however active it is
+	IdleTimeoutHours     int `yaml:"idle_timeout_hours,omitempty" json:"idle_timeout_hours,omitempty"`
+	AbsoluteTimeoutHours int `yaml:"absolute_timeout_hours,omitempty" json:"absolute_timeout_hours,omitempty"`
+}
+
+// Images configures GET /api/v1/image renditions, which are cached with the thumbnails
+type Images struct {
+	// Secret signs rendition URLs, which then work without logging in.
+	// Empty disables signed URLs.
+	Secret  string `yaml:"secret,omitempty" json:"-"`
+	MaxSize int    `yaml:"max_size,omitempty" json:"max_size,omitempty"` // Largest width or height in pixels
+
+	// Signed URLs expire after URLTTLHours unless signed for longer, up to
+	// MaxURLTTLHours
+	URLTTLHours    int `yaml:"url_ttl_hours,omitempty" json:"url_ttl_hours,omitempty"`
+	MaxURLTTLHours int `yaml:"max_url_ttl_hours,omitempty" json:"max_url_ttl_hours,omitempty"`
+}
+
+// Thumbnails configures the generated thumbnail variants
+type Thumbnails struct {
+	Sizes       []int    `yaml:"sizes,omitempty" json:"sizes,omitempty"`               // Widths clients may request
+	DefaultSize int      `yaml:"default_size,omitempty" json:"default_size,omitempty"` // Width when none is requested
+	Quality     int      `yaml:"quality,omitempty" json:"quality,omitempty"`           // JPEG and WebP quality, 1-100
+	Formats     []string `yaml:"formats,omitempty" json:"formats,omitempty"`           // Enabled formats: jpeg, webp
+	Workers     int      `yaml:"workers,omitempty" json:"workers,omitempty"`           // Thumbnails generated at once, 0 for one per CPU
+	WarmSizes   []int    `yaml:"warm_sizes,omitempty" json:"warm_sizes,omitempty"`     // Widths pre-generated for aliases with warm_thumbnails, default_size if empty
+
+	// The cache drops the least recently used thumbnails beyond CacheMaxMB
+	// and those unused for CacheMaxAgeDays, 0 disables either limit
+	CacheDir        string `yaml:"cache_dir,omitempty" json:"cache_dir,omitempty"`
+	CacheMaxMB      int64  `yaml:"cache_max_mb,omitempty" json:"cache_max_mb,omitempty"`
+	CacheMaxAgeDays int    `yaml:"cache_max_age_days,omitempty" json:"cache_max_age_days,omitempty"`
 }
 
 func Load(path string) (*Config, error) {
 	// Default config
 	cfg := &Config{
-		Port: 8080,
+		Port:              8080,
+		Database:          "./data/photomato.db",
+		UploadDir:         "./data/uploads",
+		UploadExpiryHours: 24,
+		UploadMaxSizeMB:   4096,
+		Thumbnails: Thumbnails{
+			Sizes:       []int{200, 400, 800, 1600},
+			DefaultSize: 400,
+			Quality:     80,
+			Formats:     []string{"webp", "jpeg"},
+
+			CacheDir:        "./cache/thumbnails",
+			CacheMaxMB:      1024,
+			CacheMaxAgeDays: 30,
+		},
+		Images: Images{
+			MaxSize:        4096,
+			URLTTLHours:    24,
+			MaxURLTTLHours: 30 * 24,
+		},
+		Sessions: Sessions{
+			Store:                SessionStoreDB,
+			IdleTimeoutHours:     7 * 24,
+			AbsoluteTimeoutHours: 30 * 24,
+		},
 	}
 
 	data, err := os.ReadFile(path)
@@ -47,9 +202,90 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if cfg.UploadPartSizeMB != 0 && cfg.UploadPartSizeMB < 5 {
+		return nil, fmt.Errorf("upload_part_size_mb must be at least 5, got %d", cfg.UploadPartSizeMB)
+	}
+	if cfg.UploadExpiryHours <= 0 {
+		return nil, fmt.Errorf("upload_expiry_hours must be positive, got %d", cfg.UploadExpiryHours)
+	}
+	if cfg.UploadMaxSizeMB <= 0 {
+		return nil, fmt.Errorf("upload_max_size_mb must be positive, got %d", cfg.UploadMaxSizeMB)
+	}
+
+	if err := cfg.Thumbnails.validate(); err != nil {
+		return nil, err
+	}
+	for _, a := range cfg.Aliases {
+		if err := a.ValidateAccess(); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.Images.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Sessions.validate(); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+func (t Thumbnails) validate() error {
+	if len(t.Sizes) == 0 {
+		return fmt.Errorf("thumbnail sizes must not be empty")
+	}
+	for _, size := range t.Sizes {
+		if size <= 0 || size > 4096 {
+			return fmt.Errorf("thumbnail size %d is out of range", size)
+		}
+	}
+	// Only configured sizes are generated, others would never be served
+	if !slices.Contains(t.Sizes, t.DefaultSize) {
+		return fmt.Errorf("thumbnail default_size %d is not one of the sizes", t.DefaultSize)
+	}
+	for _, size := range t.WarmSizes {
+		if !slices.Contains(t.Sizes, size) {
+			return fmt.Errorf("thumbnail warm size %d is not one of the sizes", size)
+		}
+	}
+
+	if t.Quality < 1 || t.Quality > 100 {
+		return fmt.Errorf("thumbnail quality must be between 1 and 100, got %d", t.Quality)
+	}
+	if t.Workers < 0 {
+		return fmt.Errorf("thumbnail workers must not be negative, got %d", t.Workers)
+	}
+	if t.CacheMaxMB < 0 || t.CacheMaxAgeDays < 0 {
+		return fmt.Errorf("thumbnail cache limits must not be negative")
+	}
+	for _, f := range t.Formats {
+		if f != "jpeg" && f != "webp" {
+			return fmt.Errorf("unknown thumbnail format %q", f)
+		}
+	}
+	return nil
+}
+
+func (i Images) validate() error {
+	if i.MaxSize <= 0 {
+		return fmt.Errorf("images max_size must be positive, got %d", i.MaxSize)
+	}
+	if i.URLTTLHours <= 0 || i.MaxURLTTLHours < i.URLTTLHours {
+		return fmt.Errorf("images url_ttl_hours must be positive and at most max_url_ttl_hours")
+	}
+	return nil
+}
+
+func (s Sessions) validate() error {
+	if s.Store != SessionStoreDB && s.Store != SessionStoreMemory {
+		return fmt.Errorf("unknown session store %q", s.Store)
+	}
+	if s.IdleTimeoutHours <= 0 || s.AbsoluteTimeoutHours <= 0 {
+		return fmt.Errorf("session timeouts must be positive")
+	}
+	return nil
+}
+
 func (c *Config) Save(path string) error {
 	data, err := yaml.Marshal(c)
 	if err != nil {
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+type Type string
+
+const (
+	PhotoAdded     Type = "photo.added"
+	PhotoRemoved   Type = "photo.removed"
+	PhotoMoved     Type = "photo.moved"
+	PhotoUpdated   Type = "photo.updated"
+	ScanStarted    Type = "scan.started"
+	ScanFinished   Type = "scan.finished"
+	AliasAdded     Type = "alias.added"
+	AliasRemoved   Type = "alias.removed"
+	ThumbnailReady Type = "thumbnail.ready"
+
+	// Resync tells a reconnecting client that it missed events and should reload
+	Resync Type = "resync"
+)
+
+// Event is a change in the library
+type Event struct {
+	ID    uint64     `json:"id"`
+	Type  Type       `json:"type"`
+	Time  time.Time  `json:"time"`
+	Alias string     `json:"alias,omitempty"`
+	Path  string     `json:"path,omitempty"`
+	From  string     `json:"from,omitempty"` // photo.moved: the previous path
+	Scan  *ScanStats `json:"scan,omitempty"` // scan.finished
+}
+
+// ScanStats summarizes a finished scan
+type ScanStats struct {
+	Added    int    `json:"added"`
+	Updated  int    `json:"updated"`
+	Removed  int    `json:"removed"`
+	Total    int    `json:"total"`
+	Duration int64  `json:"duration_ms"`
+	Error    string `json:"error,omitempty"`
+}
+
+// historySize is how many recent events are kept for reconnecting clients.
+// Subscribers are buffered as much, so a replay always fits.
+const historySize = 256
+
+// Bus fans events out to subscribers. A subscriber that falls behind is
+// dropped instead of blocking publishers, it reconnects and catches up from
+// the history. A nil Bus discards everything.
+type Bus struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []Event
+	subs    map[chan Event]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[chan Event]struct{})}
+}
+
+// Publish assigns the event its id and time and delivers it
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	e.ID = b.nextID
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.history = append(b.history, e)
+	if len(b.history) > historySize {
+		b.history = b.history[len(b.history)-historySize:]
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a func to stop receiving them.
+// With after > 0 the events published since that id are replayed first, or a
+// Resync event if they are no longer known. The channel is closed when the
+// subscriber is dropped.
+func (b *Bus) Subscribe(after uint64) (<-chan Event, func()) {
+	ch := make(chan Event, historySize)
+
+	b.mu.Lock()
+	if after > 0 {
+		if after > b.nextID || (len(b.history) > 0 && after < b.history[0].ID-1) {
+			// Unknown id, e.g. from before a restart, or too far behind
+			ch <- Event{ID: b.nextID, Type: Resync, Time: time.Now()}
+		} else {
+			for _, e := range b.history {
+				if e.ID > after {
+					ch <- e
+				}
+			}
+		}
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
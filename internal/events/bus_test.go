@@ -0,0 +1,137 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+)
+
+// publish publishes n photo events
+func publish(b *Bus, n int) {
+	for i := range n {
+		b.Publish(Event{Type: PhotoAdded, Alias: "a", Path: fmt.Sprintf("p%d.jpg", i)})
+	}
+}
+
+// drain returns the ids and types of the events waiting on ch, and whether ch
+// is still open
+func drain(ch <-chan Event) (ids []uint64, types []Type, open bool) {
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return ids, types, false
+			}
+			ids = append(ids, e.ID)
+			types = append(types, e.Type)
+		default:
+			return ids, types, true
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	b := NewBus()
+	ch, cancel := b.Subscribe(0)
+	defer cancel()
+
+	publish(b, 3)
+	for want := uint64(1); want <= 3; want++ {
+		e := <-ch
+		if e.ID != want || e.Time.IsZero() || e.Type != PhotoAdded {
+			t.Errorf("event %d = %+v", want, e)
+		}
+	}
+
+	var nilBus *Bus
+	nilBus.Publish(Event{Type: PhotoAdded}) // Discarded
+}
+
+// Reconnecting clients get what they missed, or are told to reload
+func TestSubscribeReplay(t *testing.T) {
+	tests := []struct {
+		name      string
+		published int
+		after     uint64
+		want      []uint64 // nil for a resync
+	}{
+		{"new client", 5, 0, []uint64{}},
+		{"missed some", 5, 2, []uint64{3, 4, 5}},
+		{"missed none", 5, 5, []uint64{}},
+		{"too far behind", historySize + 10, 5, nil},
+		{"unknown id", 5, 9, nil},
+		{"before a restart", 0, 3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBus()
+			publish(b, tt.published)
+			ch, cancel := b.Subscribe(tt.after)
+			defer cancel()
+
+			ids, types, _ := drain(ch)
+			if tt.want == nil {
+				if len(types) != 1 || types[0] != Resync || ids[0] != uint64(tt.published) {
+					t.Errorf("replayed %v %v, want a resync at %d", ids, types, tt.published)
+				}
+				return
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+				t.Errorf("replayed %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+// The history keeps the last historySize events, all of them are replayed
+func TestSubscribeReplayWholeHistory(t *testing.T) {
+	b := NewBus()
+	publish(b, historySize+10)
+
+	// The oldest kept event is 11, so a client that saw 10 missed nothing lost
+	ch, cancel := b.Subscribe(10)
+	defer cancel()
+	ids, _, _ := drain(ch)
+	if len(ids) != historySize || ids[0] != 11 || ids[len(ids)-1] != historySize+10 {
+		t.Errorf("replayed %d events from %v", len(ids), ids[:1])
+	}
+
+	ch, cancel = b.Subscribe(9)
+	defer cancel()
+	if _, types, _ := drain(ch); len(types) != 1 || types[0] != Resync {
+		t.Errorf("replayed %v after a lost event, want a resync", types)
+	}
+}
+
+// A subscriber that does not keep up is dropped, publishers never block
+func TestSlowSubscriber(t *testing.T) {
+	b := NewBus()
+	slow, cancelSlow := b.Subscribe(0)
+	defer cancelSlow()
+	fast, cancelFast := b.Subscribe(0)
+	defer cancelFast()
+
+	publish(b, historySize)
+	if ids, _, open := drain(fast); len(ids) != historySize || !open {
+		t.Fatalf("fast subscriber got %d events, open %v", len(ids), open)
+	}
+	publish(b, 1)
+
+	ids, _, open := drain(slow)
+	if open || len(ids) != historySize {
+		t.Errorf("slow subscriber got %d events, open %v, want dropped after %d", len(ids), open, historySize)
+	}
+	if ids, _, open := drain(fast); len(ids) != 1 || !open {
+		t.Errorf("fast subscriber got %v, open %v", ids, open)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	b := NewBus()
+	ch, cancel := b.Subscribe(0)
+	cancel()
+	cancel() // Twice is fine
+	if _, ok := <-ch; ok {
+		t.Error("channel open after cancel")
+	}
+	publish(b, 1) // Not delivered to the closed channel
+}
@@ -0,0 +1,222 @@
+package meta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ErrNoExif is returned when a file carries no EXIF block
+var ErrNoExif = errors.New("no exif data")
+
+// ErrNoPreview is returned when the EXIF block embeds no thumbnail
+var ErrNoPreview = errors.New("no embedded thumbnail")
+
+// maxChunkSize caps the EXIF chunk read from PNG and WebP containers
+const maxChunkSize = 4 << 20
+
+// Exif holds the EXIF fields Photomato cares about
+type Exif struct {
+	TakenAt      time.Time `json:"taken_at,omitzero"` // DateTimeOriginal
+	Make         string    `json:"make,omitempty"`
+	Model        string    `json:"model,omitempty"`
+	Lens         string    `json:"lens,omitempty"`
+	ExposureTime string    `json:"exposure_time,omitempty"` // e.g. "1/250"
+	FNumber      float64   `json:"f_number,omitempty"`
+	ISO          int       `json:"iso,omitempty"`
+	FocalLength  float64   `json:"focal_length,omitempty"` // mm
+	Orientation  int       `json:"orientation,omitempty"`  // 1-8, 0 if unknown
+	Latitude     *float64  `json:"latitude,omitempty"`
+	Longitude    *float64  `json:"longitude,omitempty"`
+}
+
+// ReadExif extracts the EXIF block of a JPEG, PNG or WebP image.
+// name is only used to pick the container format from its extension.
+func ReadExif(r io.Reader, name string) (*Exif, error) {
+	var x *exif.Exif
+	var err error
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		x, err = exif.Decode(r)
+	case ".png":
+		x, err = decodeChunk(findPNGChunk(r, "eXIf"))
+	case ".webp":
+		x, err = decodeChunk(findWebPChunk(r, "EXIF", 0x08))
+	default:
+		return nil, ErrNoExif
+	}
+	// goexif reports partially broken blocks as non critical errors
+	if err != nil && (x == nil || exif.IsCriticalError(err)) {
+		if errors.Is(err, ErrNoExif) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrNoExif, err)
+	}
+
+	return fromExif(x), nil
+}
+
+// ReadPreview extracts the thumbnail embedded in the EXIF block of a JPEG,
+// together with the orientation it has to be shown in (0 if unknown)
+func ReadPreview(r io.Reader) ([]byte, int, error) {
+	x, err := exif.Decode(r)
+	if err != nil && (x == nil || exif.IsCriticalError(err)) {
+		return nil, 0, fmt.Errorf("%w: %v", ErrNoExif, err)
+	}
+
+	data, err := x.JpegThumbnail()
+	if err != nil {
+		return nil, 0, ErrNoPreview
+	}
+	orientation := 0
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		orientation, _ = tag.Int(0)
+	}
+	return data, orientation, nil
+}
+
+func decodeChunk(data []byte, err error) (*exif.Exif, error) {
+	if err != nil {
+		return nil, err
+	}
+	return exif.Decode(bytes.NewReader(data))
+}
+
+// findPNGChunk returns the data of the first chunk of the given type
+func findPNGChunk(r io.Reader, chunkType string) ([]byte, error) {
+	br := bufio.NewReader(r)
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(br, signature); err != nil || string(signature) != "\x89PNG\r\n\x1a\n" {
+		return nil, ErrNoExif
+	}
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return nil, ErrNoExif
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:]) {
+		case chunkType:
+			if length > maxChunkSize {
+				return nil, ErrNoExif
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return nil, ErrNoExif
+			}
+			return data, nil
+		case "IEND":
+			return nil, ErrNoExif
+		}
+		// Skip data and CRC
+		if _, err := br.Discard(int(length) + 4); err != nil {
+			return nil, ErrNoExif
+		}
+	}
+}
+
+// findWebPChunk returns the data of the first RIFF chunk with the given FourCC,
+// if flag is set in the extended format header
+func findWebPChunk(r io.Reader, fourCC string, flag byte) ([]byte, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return nil, ErrNoExif
+	}
+	// Only the extended format carries metadata and its header tells which,
+	// so the image data of the others is never read through
+	if first, err := br.Peek(9); err != nil || string(first[:4]) != "VP8X" || first[8]&flag == 0 {
+		return nil, ErrNoExif
+	}
+
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, ErrNoExif
+		}
+		length := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if string(chunk[:4]) == fourCC {
+			if length > maxChunkSize {
+				return nil, ErrNoExif
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return nil, ErrNoExif
+			}
+			return data, nil
+		}
+		// Chunks are padded to an even size
+		if _, err := br.Discard(int(length + length&1)); err != nil {
+			return nil, ErrNoExif
+		}
+	}
+}
+
+func fromExif(x *exif.Exif) *Exif {
+	e := &Exif{
+		Make:  tagString(x, exif.Make),
+		Model: tagString(x, exif.Model),
+		Lens:  tagString(x, exif.LensModel),
+	}
+
+	if t, err := x.DateTime(); err == nil {
+		e.TakenAt = t
+	}
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && den != 0 {
+			if num > 0 && num < den {
+				e.ExposureTime = fmt.Sprintf("1/%d", (den+num/2)/num)
+			} else {
+				e.ExposureTime = fmt.Sprintf("%g", float64(num)/float64(den))
+			}
+		}
+	}
+	e.FNumber = tagRat(x, exif.FNumber)
+	e.FocalLength = tagRat(x, exif.FocalLength)
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		e.ISO, _ = tag.Int(0)
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		e.Orientation, _ = tag.Int(0)
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		e.Latitude = &lat
+		e.Longitude = &long
+	}
+
+	return e
+}
+
+func tagString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func tagRat(x *exif.Exif, name exif.FieldName) float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
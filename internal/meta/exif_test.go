@@ -0,0 +1,229 @@
+package meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// tag is an IFD entry of a test EXIF block, its value a string, a uint16
+// or a [2]uint32 rational
+type tag struct {
+	id    uint16
+	value any
+}
+
+// exifBlock lays out a little endian TIFF block with ifd0 and, if not empty,
+// an EXIF sub IFD
+func exifBlock(ifd0, sub []tag) []byte {
+	ifdSize := func(tags []tag) int { return 2 + 12*len(tags) + 4 }
+	if len(sub) > 0 {
+		ifd0 = append(ifd0, tag{0x8769, uint32(8 + ifdSize(ifd0) + 12)})
+	}
+	dataAt := 8 + ifdSize(ifd0)
+	if len(sub) > 0 {
+		dataAt += ifdSize(sub)
+	}
+
+	var ifds, data bytes.Buffer
+	put := func(b *bytes.Buffer, values ...any) {
+		for _, v := range values {
+			binary.Write(b, binary.LittleEndian, v)
+		}
+	}
+	writeIFD := func(tags []tag) {
+		put(&ifds, uint16(len(tags)))
+		for _, t := range tags {
+			put(&ifds, t.id)
+			switch v := t.value.(type) {
+			case string:
+				s := append([]byte(v), 0)
+				put(&ifds, uint16(2), uint32(len(s)))
+				if len(s) <= 4 {
+					ifds.Write(append(s, make([]byte, 4-len(s))...))
+					continue
+				}
+				put(&ifds, uint32(dataAt+data.Len()))
+				data.Write(s)
+			case uint16:
+				put(&ifds, uint16(3), uint32(1), v, uint16(0))
+			case uint32:
+				put(&ifds, uint16(4), uint32(1), v)
+			case [2]uint32:
+				put(&ifds, uint16(5), uint32(1), uint32(dataAt+data.Len()))
+				put(&data, v)
+			}
+		}
+		put(&ifds, uint32(0))
+	}
+	writeIFD(ifd0)
+	if len(sub) > 0 {
+		writeIFD(sub)
+	}
+	return append(append([]byte("II*\x00\x08\x00\x00\x00"), ifds.Bytes()...), data.Bytes()...)
+}
+
+// The containers of an EXIF block, with other data around it
+func jpegWith(block []byte) []byte {
+	app1 := append([]byte("Exif\x00\x00"), block...)
+	b := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	b = binary.BigEndian.AppendUint16(b, uint16(2+len(app1)))
+	return append(append(b, app1...), 0xFF, 0xD9)
+}
+
+func pngWith(block []byte) []byte {
+	b := []byte("\x89PNG\r\n\x1a\n")
+	chunk := func(typ string, data []byte) {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+		b = append(append(append(b, typ...), data...), 0, 0, 0, 0)
+	}
+	chunk("IHDR", make([]byte, 13))
+	if block != nil {
+		chunk("eXIf", block)
+	}
+	chunk("IEND", nil)
+	return b
+}
+
+func webpWith(block []byte) []byte {
+	var b []byte
+	chunk := func(fourCC string, data []byte) {
+		b = binary.LittleEndian.AppendUint32(append(b, fourCC...), uint32(len(data)))
+		b = append(b, data...)
+		if len(data)%2 == 1 {
+			b = append(b, 0)
+		}
+	}
+	header := make([]byte, 10)
+	if block != nil {
+		header[0] = 0x08 // EXIF flag
+	}
+	chunk("VP8X", header)
+	chunk("ICCP", make([]byte, 3)) // Padded
+	if block != nil {
+		chunk("EXIF", block)
+	}
+	return append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(4+len(b))), append([]byte("WEBP"), b...)...)
+}
+
+func TestReadExif(t *testing.T) {
+	block := exifBlock(
+		[]tag{{0x010F, "Canon"}, {0x0110, "EOS R5\x00\x00"}, {0x0112, uint16(6)}},
+		[]tag{
+			{0x829A, [2]uint32{1, 250}},
+			{0x829D, [2]uint32{28, 10}},
+			{0x8827, uint16(400)},
+			{0x9003, "2024:05:17 14:03:09"},
+			{0x920A, [2]uint32{50, 1}},
+			{0xA434, " RF50mm F1.8 STM "},
+		},
+	)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"photo.jpg", jpegWith(block)},
+		{"PHOTO.JPEG", jpegWith(block)},
+		{"photo.png", pngWith(block)},
+		{"photo.webp", webpWith(block)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ReadExif(bytes.NewReader(tt.data), tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Make != "Canon" || e.Model != "EOS R5" || e.Lens != "RF50mm F1.8 STM" {
+				t.Errorf("camera = %q %q %q", e.Make, e.Model, e.Lens)
+			}
+			if got := e.TakenAt.Format("2006-01-02 15:04:05"); got != "2024-05-17 14:03:09" {
+				t.Errorf("taken at %s", got)
+			}
+			if e.ExposureTime != "1/250" || e.FNumber != 2.8 || e.ISO != 400 || e.FocalLength != 50 {
+				t.Errorf("exposure = %s f/%g ISO %d %gmm", e.ExposureTime, e.FNumber, e.ISO, e.FocalLength)
+			}
+			if e.Orientation != 6 {
+				t.Errorf("orientation = %d, want 6", e.Orientation)
+			}
+			if e.Latitude != nil || e.Longitude != nil {
+				t.Error("location without GPS data")
+			}
+		})
+	}
+}
+
+// Orientation and exposure are read as the viewer expects them
+func TestReadExifValues(t *testing.T) {
+	tests := []struct {
+		name        string
+		tags        []tag
+		orientation int
+		exposure    string
+	}{
+		{"no orientation", nil, 0, ""},
+		{"upright", []tag{{0x0112, uint16(1)}}, 1, ""},
+		{"turned", []tag{{0x0112, uint16(8)}}, 8, ""},
+		{"fraction", []tag{{0x829A, [2]uint32{10, 4000}}}, 0, "1/400"},
+		{"rounded fraction", []tag{{0x829A, [2]uint32{10, 13}}}, 0, "1/1"},
+		{"seconds", []tag{{0x829A, [2]uint32{5, 2}}}, 0, "2.5"},
+		{"whole seconds", []tag{{0x829A, [2]uint32{30, 1}}}, 0, "30"},
+		{"zero denominator", []tag{{0x829A, [2]uint32{1, 0}}}, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ifd0, sub []tag
+			for _, tg := range tt.tags {
+				if tg.id == 0x0112 {
+					ifd0 = append(ifd0, tg)
+				} else {
+					sub = append(sub, tg)
+				}
+			}
+			ifd0 = append(ifd0, tag{0x010F, "Canon"})
+			e, err := ReadExif(bytes.NewReader(jpegWith(exifBlock(ifd0, sub))), "a.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Orientation != tt.orientation || e.ExposureTime != tt.exposure {
+				t.Errorf("orientation %d exposure %q, want %d %q", e.Orientation, e.ExposureTime, tt.orientation, tt.exposure)
+			}
+		})
+	}
+}
+
+func TestReadExifMissing(t *testing.T) {
+	block := exifBlock([]tag{{0x010F, "Canon"}}, nil)
+	oversized := webpWith(nil)
+	oversized[20] = 0x08
+	oversized = append(oversized, "EXIF\xff\xff\xff\x7f"...)
+	unflagged := webpWith(block)
+	unflagged[20] = 0
+	simple := []byte("RIFF\x0e\x00\x00\x00WEBPVP8 \x02\x00\x00\x00\x00\x00")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"plain.jpg", []byte{0xFF, 0xD8, 0xFF, 0xD9}},
+		{"plain.png", pngWith(nil)},
+		{"plain.webp", webpWith(nil)},
+		{"truncated.png", pngWith(block)[:40]},
+		{"truncated.webp", webpWith(block)[:50]},
+		{"oversized.webp", oversized},
+		{"unflagged.webp", unflagged},
+		{"simple.webp", simple},
+		{"not-a.png", jpegWith(block)},
+		{"empty.jpg", nil},
+		{"photo.gif", jpegWith(block)},
+		{"photo", jpegWith(block)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadExif(bytes.NewReader(tt.data), tt.name); !errors.Is(err, ErrNoExif) {
+				t.Errorf("ReadExif error = %v, want ErrNoExif", err)
+			}
+		})
+	}
+}
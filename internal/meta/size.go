@@ -0,0 +1,26 @@
+package meta
+
+import (
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	_ "github.com/gen2brain/webp"
+	_ "golang.org/x/image/bmp"
+)
+
+// ReadSize returns the pixel size of an image as displayed, decoding only its
+// header. Orientations 5 to 8 turn the image by 90 degrees, which swaps width
+// and height.
+func ReadSize(r io.Reader, orientation int) (width, height int, err error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	if orientation >= 5 && orientation <= 8 {
+		return cfg.Height, cfg.Width, nil
+	}
+	return cfg.Width, cfg.Height, nil
+}
@@ -0,0 +1,349 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"photomato/internal/events"
+	"photomato/internal/meta"
+	"photomato/internal/store"
+	"photomato/internal/thumb"
+)
+
+// metaVersion is bumped whenever computeMeta starts extracting something new,
+// so photos indexed by an older version get their metadata computed again.
+const metaVersion = 4
+
+// maxChangeEvents caps the per-photo events published for one scan. A larger
+// change, like the first scan of an alias, only announces scan.finished and
+// clients reload the listing.
+const maxChangeEvents = 200
+
+// catalog is the index-backed listing shared by the providers.
+// Scans write into the persistent store and List/TotalCount read from it,
+// so a restart serves the previous index right away.
+type catalog struct {
+	alias string
+	store *store.Store
+	bus   *events.Bus
+
+	// Thumbnails of new photos are queued on warmer and made by render
+	warmer *Warmer
+	render func(string, thumb.Options) (io.Reader, error)
+
+	mu          sync.Mutex
+	scanTime    time.Time
+	scanned     bool
+	scanning    bool
+	metaRunning bool
+}
+
+func newCatalog(alias string, st *store.Store, bus *events.Bus) *catalog {
+	c := &catalog{alias: alias, store: st, bus: bus}
+	if t, ok, err := st.ScannedAt(alias); err == nil && ok {
+		c.scanTime = t
+		c.scanned = true
+	}
+	return c
+}
+
+// warm pre-generates the thumbnails of photos found from now on, w may be nil
+func (c *catalog) warm(w *Warmer, render func(string, thumb.Options) (io.Reader, error)) {
+	c.warmer = w
+	c.render = render
+}
+
+// warming returns the alias, warmer and render of c, see Warmer.Handover
+func (c *catalog) warming() (string, *Warmer, func(string, thumb.Options) (io.Reader, error)) {
+	return c.alias, c.warmer, c.render
+}
+
+// refresh runs scan and syncs its result into the index.
+// Concurrent calls are dropped while a scan is in progress.
+func (c *catalog) refresh(scan func() ([]store.Record, error)) (store.SyncResult, error) {
+	c.mu.Lock()
+	if c.scanning {
+		c.mu.Unlock()
+		return store.SyncResult{}, nil
+	}
+	c.scanning = true
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.scanning = false
+		c.mu.Unlock()
+	}()
+
+	start := time.Now()
+	c.publish(events.Event{Type: events.ScanStarted})
+
+	result, err := c.sync(scan)
+
+	stats := &events.ScanStats{
+		Added:    len(result.Added),
+		Updated:  len(result.Updated),
+		Removed:  len(result.Removed),
+		Total:    c.totalCount(),
+		Duration: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		stats.Error = err.Error()
+	} else {
+		c.changed(result, stats.Added+stats.Updated+stats.Removed <= maxChangeEvents)
+	}
+	c.publish(events.Event{Type: events.ScanFinished, Scan: stats})
+
+	return result, err
+}
+
+// sync runs scan and applies its result to the index
+func (c *catalog) sync(scan func() ([]store.Record, error)) (store.SyncResult, error) {
+	records, err := scan()
+	if err != nil {
+		return store.SyncResult{}, err
+	}
+
+	result, err := c.store.Sync(c.alias, records)
+	if err != nil {
+		return result, fmt.Errorf("failed to update index: %w", err)
+	}
+
+	c.mu.Lock()
+	c.scanTime = time.Now()
+	c.scanned = true
+	c.mu.Unlock()
+
+	return result, nil
+}
+
+// publish sends an event about this alias
+func (c *catalog) publish(e events.Event) {
+	e.Alias = c.alias
+	c.bus.Publish(e)
+}
+
+// changed drops the thumbnails of replaced and removed photos after an index
+// update, queues new ones, and with announce set publishes an event per photo
+func (c *catalog) changed(result store.SyncResult, announce bool) {
+	for _, p := range result.Updated {
+		thumb.Evict(c.alias, p)
+	}
+	for _, p := range result.Removed {
+		thumb.Evict(c.alias, p)
+	}
+	if c.warmer != nil {
+		c.warmer.Enqueue(c.alias, slices.Concat(result.Added, result.Updated), c.render)
+	}
+	if !announce {
+		return
+	}
+
+	for _, p := range result.Added {
+		c.publish(events.Event{Type: events.PhotoAdded, Path: p})
+	}
+	for _, p := range result.Updated {
+		c.publish(events.Event{Type: events.PhotoUpdated, Path: p})
+	}
+	for _, p := range result.Removed {
+		c.publish(events.Event{Type: events.PhotoRemoved, Path: p})
+	}
+}
+
+// indexAdd stores a photo the provider just wrote
+func (c *catalog) indexAdd(r store.Record) error {
+	if err := c.store.Put(c.alias, r); err != nil {
+		return err
+	}
+	c.publish(events.Event{Type: events.PhotoAdded, Path: r.Path})
+	return nil
+}
+
+// indexRemove drops a photo the provider just deleted
+func (c *catalog) indexRemove(path string) error {
+	if err := c.store.Remove(c.alias, path); err != nil {
+		return err
+	}
+	thumb.Evict(c.alias, path)
+	c.publish(events.Event{Type: events.PhotoRemoved, Path: path})
+	return nil
+}
+
+// indexMove renames a photo the provider just moved
+func (c *catalog) indexMove(src, dest string) error {
+	if err := c.store.Move(c.alias, src, dest); err != nil {
+		return err
+	}
+	thumb.Evict(c.alias, src)
+	c.publish(events.Event{Type: events.PhotoMoved, Path: dest, From: src})
+	return nil
+}
+
+// thumbnailServed stores the placeholder of a photo once it has a thumbnail.
+// summary is set when the thumbnail was just generated, which is announced.
+// Otherwise photos without a placeholder, e.g. because another instance made
+// the thumbnail, are summarized from the cached file.
+func (c *catalog) thumbnailServed(path, cachePath string, summary *thumb.Summary) {
+	if summary != nil {
+		c.setPlaceholder(path, *summary)
+		c.publish(events.Event{Type: events.ThumbnailReady, Path: path})
+		return
+	}
+
+	r, ok, err := c.store.Get(c.alias, path)
+	if err != nil || !ok || r.BlurHash != "" {
+		return
+	}
+	go func() {
+		s, err := thumb.SummarizeFile(cachePath)
+		if err != nil {
+			return // Evicted meanwhile, the next request retries
+		}
+		c.setPlaceholder(path, s)
+	}()
+}
+
+func (c *catalog) setPlaceholder(path string, s thumb.Summary) {
+	if err := c.store.SetPlaceholder(c.alias, path, s.BlurHash, s.Color, s.Width, s.Height); err != nil {
+		log.Printf("Failed to store placeholder of %s/%s: %v", c.alias, path, err)
+	}
+}
+
+// stale reports whether the index is older than maxAge and no scan is running
+func (c *catalog) stale(maxAge time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.scanning && time.Since(c.scanTime) > maxAge
+}
+
+// list reads one page from the index, id builds the Photo.ID of a photo path
+func (c *catalog) list(opts ListOptions, id func(string) string) ([]Photo, string, error) {
+	records, next, err := c.store.List(c.alias, store.Query{
+		Dir:       opts.Dir,
+		Recursive: opts.Recursive,
+		Sort:      opts.Sort,
+		Order:     opts.Order,
+		Cursor:    opts.Cursor,
+		Limit:     opts.Limit,
+		Exts:      opts.Exts,
+		MinSize:   opts.MinSize,
+		MaxSize:   opts.MaxSize,
+		From:      opts.From,
+		To:        opts.To,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	photos := make([]Photo, 0, len(records))
+	for _, r := range records {
+		if r.IsDir {
+			photos = append(photos, dirEntry(r.Path, r.ModTime))
+			continue
+		}
+		photos = append(photos, Photo{
+			ID:       id(r.Path),
+			Name:     r.Name,
+			Path:     r.Path,
+			Size:     r.Size,
+			ModTime:  r.ModTime,
+			TakenAt:  r.TakenAt,
+			Width:    r.Width,
+			Height:   r.Height,
+			BlurHash: r.BlurHash,
+			Color:    r.Color,
+		})
+	}
+	return photos, next, nil
+}
+
+func (c *catalog) totalCount() int {
+	c.mu.Lock()
+	scanned := c.scanned
+	c.mu.Unlock()
+	if !scanned {
+		return -1 // Indicates scanning
+	}
+
+	n, err := c.store.Count(c.alias)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// computeMeta fills in the metadata of photos the current metaVersion has not seen yet.
+// Only one pass runs at a time per alias.
+func (c *catalog) computeMeta(compute func(store.Record) store.Meta) {
+	c.mu.Lock()
+	if c.metaRunning {
+		c.mu.Unlock()
+		return
+	}
+	c.metaRunning = true
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.metaRunning = false
+		c.mu.Unlock()
+	}()
+
+	for {
+		pending, err := c.store.PendingMeta(c.alias, metaVersion, 100)
+		if err != nil {
+			fmt.Printf("Failed to load pending metadata for %s: %v\n", c.alias, err)
+			return
+		}
+		if len(pending) == 0 {
+			return
+		}
+		for _, r := range pending {
+			// Failures are stored too, so a broken file is not retried forever
+			if err := c.store.SetMeta(c.alias, r.Path, compute(r), metaVersion); err != nil {
+				fmt.Printf("Failed to store metadata for %s/%s: %v\n", c.alias, r.Path, err)
+				return
+			}
+		}
+	}
+}
+
+// exif returns the EXIF of a photo from the index, or reads it with read when
+// the photo has not been processed yet. It returns nil if the photo has none.
+func (c *catalog) exif(path string, read func(string) (*meta.Exif, error)) (*meta.Exif, error) {
+	r, ok, err := c.store.Get(c.alias, path)
+	if err != nil {
+		return nil, err
+	}
+	if ok && r.MetaVersion >= metaVersion {
+		if r.Exif == "" {
+			return nil, nil
+		}
+		var e meta.Exif
+		if err := json.Unmarshal([]byte(r.Exif), &e); err != nil {
+			return nil, err
+		}
+		return &e, nil
+	}
+
+	e, err := read(path)
+	if errors.Is(err, meta.ErrNoExif) {
+		return nil, nil
+	}
+	return e, err
+}
+
+// encodeExif returns the JSON stored in the index and the capture date of e
+func encodeExif(e *meta.Exif) (string, time.Time) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", time.Time{}
+	}
+	return string(data), e.TakenAt
+}
@@ -0,0 +1,67 @@
+package provider
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+
+	"photomato/internal/events"
+	"photomato/internal/store"
+	"photomato/internal/thumb"
+)
+
+// sidecarSuffix names the file next to a photo that holds its edit, e.g.
+// IMG_1.jpg.photomato.json. It is not an image, so scans skip it.
+const sidecarSuffix = ".photomato.json"
+
+// readSidecar decodes the edit stored in a sidecar
+func readSidecar(r io.Reader) (thumb.Edit, error) {
+	var e thumb.Edit
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return e, err
+	}
+	return e, e.Validate()
+}
+
+// encodeSidecar returns the content of the sidecar of e
+func encodeSidecar(e thumb.Edit) []byte {
+	data, _ := json.MarshalIndent(e, "", "  ")
+	return append(data, '\n')
+}
+
+// edit returns the edit of a photo from the index, the metadata pass reads
+// it from the sidecar
+func (c *catalog) edit(path string) (thumb.Edit, error) {
+	r, ok, err := c.store.Get(c.alias, path)
+	if err != nil || !ok {
+		return thumb.Edit{}, err
+	}
+	return thumb.ParseEdit(r.Edit)
+}
+
+// editChanged indexes an edit the provider just wrote, the thumbnails of the
+// previous edit are dropped and new ones queued
+func (c *catalog) editChanged(path string, e thumb.Edit) error {
+	if err := c.store.SetEdit(c.alias, path, e.String()); err != nil {
+		return err
+	}
+	thumb.Evict(c.alias, path)
+	if c.warmer != nil {
+		c.warmer.Enqueue(c.alias, []string{path}, c.render)
+	}
+	c.publish(events.Event{Type: events.PhotoUpdated, Path: path})
+	return nil
+}
+
+// applySidecar sets the edit of m from a sidecar and adjusts the size to it
+func applySidecar(m *store.Meta, r io.Reader, path string) {
+	e, err := readSidecar(r)
+	if err != nil {
+		log.Printf("Ignoring invalid edit of %s: %v", path, err)
+		return
+	}
+	m.Edit = e.String()
+	if m.Width > 0 && m.Height > 0 {
+		m.Width, m.Height = e.Size(m.Width, m.Height)
+	}
+}
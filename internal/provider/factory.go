@@ -0,0 +1,75 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	"photomato/internal/config"
+	"photomato/internal/events"
+	"photomato/internal/store"
+)
+
+// Env carries the services and settings shared by every provider
+type Env struct {
+	Store    *store.Store
+	Bus      *events.Bus // Library change events, published by providers and the API
+	Warmer   *Warmer     // Pre-generates thumbnails of aliases with warm_thumbnails
+	PartSize uint64      // S3 multipart part size in bytes, 0 for the client default
+}
+
+// NewEnv builds the provider environment from the global config
+func NewEnv(cfg *config.Config, st *store.Store) Env {
+	return Env{
+		Store:    st,
+		Bus:      events.NewBus(),
+		Warmer:   NewWarmer(cfg.Thumbnails.WarmSizes),
+		PartSize: uint64(cfg.UploadPartSizeMB) << 20,
+	}
+}
+
+// New creates the provider for a configured alias
+func New(alias config.Alias, env Env) (Provider, error) {
+	var warmer *Warmer
+	if alias.WarmThumbnails {
+		warmer = env.Warmer
+	}
+
+	switch alias.Type {
+	case config.AliasTypeLocal:
+		return NewLocalProvider(LocalProviderConfig{
+			Alias:  alias.Name,
+			Root:   alias.Path,
+			Store:  env.Store,
+			Bus:    env.Bus,
+			Warmer: warmer,
+		})
+	case config.AliasTypeS3:
+		cfg := S3ConfigFromAlias(alias)
+		cfg.Store = env.Store
+		cfg.Bus = env.Bus
+		cfg.Warmer = warmer
+		cfg.PartSize = env.PartSize
+		return NewS3Provider(cfg)
+	}
+	return nil, fmt.Errorf("unknown alias type %q", alias.Type)
+}
+
+// S3ConfigFromAlias maps an S3 alias onto the provider settings
+func S3ConfigFromAlias(alias config.Alias) S3ProviderConfig {
+	// Determine SSL usage from endpoint
+	useSSL := strings.HasPrefix(alias.Endpoint, "https://")
+	endpoint := strings.TrimPrefix(strings.TrimPrefix(alias.Endpoint, "https://"), "http://")
+
+	return S3ProviderConfig{
+		Alias:     alias.Name,
+		Endpoint:  endpoint,
+		AccessKey: alias.AccessKey,
+		SecretKey: alias.SecretKey,
+		UseSSL:    useSSL,
+		Bucket:    alias.Bucket,
+		Prefix:    alias.Path, // Path is used as prefix
+		Region:    alias.Region,
+
+		ThumbPrefix: alias.ThumbPrefix,
+	}
+}
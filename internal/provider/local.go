@@ -1,235 +1,333 @@
 package provider
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
+
+	"photomato/internal/events"
+	"photomato/internal/meta"
+	"photomato/internal/store"
 	"photomato/internal/thumb"
 )
 
 type LocalProvider struct {
 	RootPath string
-	
-	// Cache
-	mu        sync.RWMutex
-	cache     []Photo
-	cacheTime time.Time
-	scanned   bool
-	scanning  bool
+
+	*catalog
+	watcher *fsnotify.Watcher // nil when watching failed, List polls instead
+}
+
+type LocalProviderConfig struct {
+	Alias  string
+	Root   string
+	Store  *store.Store
+	Bus    *events.Bus
+	Warmer *Warmer // Nil unless thumbnails are pre-generated
 }
 
-func NewLocalProvider(rootPath string) (*LocalProvider, error) {
-	info, err := os.Stat(rootPath)
+func NewLocalProvider(cfg LocalProviderConfig) (*LocalProvider, error) {
+	info, err := os.Stat(cfg.Root)
 	if err != nil {
 		return nil, err
 	}
 	if !info.IsDir() {
-		return nil, fmt.Errorf("%s is not a directory", rootPath)
+		return nil, fmt.Errorf("%s is not a directory", cfg.Root)
 	}
-	p := &LocalProvider{RootPath: rootPath}
-	
-	// Start async scan
+	p := &LocalProvider{
+		RootPath: cfg.Root,
+		catalog:  newCatalog(cfg.Alias, cfg.Store, cfg.Bus),
+	}
+	p.warm(cfg.Warmer, p.GetThumbnail)
+
+	// Watch before scanning, so nothing changing during the scan is lost
+	if err := p.startWatcher(); err != nil {
+		log.Printf("Failed to watch %s, falling back to polling: %v", cfg.Root, err)
+	}
+
+	// Start async scan, the previous index is served meanwhile
 	go func() {
 		p.refreshCache()
 	}()
-	
-	return p, nil
-}
 
-// invalidateCache clears the cache
-func (p *LocalProvider) invalidateCache() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.cache = nil
-	p.scanned = false
-	p.cacheTime = time.Time{} // zero time
-	
-	// Re-trigger scan
-	go p.refreshCache()
+	return p, nil
 }
 
-// refreshCache handles locking and scanning
+// refreshCache rescans the directory tree into the index
 func (p *LocalProvider) refreshCache() {
-	p.mu.Lock()
-	if p.scanning {
-		p.mu.Unlock()
+	result, err := p.refresh(p.scan)
+	if err != nil {
+		fmt.Printf("Scan failed: %v\n", err)
 		return
 	}
-	p.scanning = true
-	p.mu.Unlock()
+	if len(result.Added)+len(result.Updated)+len(result.Removed) > 0 {
+		fmt.Printf("Indexed %s: %d added, %d updated, %d removed\n", p.alias, len(result.Added), len(result.Updated), len(result.Removed))
+	}
 
-	defer func() {
-		p.mu.Lock()
-		p.scanning = false
-		p.mu.Unlock()
-	}()
+	p.computeMeta(p.fileMeta)
+}
+
+// fileMeta hashes the file content of an indexed photo and extracts its EXIF
+// and size
+func (p *LocalProvider) fileMeta(r store.Record) store.Meta {
+	var m store.Meta
 
-	photos, err := p.scan()
+	f, err := os.Open(filepath.Join(p.RootPath, filepath.FromSlash(r.Path)))
 	if err != nil {
-		fmt.Printf("Scan failed: %v\n", err)
-		return
+		return m
+	}
+	defer f.Close()
+
+	// EXIF sits near the start of the file, hash what the parser read and then the rest
+	h := sha256.New()
+	orientation := 0
+	if e, err := meta.ReadExif(io.TeeReader(f, h), r.Name); err == nil {
+		m.Exif, m.TakenAt = encodeExif(e)
+		orientation = e.Orientation
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return m
+	}
+	m.Hash = hex.EncodeToString(h.Sum(nil))
+
+	// Only the header is read again
+	if _, err := f.Seek(0, io.SeekStart); err == nil {
+		m.Width, m.Height, _ = meta.ReadSize(bufio.NewReader(f), orientation)
+	}
+
+	if sidecar, err := os.Open(p.sidecarPath(r.Path)); err == nil {
+		applySidecar(&m, sidecar, r.Path)
+		sidecar.Close()
 	}
-	
-	p.mu.Lock()
-	// No defer here as we unlock explicitly or just fall through (but defer is safer if panic, 
-	// actually we hold lock for assignment only)
-	p.cache = photos
-	p.cacheTime = time.Now()
-	p.scanned = true
-	p.mu.Unlock()
-	
-	// fmt.Printf("Refreshed cache with %d photos\n", len(photos))
+	return m
 }
 
-// scan reads the directory and builds the photo list
-// No locking inside scan itself
-func (p *LocalProvider) scan() ([]Photo, error) {
-	entries, err := os.ReadDir(p.RootPath)
+// fullPath returns the file of path, which must stay below the root
+func (p *LocalProvider) fullPath(path string) (string, error) {
+	cleaned, err := CleanPath(path)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return filepath.Join(p.RootPath, filepath.FromSlash(cleaned)), nil
+}
 
-	var allPhotos []Photo
-	for _, entry := range entries {
-		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
-			continue
+// sidecarPath returns where the edit of a photo is stored
+func (p *LocalProvider) sidecarPath(path string) string {
+	return filepath.Join(p.RootPath, filepath.FromSlash(path)) + sidecarSuffix
+}
+
+// scan walks the directory tree and builds the photo and folder records
+// No locking inside scan itself
+func (p *LocalProvider) scan() ([]store.Record, error) {
+	return p.walk(p.RootPath)
+}
+
+// walk builds the records of start and everything below it
+func (p *LocalProvider) walk(start string) ([]store.Record, error) {
+	var records []store.Record
+	err := filepath.WalkDir(start, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if fullPath == start {
+				return err
+			}
+			// Unreadable subfolders are skipped rather than failing the whole scan
+			if entry != nil && entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fullPath == p.RootPath {
+			return nil
 		}
 
-		// Filter extensions
-		ext := strings.ToLower(filepath.Ext(entry.Name()))
-		switch ext {
-		case ".jpg", ".jpeg", ".png", ".webp", ".gif", ".svg", ".bmp":
-			// Allowed
-		default:
-			continue
+		// Skip hidden files and folders
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
+		rel, err := filepath.Rel(p.RootPath, fullPath)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
 		info, err := entry.Info()
 		if err != nil {
-			continue
+			return nil
+		}
+
+		if entry.IsDir() {
+			records = append(records, store.Record{
+				Path:    rel,
+				Name:    entry.Name(),
+				IsDir:   true,
+				ModTime: info.ModTime(),
+			})
+			return nil
 		}
-		allPhotos = append(allPhotos, Photo{
-			ID:      entry.Name(),
+
+		if !isImage(entry.Name()) {
+			return nil
+		}
+
+		records = append(records, store.Record{
+			Path:    rel,
 			Name:    entry.Name(),
-			Path:    entry.Name(),
 			Size:    info.Size(),
 			ModTime: info.ModTime(),
 		})
-	}
-
-	// Sort by ModTime desc
-	sort.Slice(allPhotos, func(i, j int) bool {
-		return allPhotos[i].ModTime.After(allPhotos[j].ModTime)
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return allPhotos, nil
+	return records, nil
 }
 
-func (p *LocalProvider) List(cursor string, limit int) ([]Photo, string, error) {
-	p.mu.RLock()
-	// SWR: If scanned and cache exists, check if we should refresh (older than 20s)
-	// If not scanned, we definitely wait or trigger (New starts it).
-	elapsed := time.Since(p.cacheTime)
-	shouldRefresh := elapsed > 20*time.Second
-	isScanning := p.scanning
-	p.mu.RUnlock()
-
-	if shouldRefresh && !isScanning {
+func (p *LocalProvider) List(opts ListOptions) ([]Photo, string, error) {
+	// SWR: without a watcher, serve the index right away and refresh it in the
+	// background when older than 20s
+	if p.watcher == nil && p.stale(20*time.Second) {
 		go p.refreshCache()
 	}
 
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	
-	// If not scanned yet, return empty list instantly
-	if !p.scanned && p.cache == nil {
-		return []Photo{}, "", nil // Client will see empty list -> 0 count
-	}
+	return p.list(opts, func(path string) string { return path })
+}
 
-	allPhotos := p.cache
+func (p *LocalProvider) TotalCount() int {
+	return p.totalCount()
+}
 
-	// Efficient pagination on the cached slice
-	start := 0
-	if cursor != "" {
-		for i, photo := range allPhotos {
-			if photo.ID == cursor {
-				start = i + 1
-				break
-			}
-		}
+// GetThumbnail generates or retrieves a thumbnail
+func (p *LocalProvider) GetThumbnail(path string, opts thumb.Options) (io.Reader, error) {
+	fullPath, err := p.fullPath(path)
+	if err != nil {
+		return nil, err
 	}
-
-	end := start + limit
-	if end > len(allPhotos) {
-		end = len(allPhotos)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
 	}
 
-	// Important: Copy the slice to avoid race conditions if caller modifies it (though Photo is value type)
-	// But slicing is safe as long as underlying array isn't modified.
-	// Since we replace p.cache entirely on update, the old array is safe to read.
-	result := make([]Photo, end-start)
-	copy(result, allPhotos[start:end])
-
-	nextCursor := ""
-	if end < len(allPhotos) && len(result) > 0 {
-		nextCursor = result[len(result)-1].ID
+	key := thumb.Key{
+		Alias:   p.alias,
+		Path:    filepath.ToSlash(path),
+		Version: fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()),
 	}
+	if key.Edit, err = p.edit(key.Path); err != nil {
+		return nil, err
+	}
+	thumbPath, summary, err := thumb.Generate(key, opts, func() (io.ReadCloser, error) {
+		return os.Open(fullPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.thumbnailServed(key.Path, thumbPath, summary)
+	return os.Open(thumbPath)
+}
 
-	return result, nextCursor, nil
+func (p *LocalProvider) GetExif(path string) (*meta.Exif, error) {
+	return p.exif(path, func(path string) (*meta.Exif, error) {
+		fullPath, err := p.fullPath(path)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return meta.ReadExif(f, path)
+	})
 }
 
-func (p *LocalProvider) TotalCount() int {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	if !p.scanned {
-		return -1 // Indicates scanning
-	}
-	return len(p.cache)
+func (p *LocalProvider) GetEdit(path string) (thumb.Edit, error) {
+	return p.edit(filepath.ToSlash(path))
 }
 
-// GetThumbnail generates or retrieves a thumbnail
-func (p *LocalProvider) GetThumbnail(path string) (io.Reader, error) {
-	fullPath := filepath.Join(p.RootPath, path)
-	thumbPath, err := thumb.GenerateFromFile(fullPath)
-	if err != nil {
-		return nil, err
+func (p *LocalProvider) SetEdit(path string, e thumb.Edit) error {
+	if _, err := p.fullPath(path); err != nil {
+		return err
 	}
-	return os.Open(thumbPath)
+	sidecar := p.sidecarPath(path)
+	if e.IsZero() {
+		if err := os.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := os.WriteFile(sidecar, encodeSidecar(e), 0644); err != nil {
+		return err
+	}
+	return p.editChanged(filepath.ToSlash(path), e)
 }
 
 func (p *LocalProvider) GetFileReader(path string) (io.ReadCloser, error) {
-	fullPath := filepath.Join(p.RootPath, path)
+	fullPath, err := p.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
 	return os.Open(fullPath)
 }
 
 func (p *LocalProvider) GetOriginalURL(path string) (string, error) {
-	return filepath.Join(p.RootPath, path), nil
+	return p.fullPath(path)
 }
 
 func (p *LocalProvider) Delete(path string) error {
-	defer p.invalidateCache() // Invalidate cache on change
-
-	fullPath := filepath.Join(p.RootPath, path)
-	return os.Remove(fullPath)
+	fullPath, err := p.fullPath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	os.Remove(p.sidecarPath(path))
+	return p.indexRemove(path)
 }
 
 func (p *LocalProvider) Move(src, dest string) error {
-	defer p.invalidateCache() // Invalidate cache on change
-
-	fullSrc := filepath.Join(p.RootPath, src)
-	fullDest := filepath.Join(p.RootPath, dest)
-	return os.Rename(fullSrc, fullDest)
+	fullSrc, err := p.fullPath(src)
+	if err != nil {
+		return err
+	}
+	fullDest, err := p.fullPath(dest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullDest), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(fullSrc, fullDest); err != nil {
+		return err
+	}
+	// The edit follows the photo, a replaced photo takes its edit along
+	if err := os.Rename(p.sidecarPath(src), p.sidecarPath(dest)); os.IsNotExist(err) {
+		os.Remove(p.sidecarPath(dest))
+	} else if err != nil {
+		log.Printf("Failed to move edit of %s: %v", src, err)
+	}
+	return p.indexMove(filepath.ToSlash(src), filepath.ToSlash(dest))
 }
 
 func (p *LocalProvider) Upload(filename string, data io.Reader) (string, error) {
-	defer p.invalidateCache() // Invalidate cache on change
-
+	filename, err := CleanPath(filename)
+	if err != nil {
+		return "", err
+	}
 	ext := filepath.Ext(filename)
 	name := strings.TrimSuffix(filename, ext)
 
@@ -246,6 +344,10 @@ func (p *LocalProvider) Upload(filename string, data io.Reader) (string, error)
 		fullPath = filepath.Join(p.RootPath, finalName)
 	}
 
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return "", err
+	}
+
 	out, err := os.Create(fullPath)
 	if err != nil {
 		return "", err
@@ -254,8 +356,26 @@ func (p *LocalProvider) Upload(filename string, data io.Reader) (string, error)
 
 	_, err = io.Copy(out, data)
 	if err != nil {
+		// Don't leave a truncated photo behind
+		out.Close()
+		os.Remove(fullPath)
+		return "", err
+	}
+
+	info, err := out.Stat()
+	if err != nil {
+		return "", err
+	}
+	finalName = filepath.ToSlash(finalName)
+	if err := p.indexAdd(store.Record{
+		Path:    finalName,
+		Name:    filepath.Base(finalName),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}); err != nil {
 		return "", err
 	}
+	go p.computeMeta(p.fileMeta)
 
 	return finalName, nil
 }
@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Paths are relative to the root, none of them may reach a file next to it
+func TestLocalProviderStaysInRoot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	for name, parent := range map[string]string{"in.jpg": root, "out.jpg": filepath.Join(dir, "other")} {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(parent, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &LocalProvider{RootPath: root}
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"in.jpg", true},
+		{"/in.jpg", true},
+		{"sub/../in.jpg", true},
+		{"../other/out.jpg", false},
+		{"/../other/out.jpg", false},
+		{`..\other\out.jpg`, false},
+		{"sub/../../other/out.jpg", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			r, err := p.GetFileReader(tt.path)
+			if err == nil {
+				r.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("GetFileReader(%q) error = %v, want ok %v", tt.path, err, tt.ok)
+			}
+			if _, err := p.GetOriginalURL(tt.path); (err == nil) != tt.ok {
+				t.Errorf("GetOriginalURL(%q) error = %v, want ok %v", tt.path, err, tt.ok)
+			}
+			if !tt.ok {
+				if err := p.Delete(tt.path); err == nil {
+					t.Errorf("Delete(%q) succeeded", tt.path)
+				}
+				if err := p.Move("in.jpg", tt.path); err == nil {
+					t.Errorf("Move to %q succeeded", tt.path)
+				}
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other", "out.jpg")); err != nil {
+		t.Errorf("file outside the root was touched: %v", err)
+	}
+}
@@ -1,34 +1,77 @@
 package provider
 
 import (
+	"fmt"
 	"io"
+	"path"
+	"path/filepath"
+	"strings"
 	"time"
+
+	"photomato/internal/meta"
+	"photomato/internal/thumb"
 )
 
 type Photo struct {
 	ID           string    `json:"id"`
 	Name         string    `json:"name"`
-	Path         string    `json:"path"` // Relative path or Key
+	Path         string    `json:"path"` // Relative path or Key, always slash separated
 	URL          string    `json:"url"`  // Public access URL
 	ThumbnailURL string    `json:"thumbnail_url"`
 	Size         int64     `json:"size"`
 	ModTime      time.Time `json:"mod_time"`
-	IsDir        bool      `json:"is_dir"` // Should be unneeded if flat view, but good for future
+	TakenAt      time.Time `json:"taken_at,omitzero"` // EXIF capture date, survives copies between aliases
+	IsDir        bool      `json:"is_dir"` // Child folder entry in folder listings
+
+	// Known once a thumbnail was generated, so clients can reserve the space
+	// and show a placeholder meanwhile
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"` // Upright, EXIF orientation applied
+	BlurHash string `json:"blurhash,omitempty"`
+	Color    string `json:"color,omitempty"` // Dominant colour as #rrggbb
+}
+
+// ListOptions selects, filters and orders a photo listing
+type ListOptions struct {
+	Dir       string // Folder to list, "" for the root
+	Recursive bool   // Every photo below Dir as one flat list instead of its direct entries
+	Sort      string // store.SortName, SortSize, SortModTime or SortTaken
+	Order     string // store.OrderAsc or store.OrderDesc
+	Cursor    string
+	Limit     int
+
+	Exts    []string  // Only these extensions, without the dot
+	MinSize int64     // Bytes, 0 for no lower bound
+	MaxSize int64     // Bytes, 0 for no upper bound
+	From    time.Time // Capture date (falling back to mtime) range, zero for open ends
+	To      time.Time
 }
 
 type Provider interface {
-	// List returns photos with cursor-based pagination
-	List(cursor string, limit int) ([]Photo, string, error)
-	
-	// GetThumbnail returns a reader for the thumbnail image
-	GetThumbnail(path string) (io.Reader, error)
-	
+	// List returns one page of entries with cursor-based pagination.
+	// Child folders come first as IsDir entries, followed by the photos directly in the folder.
+	// With Recursive set, every photo below the folder is returned as one flat list instead.
+	List(opts ListOptions) ([]Photo, string, error)
+
+	// GetThumbnail returns a reader for the thumbnail image in the size and format of opts
+	GetThumbnail(path string, opts thumb.Options) (io.Reader, error)
+
+	// GetExif returns the EXIF metadata of a photo, or nil if it has none
+	GetExif(path string) (*meta.Exif, error)
+
+	// GetEdit returns the non-destructive edit of a photo, zero if it has none
+	GetEdit(path string) (thumb.Edit, error)
+
+	// SetEdit stores the edit of a photo in its sidecar, a zero edit removes it.
+	// Thumbnails render the edited photo from then on.
+	SetEdit(path string, e thumb.Edit) error
+
 	// GetOriginalURL returns a direct URL (presigned for S3) or local file path
 	GetOriginalURL(path string) (string, error)
-	
+
 	// Delete removes the file
 	Delete(path string) error
-	
+
 	// Move moves the file to a destination path
 	Move(src, dest string) error
 
@@ -41,3 +84,60 @@ type Provider interface {
 	// TotalCount returns total number of photos, or -1 if scanning
 	TotalCount() int
 }
+
+// isImage reports whether name has one of the supported image extensions
+func isImage(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".webp", ".gif", ".svg", ".bmp":
+		return true
+	}
+	return false
+}
+
+// CleanDir normalizes a folder path relative to the provider root.
+// The root itself is "", and paths escaping the root are rejected.
+func CleanDir(dir string) (string, error) {
+	dir = strings.Trim(strings.ReplaceAll(dir, "\\", "/"), "/")
+	if dir == "" {
+		return "", nil
+	}
+	cleaned := path.Clean(dir)
+	if cleaned == "." {
+		return "", nil
+	}
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid folder %q", dir)
+	}
+	return cleaned, nil
+}
+
+// CleanPath normalizes the path of a file relative to the provider root.
+// The root itself and paths escaping it are rejected.
+func CleanPath(p string) (string, error) {
+	cleaned, err := CleanDir(p)
+	if err != nil || cleaned == "" {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	return cleaned, nil
+}
+
+// dirEntry builds the IsDir entry for a folder path.
+// The trailing slash keeps folder IDs apart from photo IDs.
+func dirEntry(dirPath string, modTime time.Time) Photo {
+	return Photo{
+		ID:      dirPath + "/",
+		Name:    path.Base(dirPath),
+		Path:    dirPath,
+		ModTime: modTime,
+		IsDir:   true,
+	}
+}
+
+// parentDir returns the folder containing p, "" for the root
+func parentDir(p string) string {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return ""
+	}
+	return p[:i]
+}
@@ -5,8 +5,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log"
+	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,6 +15,9 @@ import (
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 
+	"photomato/internal/events"
+	"photomato/internal/meta"
+	"photomato/internal/store"
 	"photomato/internal/thumb"
 )
 
@@ -22,15 +26,25 @@ type S3Provider struct {
 	BucketName string
 	Prefix     string // Optional prefix/folder within the bucket
 
-	// Cache
-	mu        sync.RWMutex
-	cache     []Photo
-	cacheTime time.Time
-	scanned   bool
-	scanning  bool
+	// ThumbPrefix, relative to Prefix, keeps generated thumbnails in the
+	// bucket for all instances to share. Empty keeps them local only.
+	ThumbPrefix string
+
+	partSize uint64
+
+	// sidecars holds the photos with an edit sidecar, as seen by the last
+	// scan and kept up to date by edits, so objectMeta fetches only those
+	sidecarMu sync.Mutex
+	sidecars  map[string]bool
+
+	*catalog
 }
 
 type S3ProviderConfig struct {
+	Alias     string
+	Store     *store.Store
+	Bus       *events.Bus
+	Warmer    *Warmer // Nil unless thumbnails are pre-generated
 	Endpoint  string
 	AccessKey string
 	SecretKey string
@@ -38,9 +52,19 @@ type S3ProviderConfig struct {
 	Bucket    string
 	Prefix    string
 	Region    string
+	PartSize  uint64 // Multipart part size, 0 for the client default
+
+	ThumbPrefix string // Shared thumbnail prefix within Prefix, "" to disable
 }
 
-func NewS3Provider(cfg S3ProviderConfig) (*S3Provider, error) {
+// smallUploadSize is the largest upload sent as a single PUT
+const smallUploadSize = 5 << 20
+
+// staleUploadAge is when an incomplete multipart upload counts as abandoned
+const staleUploadAge = 24 * time.Hour
+
+// newS3Client connects to the endpoint and verifies the bucket exists
+func newS3Client(cfg S3ProviderConfig) (*minio.Client, error) {
 	client, err := minio.New(cfg.Endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
 		Secure: cfg.UseSSL,
@@ -62,81 +86,205 @@ func NewS3Provider(cfg S3ProviderConfig) (*S3Provider, error) {
 		return nil, fmt.Errorf("bucket %s does not exist", cfg.Bucket)
 	}
 
+	return client, nil
+}
+
+// TestS3Connection checks the S3 settings without creating a provider
+func TestS3Connection(cfg S3ProviderConfig) error {
+	_, err := newS3Client(cfg)
+	return err
+}
+
+func NewS3Provider(cfg S3ProviderConfig) (*S3Provider, error) {
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	p := &S3Provider{
-		Client:     client,
-		BucketName: cfg.Bucket,
-		Prefix:     cfg.Prefix,
+		Client:      client,
+		BucketName:  cfg.Bucket,
+		Prefix:      cfg.Prefix,
+		ThumbPrefix: cfg.ThumbPrefix,
+		partSize:    cfg.PartSize,
+		catalog:     newCatalog(cfg.Alias, cfg.Store, cfg.Bus),
 	}
-	
-	// Start async scan
+	// Pre-generation wants the real thumbnail, never a preview
+	p.warm(cfg.Warmer, p.renderThumbnail)
+
+	// Start async scan, the previous index is served meanwhile
 	go func() {
 		p.refreshCache()
 	}()
+	go p.abortStaleUploads()
 
 	return p, nil
 }
 
-// invalidateCache clears the cache
-func (p *S3Provider) invalidateCache() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.cache = nil
-	p.scanned = false
-	p.cacheTime = time.Time{} // zero time
-	
-	// Re-trigger scan
-	go p.refreshCache()
-}
-
-// refreshCache handles locking and scanning
+// refreshCache relists the bucket into the index
 func (p *S3Provider) refreshCache() {
-	p.mu.Lock()
-	if p.scanning {
-		p.mu.Unlock()
+	start := time.Now()
+	result, err := p.refresh(p.scan)
+	if err != nil {
+		fmt.Printf("S3 Scan failed: %v\n", err)
 		return
 	}
-	p.scanning = true
-	p.mu.Unlock()
 
-	defer func() {
-		p.mu.Lock()
-		p.scanning = false
-		p.mu.Unlock()
-	}()
+	fmt.Printf("S3 Refreshed %s in %v: %d added, %d updated, %d removed\n",
+		p.alias, time.Since(start), len(result.Added), len(result.Updated), len(result.Removed))
 
-	start := time.Now()
-	photos, err := p.scan()
+	p.computeMeta(p.objectMeta)
+}
+
+// exifHeadSize is how much of an object is fetched to find its EXIF block
+// and frame header. JPEG keeps both right after SOI, PNG and WebP usually
+// before the image data.
+const exifHeadSize = 256 << 10
+
+// objectMeta extracts the EXIF and size of an indexed object, the ETag serves as its hash
+func (p *S3Provider) objectMeta(r store.Record) store.Meta {
+	m := store.Meta{Hash: r.Hash}
+
+	// The head covers both for most photos, one request is enough
+	head, err := p.readHead(r.Path, exifHeadSize)
 	if err != nil {
-		fmt.Printf("S3 Scan failed: %v\n", err)
-		return
+		return m
 	}
-	
-	p.mu.Lock()
-	// No defer here as we unlock explicitly
-	p.cache = photos
-	p.cacheTime = time.Now()
-	p.scanned = true
-	p.mu.Unlock()
-	
-	fmt.Printf("S3 Refreshed %d photos in %v\n", len(photos), time.Since(start))
+
+	orientation := 0
+	if e, err := p.exifFrom(r.Path, head); err == nil {
+		m.Exif, m.TakenAt = encodeExif(e)
+		orientation = e.Orientation
+	}
+	m.Width, m.Height, _ = meta.ReadSize(bytes.NewReader(head), orientation)
+
+	if !p.hasSidecar(r.Path) {
+		return m
+	}
+	if sidecar, err := p.readSidecar(r.Path); err == nil {
+		applySidecar(&m, sidecar, r.Path)
+		sidecar.Close()
+	}
+	return m
 }
 
-// scan reads the S3 bucket and builds the photo list
-// Caller must hold the lock if writing to cache
-func (p *S3Provider) scan() ([]Photo, error) {
-	ctx := context.Background()
+// hasSidecar reports whether a photo has an edit sidecar
+func (p *S3Provider) hasSidecar(path string) bool {
+	p.sidecarMu.Lock()
+	defer p.sidecarMu.Unlock()
+	return p.sidecars[path]
+}
+
+// setSidecar records whether a photo has an edit sidecar
+func (p *S3Provider) setSidecar(path string, ok bool) {
+	p.sidecarMu.Lock()
+	defer p.sidecarMu.Unlock()
+	if p.sidecars == nil {
+		p.sidecars = make(map[string]bool)
+	}
+	if ok {
+		p.sidecars[path] = true
+	} else {
+		delete(p.sidecars, path)
+	}
+}
+
+func (p *S3Provider) readExif(path string) (*meta.Exif, error) {
+	head, err := p.readHead(path, exifHeadSize)
+	if err != nil {
+		return nil, err
+	}
+	return p.exifFrom(path, head)
+}
 
-	prefix := p.Prefix
-	if prefix != "" && !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
+// exifFrom extracts the EXIF of an object from its head. PNG and WebP may
+// store it after the image data, the rest of those is only fetched if so.
+func (p *S3Provider) exifFrom(path string, head []byte) (*meta.Exif, error) {
+	if len(head) < exifHeadSize {
+		return meta.ReadExif(bytes.NewReader(head), path)
 	}
+	tail := &objectTail{p: p, path: path, offset: int64(len(head))}
+	defer tail.Close()
+	return meta.ReadExif(io.MultiReader(bytes.NewReader(head), tail), path)
+}
+
+// objectTail reads an object from offset on. It is only requested once read.
+type objectTail struct {
+	p      *S3Provider
+	path   string
+	offset int64
+	object *minio.Object
+}
+
+func (t *objectTail) Read(b []byte) (int, error) {
+	if t.object == nil {
+		opts := minio.GetObjectOptions{}
+		if err := opts.SetRange(t.offset, 0); err != nil {
+			return 0, err
+		}
+		object, err := t.p.Client.GetObject(context.Background(), t.p.BucketName, t.p.buildKey(t.path), opts)
+		if err != nil {
+			return 0, err
+		}
+		t.object = object
+	}
+	return t.object.Read(b)
+}
+
+func (t *objectTail) Close() error {
+	if t.object == nil {
+		return nil
+	}
+	return t.object.Close()
+}
+
+// readHead fetches up to size bytes from the start of an object
+func (p *S3Provider) readHead(path string, size int64) ([]byte, error) {
+	opts := minio.GetObjectOptions{}
+	opts.SetRange(0, size-1)
+	object, err := p.Client.GetObject(context.Background(), p.BucketName, p.buildKey(path), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	return io.ReadAll(object)
+}
+
+func isJPEG(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		return true
+	}
+	return false
+}
+
+// scan lists the S3 bucket recursively and builds the photo and folder records
+func (p *S3Provider) scan() ([]store.Record, error) {
+	ctx := context.Background()
+
+	prefix := p.keyPrefix()
+	thumbPrefix := p.thumbPrefix()
 
 	opts := minio.ListObjectsOptions{
 		Prefix:    prefix,
-		Recursive: false, // No subdirectory recursion
+		Recursive: true,
+	}
+
+	var records []store.Record
+	sidecars := make(map[string]bool)
+	// S3 has no real folders, they are derived from the keys below them
+	dirTimes := make(map[string]time.Time)
+	addDirs := func(dir string, modTime time.Time) {
+		for dir != "" {
+			if t, ok := dirTimes[dir]; ok && !modTime.After(t) {
+				return
+			}
+			dirTimes[dir] = modTime
+			dir = parentDir(dir)
+		}
 	}
 
-	var allPhotos []Photo
 	objectCh := p.Client.ListObjects(ctx, p.BucketName, opts)
 
 	for object := range objectCh {
@@ -144,136 +292,259 @@ func (p *S3Provider) scan() ([]Photo, error) {
 			return nil, object.Err
 		}
 
-		// Skip "directories" (keys ending with /)
-		if strings.HasSuffix(object.Key, "/") {
+		// Store relative path (without prefix)
+		relativePath := strings.TrimPrefix(object.Key, prefix)
+		if relativePath == "" || isHiddenPath(relativePath) {
+			continue
+		}
+		// Our own thumbnails, when shared under a visible prefix
+		if thumbPrefix != "" && strings.HasPrefix(object.Key, thumbPrefix) {
 			continue
 		}
 
-		// Skip hidden files
-		name := filepath.Base(object.Key)
-		if strings.HasPrefix(name, ".") {
+		// Folder marker objects (keys ending with /)
+		if strings.HasSuffix(relativePath, "/") {
+			addDirs(strings.TrimSuffix(relativePath, "/"), object.LastModified)
 			continue
 		}
 
-		// Filter by image extensions
-		ext := strings.ToLower(filepath.Ext(name))
-		switch ext {
-		case ".jpg", ".jpeg", ".png", ".webp", ".gif", ".svg", ".bmp":
-			// Allowed
-		default:
+		addDirs(parentDir(relativePath), object.LastModified)
+
+		if photoPath, ok := strings.CutSuffix(relativePath, sidecarSuffix); ok {
+			sidecars[photoPath] = true
 			continue
 		}
 
-		// Store relative path (without prefix)
-		relativePath := object.Key
-		if p.Prefix != "" && strings.HasPrefix(relativePath, prefix) {
-			relativePath = strings.TrimPrefix(relativePath, prefix)
+		// Filter by image extensions
+		name := path.Base(relativePath)
+		if !isImage(name) {
+			continue
 		}
 
-		allPhotos = append(allPhotos, Photo{
-			ID:      object.Key,
-			Name:    name,
+		records = append(records, store.Record{
 			Path:    relativePath,
+			Name:    name,
 			Size:    object.Size,
 			ModTime: object.LastModified,
+			Hash:    strings.Trim(object.ETag, `"`),
 		})
 	}
 
-	// Sort by ModTime desc
-	sort.Slice(allPhotos, func(i, j int) bool {
-		return allPhotos[i].ModTime.After(allPhotos[j].ModTime)
-	})
+	for dir, modTime := range dirTimes {
+		records = append(records, store.Record{
+			Path:    dir,
+			Name:    path.Base(dir),
+			IsDir:   true,
+			ModTime: modTime,
+		})
+	}
 
-	return allPhotos, nil
+	p.sidecarMu.Lock()
+	p.sidecars = sidecars
+	p.sidecarMu.Unlock()
+	return records, nil
 }
 
-func (p *S3Provider) List(cursor string, limit int) ([]Photo, string, error) {
-	p.mu.RLock()
-	// SWR: If scanned and cache exists, check if we should refresh (older than 20s)
-	// If not scanned, we definitely wait or trigger (New starts it).
-	elapsed := time.Since(p.cacheTime)
-	shouldRefresh := elapsed > 20*time.Second
-	isScanning := p.scanning
-	p.mu.RUnlock()
+// isHiddenPath reports whether any segment of a relative key starts with a dot
+func isHiddenPath(relativePath string) bool {
+	for _, segment := range strings.Split(relativePath, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
 
-	if shouldRefresh && !isScanning {
+func (p *S3Provider) List(opts ListOptions) ([]Photo, string, error) {
+	// SWR: serve the index right away and refresh it in the background when older than 20s
+	if p.stale(20 * time.Second) {
 		go p.refreshCache()
 	}
-	
-	p.mu.RLock()
-	defer p.mu.RUnlock()
 
-	// If not scanned yet, return empty list instantly
-	if !p.scanned && p.cache == nil {
-		return []Photo{}, "", nil
-	}
+	return p.list(opts, p.buildKey)
+}
 
-	allPhotos := p.cache
+func (p *S3Provider) TotalCount() int {
+	return p.totalCount()
+}
 
-	// Efficient pagination on the cached slice
-	start := 0
-	if cursor != "" {
-		for i, photo := range allPhotos {
-			if photo.ID == cursor {
-				start = i + 1
-				break
-			}
+// previewHeadSize is how much of a JPEG object is fetched to find the
+// thumbnail embedded in its EXIF block
+const previewHeadSize = 64 << 10
+
+// GetThumbnail serves a cached or shared thumbnail right away. Otherwise the preview
+// embedded in a JPEG stands in while the thumbnail is generated in the
+// background, which thumbnail.ready announces.
+func (p *S3Provider) GetThumbnail(path string, opts thumb.Options) (io.Reader, error) {
+	key, err := p.thumbKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if cachePath, ok := thumb.Cached(key, opts); ok {
+		p.thumbnailServed(path, cachePath, nil)
+		return thumb.OpenThumbnail(cachePath)
+	}
+	// Another instance may have generated it already
+	if shared := p.shared(); shared != nil {
+		if cachePath, ok := thumb.FetchShared(key, opts, shared); ok {
+			p.thumbnailServed(path, cachePath, nil)
+			return thumb.OpenThumbnail(cachePath)
 		}
 	}
 
-	end := start + limit
-	if end > len(allPhotos) {
-		end = len(allPhotos)
+	// The preview is the unedited photo
+	if !key.Edit.IsZero() {
+		return p.renderThumbnail(path, opts)
 	}
-
-	// Important: Copy the slice to avoid race conditions if caller modifies it
-	result := make([]Photo, end-start)
-	copy(result, allPhotos[start:end])
-
-	nextCursor := ""
-	if end < len(allPhotos) && len(result) > 0 {
-		nextCursor = result[len(result)-1].ID
+	if preview, err := p.readPreview(path); err == nil {
+		go func() {
+			r, err := p.renderThumbnail(path, opts)
+			if err != nil {
+				log.Printf("Thumbnail error for %s/%s: %v", p.alias, path, err)
+				return
+			}
+			if c, ok := r.(io.Closer); ok {
+				c.Close()
+			}
+		}()
+		return preview, nil
 	}
 
-	return result, nextCursor, nil
+	return p.renderThumbnail(path, opts)
 }
 
-func (p *S3Provider) TotalCount() int {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	if !p.scanned {
-		return -1 // Indicates scanning
+// thumbKey identifies the thumbnails of path. The ETag versions them, from
+// the index when possible to spare a request. The edit only comes from the index.
+func (p *S3Provider) thumbKey(path string) (thumb.Key, error) {
+	version := ""
+	var edit thumb.Edit
+	if r, ok, err := p.store.Get(p.alias, path); err == nil && ok {
+		version = r.Hash
+		if edit, err = thumb.ParseEdit(r.Edit); err != nil {
+			return thumb.Key{}, err
+		}
+	}
+	if version == "" {
+		info, err := p.Client.StatObject(context.Background(), p.BucketName, p.buildKey(path), minio.StatObjectOptions{})
+		if err != nil {
+			return thumb.Key{}, err
+		}
+		version = info.ETag
 	}
-	return len(p.cache)
+	return thumb.Key{Alias: p.alias, Path: path, Version: version, Edit: edit}, nil
 }
 
-func (p *S3Provider) GetThumbnail(path string) (io.Reader, error) {
+// renderThumbnail returns the full thumbnail of path, waiting for it to be
+// generated if needed
+func (p *S3Provider) renderThumbnail(path string, opts thumb.Options) (io.Reader, error) {
 	ctx := context.Background()
 
-	// Build full key
-	key := p.buildKey(path)
+	key, err := p.thumbKey(path)
+	if err != nil {
+		return nil, err
+	}
 
-	// Download the object to a temp file for thumbnail generation
-	object, err := p.Client.GetObject(ctx, p.BucketName, key, minio.GetObjectOptions{})
+	// The object is only downloaded on a miss of both the local and the bucket cache
+	thumbPath, summary, err := thumb.GenerateShared(key, opts,
+		func() (io.ReadCloser, error) {
+			return p.Client.GetObject(ctx, p.BucketName, p.buildKey(path), minio.GetObjectOptions{})
+		}, p.shared())
 	if err != nil {
 		return nil, err
 	}
-	defer object.Close()
+	p.thumbnailServed(path, thumbPath, summary)
 
-	// Read into memory (for thumbnail generation)
-	data, err := io.ReadAll(object)
+	// Return the thumbnail file
+	return thumb.OpenThumbnail(thumbPath)
+}
+
+// readPreview fetches the head of a JPEG object and returns the thumbnail
+// embedded in its EXIF block
+func (p *S3Provider) readPreview(path string) (*thumb.Preview, error) {
+	if !isJPEG(path) {
+		return nil, meta.ErrNoPreview
+	}
+
+	head, err := p.readHead(path, previewHeadSize)
 	if err != nil {
 		return nil, err
 	}
 
-	// Generate thumbnail from bytes
-	thumbPath, err := thumb.GenerateFromBytes(data, path)
+	data, orientation, err := meta.ReadPreview(bytes.NewReader(head))
 	if err != nil {
 		return nil, err
 	}
+	return thumb.NewPreview(data, orientation)
+}
 
-	// Return the thumbnail file
-	return thumb.OpenThumbnail(thumbPath)
+func (p *S3Provider) GetExif(path string) (*meta.Exif, error) {
+	return p.exif(path, p.readExif)
+}
+
+func (p *S3Provider) GetEdit(path string) (thumb.Edit, error) {
+	return p.edit(path)
+}
+
+func (p *S3Provider) SetEdit(path string, e thumb.Edit) error {
+	ctx := context.Background()
+	key := p.buildKey(path) + sidecarSuffix
+
+	if e.IsZero() {
+		if err := p.Client.RemoveObject(ctx, p.BucketName, key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	} else {
+		data := encodeSidecar(e)
+		if _, err := p.Client.PutObject(ctx, p.BucketName, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+			ContentType: "application/json",
+		}); err != nil {
+			return err
+		}
+	}
+	p.setSidecar(path, !e.IsZero())
+	p.removeSharedThumbs(path)
+	return p.editChanged(path, e)
+}
+
+// readSidecar opens the sidecar object of a photo, if it has one
+func (p *S3Provider) readSidecar(path string) (io.ReadCloser, error) {
+	object, err := p.Client.GetObject(context.Background(), p.BucketName, p.buildKey(path)+sidecarSuffix, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, Stat sends the request
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, err
+	}
+	return object, nil
+}
+
+// moveSidecar moves the edit along with its photo. A photo replaced at
+// dest takes its edit along.
+func (p *S3Provider) moveSidecar(src, dest string) {
+	ctx := context.Background()
+	srcKey := p.buildKey(src) + sidecarSuffix
+	destKey := p.buildKey(dest) + sidecarSuffix
+	p.setSidecar(src, false)
+	p.setSidecar(dest, false)
+
+	_, err := p.Client.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket: p.BucketName,
+		Object: destKey,
+	}, minio.CopySrcOptions{
+		Bucket: p.BucketName,
+		Object: srcKey,
+	})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			log.Printf("Failed to move edit of %s: %v", srcKey, err)
+		}
+		p.Client.RemoveObject(ctx, p.BucketName, destKey, minio.RemoveObjectOptions{})
+		return
+	}
+	p.setSidecar(dest, true)
+	p.Client.RemoveObject(ctx, p.BucketName, srcKey, minio.RemoveObjectOptions{})
 }
 
 func (p *S3Provider) GetFileReader(path string) (io.ReadCloser, error) {
@@ -296,17 +567,19 @@ func (p *S3Provider) GetOriginalURL(path string) (string, error) {
 }
 
 func (p *S3Provider) Delete(path string) error {
-	defer p.invalidateCache() // Invalidate cache on change
-
 	ctx := context.Background()
 	key := p.buildKey(path)
 
-	return p.Client.RemoveObject(ctx, p.BucketName, key, minio.RemoveObjectOptions{})
+	if err := p.Client.RemoveObject(ctx, p.BucketName, key, minio.RemoveObjectOptions{}); err != nil {
+		return err
+	}
+	p.removeSharedThumbs(path)
+	p.Client.RemoveObject(ctx, p.BucketName, key+sidecarSuffix, minio.RemoveObjectOptions{})
+	p.setSidecar(path, false)
+	return p.indexRemove(path)
 }
 
 func (p *S3Provider) Move(src, dest string) error {
-	defer p.invalidateCache() // Invalidate cache on change
-
 	ctx := context.Background()
 
 	srcKey := p.buildKey(src)
@@ -325,14 +598,21 @@ func (p *S3Provider) Move(src, dest string) error {
 	}
 
 	// Delete original
-	return p.Client.RemoveObject(ctx, p.BucketName, srcKey, minio.RemoveObjectOptions{})
+	if err := p.Client.RemoveObject(ctx, p.BucketName, srcKey, minio.RemoveObjectOptions{}); err != nil {
+		return err
+	}
+	p.removeSharedThumbs(src)
+	p.moveSidecar(src, dest)
+	return p.indexMove(src, dest)
 }
 
 func (p *S3Provider) Upload(filename string, data io.Reader) (string, error) {
-	defer p.invalidateCache() // Invalidate cache on change
-
 	ctx := context.Background()
 
+	filename, err := CleanPath(filename)
+	if err != nil {
+		return "", err
+	}
 	ext := filepath.Ext(filename)
 	name := strings.TrimSuffix(filename, ext)
 
@@ -342,10 +622,13 @@ func (p *S3Provider) Upload(filename string, data io.Reader) (string, error) {
 	// Conflict resolution (check if key exists)
 	for i := 1; ; i++ {
 		_, err := p.Client.StatObject(ctx, p.BucketName, key, minio.StatObjectOptions{})
-		if err != nil {
-			// Object doesn't exist, we're good
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
 			break
 		}
+		if err != nil {
+			// Anything else, e.g. denied access, must not overwrite blindly
+			return "", err
+		}
 		finalName = fmt.Sprintf("%s_%d%s", name, i, ext)
 		key = p.buildKey(finalName)
 	}
@@ -367,30 +650,84 @@ func (p *S3Provider) Upload(filename string, data io.Reader) (string, error) {
 		contentType = "image/bmp"
 	}
 
-	// Read all data into memory to know the size
-	buf, err := io.ReadAll(data)
-	if err != nil {
+	// Small files go up in a single PUT. Anything larger streams through a
+	// multipart upload that only ever buffers one part.
+	var head bytes.Buffer
+	var body io.Reader
+	size := int64(-1)
+	n, err := io.CopyN(&head, data, smallUploadSize)
+	switch err {
+	case io.EOF:
+		body, size = &head, n
+	case nil:
+		body = io.MultiReader(&head, data)
+	default:
 		return "", err
 	}
 
-	_, err = p.Client.PutObject(ctx, p.BucketName, key, bytes.NewReader(buf), int64(len(buf)), minio.PutObjectOptions{
+	info, err := p.Client.PutObject(ctx, p.BucketName, key, body, size, minio.PutObjectOptions{
 		ContentType: contentType,
+		PartSize:    p.partSize,
 	})
 	if err != nil {
+		// minio aborts its multipart upload on failure, this covers the abort
+		// request itself failing so no orphaned parts are left behind
+		if size < 0 {
+			if rmErr := p.Client.RemoveIncompleteUpload(context.Background(), p.BucketName, key); rmErr != nil {
+				log.Printf("Failed to abort multipart upload of %s: %v", key, rmErr)
+			}
+		}
 		return "", err
 	}
 
+	modTime := info.LastModified
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	if err := p.indexAdd(store.Record{
+		Path:    finalName,
+		Name:    path.Base(finalName),
+		Size:    info.Size,
+		ModTime: modTime,
+		Hash:    info.ETag,
+	}); err != nil {
+		return "", err
+	}
+	go p.computeMeta(p.objectMeta)
+
 	return finalName, nil
 }
 
-func (p *S3Provider) buildKey(path string) string {
-	if p.Prefix == "" {
-		return path
+// keyPrefix returns the configured prefix with a trailing slash, or "" for the bucket root
+func (p *S3Provider) keyPrefix() string {
+	if p.Prefix == "" || strings.HasSuffix(p.Prefix, "/") {
+		return p.Prefix
 	}
-	
-	prefix := p.Prefix
-	if !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
+	return p.Prefix + "/"
+}
+
+// abortStaleUploads cleans up multipart uploads left behind by crashed or
+// killed uploads, whose parts would otherwise be billed forever
+func (p *S3Provider) abortStaleUploads() {
+	ctx := context.Background()
+	core := minio.Core{Client: p.Client}
+
+	for upload := range p.Client.ListIncompleteUploads(ctx, p.BucketName, p.keyPrefix(), true) {
+		if upload.Err != nil {
+			log.Printf("Failed to list incomplete uploads of %s: %v", p.alias, upload.Err)
+			return
+		}
+		if time.Since(upload.Initiated) < staleUploadAge {
+			continue
+		}
+		if err := core.AbortMultipartUpload(ctx, p.BucketName, upload.Key, upload.UploadID); err != nil {
+			log.Printf("Failed to abort stale upload of %s: %v", upload.Key, err)
+			continue
+		}
+		log.Printf("Aborted stale multipart upload of %s", upload.Key)
 	}
-	return prefix + path
+}
+
+func (p *S3Provider) buildKey(path string) string {
+	return p.keyPrefix() + path
 }
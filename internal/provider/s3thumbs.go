@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+
+	"photomato/internal/thumb"
+)
+
+// bucketThumbs keeps the thumbnails of an S3 alias in its bucket, so every
+// instance serving the alias generates each of them only once
+type bucketThumbs struct {
+	p *S3Provider
+}
+
+// thumbPrefix returns where shared thumbnails live, "" when they are not shared
+func (p *S3Provider) thumbPrefix() string {
+	if p.ThumbPrefix == "" {
+		return ""
+	}
+	return p.keyPrefix() + strings.Trim(p.ThumbPrefix, "/") + "/"
+}
+
+// shared returns the bucket as shared thumbnail cache, or nil if disabled
+func (p *S3Provider) shared() thumb.Shared {
+	if p.ThumbPrefix == "" {
+		return nil
+	}
+	return bucketThumbs{p}
+}
+
+// objectKey names a thumbnail after its photo, so all variants of a photo
+// share one folder
+func (t bucketThumbs) objectKey(key thumb.Key, opts thumb.Options) string {
+	return fmt.Sprintf("%s%s/%s_%d.%s", t.p.thumbPrefix(), key.Path, key.Tag(), opts.Size, opts.Format)
+}
+
+func (t bucketThumbs) Fetch(key thumb.Key, opts thumb.Options) (io.ReadCloser, error) {
+	object, err := t.p.Client.GetObject(context.Background(), t.p.BucketName, t.objectKey(key, opts), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, Stat sends the request
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fs.ErrNotExist
+		}
+		return nil, err
+	}
+	return object, nil
+}
+
+func (t bucketThumbs) Store(key thumb.Key, opts thumb.Options, r io.Reader, size int64) error {
+	_, err := t.p.Client.PutObject(context.Background(), t.p.BucketName, t.objectKey(key, opts), r, size, minio.PutObjectOptions{
+		ContentType: opts.Format.ContentType(),
+	})
+	return err
+}
+
+// removeSharedThumbs deletes the thumbnails of a photo from the bucket
+func (p *S3Provider) removeSharedThumbs(path string) {
+	if p.ThumbPrefix == "" {
+		return
+	}
+	ctx := context.Background()
+
+	opts := minio.ListObjectsOptions{Prefix: p.thumbPrefix() + path + "/", Recursive: true}
+	for object := range p.Client.ListObjects(ctx, p.BucketName, opts) {
+		if object.Err != nil {
+			log.Printf("Failed to list shared thumbnails of %s: %v", path, object.Err)
+			return
+		}
+		if err := p.Client.RemoveObject(ctx, p.BucketName, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			log.Printf("Failed to remove shared thumbnail %s: %v", object.Key, err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package provider
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"photomato/internal/thumb"
+)
+
+// warmIdleWait is how long the warmer backs off while thumbnails are being
+// generated for clients, which always go first
+const warmIdleWait = 200 * time.Millisecond
+
+// Warmer pre-generates thumbnails of new photos in the background, one at a
+// time and only while no client is waiting for a thumbnail
+type Warmer struct {
+	sizes []int
+
+	mu       sync.Mutex
+	queue    []warmJob
+	queued   map[warmJob]bool
+	progress map[string]*WarmProgress
+	paused   bool
+	wake     chan struct{}
+}
+
+type warmJob struct {
+	alias string
+	path  string
+}
+
+// WarmProgress is the state of the current batch of an alias
+type WarmProgress struct {
+	Total   int    `json:"total"`
+	Done    int    `json:"done"`
+	Failed  int    `json:"failed"`
+	Current string `json:"current,omitempty"`
+
+	render func(string, thumb.Options) (io.Reader, error)
+}
+
+// NewWarmer creates a warmer generating the given widths in the preferred
+// format, no sizes means the default one
+func NewWarmer(sizes []int) *Warmer {
+	return &Warmer{
+		sizes:    sizes,
+		queued:   make(map[warmJob]bool),
+		progress: make(map[string]*WarmProgress),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Enqueue schedules paths of an alias, render produces their thumbnails
+func (w *Warmer) Enqueue(alias string, paths []string, render func(string, thumb.Options) (io.Reader, error)) {
+	if w == nil || len(paths) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p, ok := w.progress[alias]
+	if !ok || p.Done+p.Failed == p.Total {
+		// Start a new batch
+		p = &WarmProgress{}
+		w.progress[alias] = p
+	}
+	// The latest provider of the alias renders, e.g. after it was reconfigured
+	p.render = render
+
+	for _, path := range paths {
+		job := warmJob{alias, path}
+		if w.queued[job] {
+			continue
+		}
+		w.queued[job] = true
+		w.queue = append(w.queue, job)
+		p.Total++
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Drop forgets the queued work of an alias, e.g. when it is removed
+func (w *Warmer) Drop(alias string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	queue := w.queue[:0]
+	for _, job := range w.queue {
+		if job.alias == alias {
+			delete(w.queued, job)
+			continue
+		}
+		queue = append(queue, job)
+	}
+	w.queue = queue
+	delete(w.progress, alias)
+}
+
+// Handover passes the queued work of an alias to the provider replacing it,
+// e.g. after it was renamed or reconfigured. The work is dropped if to does
+// not pre-generate thumbnails.
+func (w *Warmer) Handover(from string, to Provider) {
+	t, ok := to.(interface {
+		warming() (string, *Warmer, func(string, thumb.Options) (io.Reader, error))
+	})
+	if !ok {
+		w.Drop(from)
+		return
+	}
+	alias, warmer, render := t.warming()
+	if warmer != w {
+		w.Drop(from)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p, ok := w.progress[from]
+	if !ok {
+		return
+	}
+	p.render = render
+	if alias == from {
+		return
+	}
+
+	// The new provider may have queued photos already
+	delete(w.progress, from)
+	if cur, ok := w.progress[alias]; ok {
+		cur.Total += p.Total - p.Done - p.Failed
+		if p.Current != "" {
+			cur.Total-- // Counted into p when done
+		}
+		p = cur
+	} else {
+		w.progress[alias] = p
+	}
+	queue := w.queue[:0]
+	for _, job := range w.queue {
+		if job.alias == from {
+			delete(w.queued, job)
+			job.alias = alias
+			if w.queued[job] {
+				p.Total--
+				continue
+			}
+			w.queued[job] = true
+		}
+		queue = append(queue, job)
+	}
+	w.queue = queue
+}
+
+// SetPaused stops or resumes the warmer, the current photo is finished first
+func (w *Warmer) SetPaused(paused bool) {
+	w.mu.Lock()
+	w.paused = paused
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Progress returns whether the warmer is paused and the progress per alias
+func (w *Warmer) Progress() (bool, map[string]WarmProgress) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	progress := make(map[string]WarmProgress, len(w.progress))
+	for alias, p := range w.progress {
+		progress[alias] = *p
+	}
+	return w.paused, progress
+}
+
+// next waits for a job, it returns the job, the progress it counts into and
+// how to render it
+func (w *Warmer) next() (warmJob, *WarmProgress, func(string, thumb.Options) (io.Reader, error)) {
+	for {
+		w.mu.Lock()
+		if !w.paused && len(w.queue) > 0 {
+			job := w.queue[0]
+			w.queue = w.queue[1:]
+			delete(w.queued, job)
+			p := w.progress[job.alias]
+			p.Current = job.path
+			render := p.render
+			w.mu.Unlock()
+			return job, p, render
+		}
+		w.mu.Unlock()
+		<-w.wake
+	}
+}
+
+// Run processes the queue, it never returns
+func (w *Warmer) Run() {
+	for {
+		job, p, render := w.next()
+
+		// Clients first
+		for !thumb.Idle() {
+			time.Sleep(warmIdleWait)
+		}
+
+		sizes := w.sizes
+		if len(sizes) == 0 {
+			sizes = []int{thumb.Size}
+		}
+
+		var failed error
+		for _, size := range sizes {
+			r, err := render(job.path, thumb.Options{Size: size, Format: thumb.Formats[0]})
+			if err != nil {
+				failed = err
+				break
+			}
+			if c, ok := r.(io.Closer); ok {
+				c.Close()
+			}
+		}
+
+		w.mu.Lock()
+		p.Current = ""
+		if failed != nil {
+			p.Failed++
+		} else {
+			p.Done++
+		}
+		w.mu.Unlock()
+
+		if failed != nil {
+			log.Printf("Failed to pre-generate thumbnail of %s/%s: %v", job.alias, job.path, failed)
+		}
+	}
+}
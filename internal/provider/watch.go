@@ -0,0 +1,246 @@
+package provider
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"photomato/internal/events"
+	"photomato/internal/store"
+)
+
+const (
+	// rescanInterval is how often a watched tree is still rescanned in full,
+	// to catch whatever the watcher missed (overflows, network filesystems)
+	rescanInterval = 10 * time.Minute
+
+	// Events are collected until the tree has been quiet for watchSettle,
+	// but never held longer than watchMaxDelay, e.g. during a long copy
+	watchSettle   = 500 * time.Millisecond
+	watchMaxDelay = 5 * time.Second
+)
+
+// startWatcher watches the directory tree and applies changes to the index
+// as they happen. inotify is not recursive, so every folder gets its own watch.
+func (p *LocalProvider) startWatcher() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(p.RootPath); err != nil {
+		w.Close()
+		return err
+	}
+	p.watcher = w
+	p.addWatches(p.RootPath)
+
+	go p.watchLoop(w)
+	return nil
+}
+
+// addWatches watches dir and every visible folder below it
+func (p *LocalProvider) addWatches(dir string) {
+	filepath.WalkDir(dir, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		if fullPath != p.RootPath && entry.Name()[0] == '.' {
+			return filepath.SkipDir
+		}
+		if err := p.watcher.Add(fullPath); err != nil {
+			// Most likely out of inotify watches, the periodic rescan still covers it
+			log.Printf("Failed to watch %s: %v", fullPath, err)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// relPath returns the index path of a watched file, ok is false for the root
+// and for hidden entries
+func (p *LocalProvider) relPath(fullPath string) (string, bool) {
+	rel, err := filepath.Rel(p.RootPath, fullPath)
+	if err != nil || rel == "." {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if isHiddenPath(rel) {
+		return "", false
+	}
+	return rel, true
+}
+
+func (p *LocalProvider) watchLoop(w *fsnotify.Watcher) {
+	pending := make(map[string]struct{})
+	var first time.Time
+
+	settle := time.NewTimer(watchSettle)
+	settle.Stop()
+	rescan := time.NewTicker(rescanInterval)
+	defer rescan.Stop()
+
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			rel, ok := p.relPath(event.Name)
+			if !ok {
+				continue
+			}
+			if len(pending) == 0 {
+				first = time.Now()
+			}
+			pending[rel] = struct{}{}
+
+			if time.Since(first) < watchMaxDelay {
+				settle.Reset(watchSettle)
+			} else {
+				settle.Reset(0)
+			}
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watcher error for %s: %v", p.alias, err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				go p.refreshCache()
+			}
+
+		case <-settle.C:
+			start := time.Now()
+			result := p.applyChanges(pending)
+			// A large batch, like a folder moved in, is announced as refresh does
+			n := len(result.Added) + len(result.Updated) + len(result.Removed)
+			p.changed(result, n <= maxChangeEvents)
+			if n > maxChangeEvents {
+				p.publish(events.Event{Type: events.ScanFinished, Scan: &events.ScanStats{
+					Added:    len(result.Added),
+					Updated:  len(result.Updated),
+					Removed:  len(result.Removed),
+					Total:    p.totalCount(),
+					Duration: time.Since(start).Milliseconds(),
+				}})
+			}
+			pending = make(map[string]struct{})
+
+		case <-rescan.C:
+			go p.refreshCache()
+		}
+	}
+}
+
+// applyChanges brings the index in line with the current state of the given
+// paths. Whatever no longer exists is dropped together with its subtree.
+func (p *LocalProvider) applyChanges(paths map[string]struct{}) store.SyncResult {
+	var result store.SyncResult
+
+	// Handle what is gone first: a moved folder keeps its inotify watch under
+	// the old path until that is removed, and would not be watched at the new one
+	existing := make(map[string]os.FileInfo)
+	for rel := range paths {
+		fullPath := filepath.Join(p.RootPath, filepath.FromSlash(rel))
+		info, err := os.Stat(fullPath)
+		if err == nil {
+			existing[rel] = info
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		p.unwatch(fullPath)
+		removed, err := p.store.RemoveTree(p.alias, rel)
+		if err != nil {
+			log.Printf("Failed to remove %s/%s from index: %v", p.alias, rel, err)
+			continue
+		}
+		result.Removed = append(result.Removed, removed...)
+	}
+
+	for rel, info := range existing {
+		var records []store.Record
+		if info.IsDir() {
+			// A new or moved-in folder, watch it and index its content
+			fullPath := filepath.Join(p.RootPath, filepath.FromSlash(rel))
+			p.addWatches(fullPath)
+			var err error
+			if records, err = p.walk(fullPath); err != nil {
+				continue
+			}
+		} else if isImage(info.Name()) {
+			records = []store.Record{{
+				Path:    rel,
+				Name:    info.Name(),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			}}
+		}
+
+		for _, r := range records {
+			var err error
+			if r.IsDir {
+				err = p.store.PutDir(p.alias, r.Path, r.ModTime)
+			} else {
+				err = p.indexPhoto(r, &result)
+			}
+			if err != nil {
+				log.Printf("Failed to index %s/%s: %v", p.alias, r.Path, err)
+			}
+		}
+	}
+
+	if len(result.Added)+len(result.Updated) > 0 {
+		go p.computeMeta(p.fileMeta)
+	}
+	return result
+}
+
+// unwatch drops the watches of fullPath and everything below it
+func (p *LocalProvider) unwatch(fullPath string) {
+	for _, watched := range p.watcher.WatchList() {
+		if watched == fullPath || strings.HasPrefix(watched, fullPath+string(filepath.Separator)) {
+			p.watcher.Remove(watched)
+		}
+	}
+}
+
+// indexPhoto stores r unless the index already has it with the same size and
+// modification time, e.g. because the provider wrote the file itself
+func (p *LocalProvider) indexPhoto(r store.Record, result *store.SyncResult) error {
+	existing, ok, err := p.store.Get(p.alias, r.Path)
+	if err != nil {
+		return err
+	}
+	if ok && existing.Size == r.Size && existing.ModTime.Equal(r.ModTime) {
+		return nil
+	}
+	if err := p.store.Put(p.alias, r); err != nil {
+		return err
+	}
+	if ok {
+		result.Updated = append(result.Updated, r.Path)
+	} else {
+		result.Added = append(result.Added, r.Path)
+	}
+	return nil
+}
+
+// Close stops watching the directory tree
+func (p *LocalProvider) Close() error {
+	if p.watcher == nil {
+		return nil
+	}
+	return p.watcher.Close()
+}
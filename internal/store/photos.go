@@ -0,0 +1,679 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Record is one indexed photo or folder of an alias
+type Record struct {
+	Path    string // Relative to the alias root, slash separated
+	Name    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+	Hash    string // Content hash (ETag for S3), empty until computed
+	Width   int
+	Height  int
+	Exif    string    // JSON encoded EXIF fields
+	TakenAt time.Time // Capture date from EXIF, zero if unknown
+
+	// Placeholder shown until the thumbnail loads, set when one is generated
+	BlurHash string
+	Color    string // Dominant colour as #rrggbb
+
+	Edit string // Non-destructive edit, mirrors the sidecar of the photo
+
+	MetaVersion int // Version of the code that computed the metadata, 0 if pending
+}
+
+// EffectiveTime is the capture date, falling back to ModTime when the photo has none
+func (r Record) EffectiveTime() time.Time {
+	if !r.TakenAt.IsZero() {
+		return r.TakenAt
+	}
+	return r.ModTime
+}
+
+// Meta holds the per-photo metadata computed after a scan
+type Meta struct {
+	Hash    string
+	Width   int
+	Height  int
+	Exif    string
+	TakenAt time.Time
+	Edit    string
+}
+
+// SyncResult lists the photo paths changed by a Sync
+type SyncResult struct {
+	Added   []string
+	Updated []string
+	Removed []string
+}
+
+// Sort keys for photo listings
+const (
+	SortName    = "name"
+	SortSize    = "size"
+	SortModTime = "mtime"
+	SortTaken   = "taken" // Capture date, falling back to mtime
+)
+
+// Sort orders for photo listings
+const (
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+// Query selects one page of an alias listing
+type Query struct {
+	Dir       string // Folder to list, "" for the root
+	Recursive bool   // List every photo below Dir instead of its direct entries
+	Sort      string // One of the Sort keys, SortModTime if empty
+	Order     string // OrderAsc or OrderDesc, OrderDesc if empty
+	Cursor    string // Opaque cursor returned by the previous page
+	Limit     int
+
+	// Filters, zero values disable them. They only apply to photos, not folders.
+	Exts    []string  // Extensions without the dot, e.g. "jpg"
+	MinSize int64     // Bytes, inclusive
+	MaxSize int64     // Bytes, inclusive
+	From    time.Time // Capture date (falling back to mtime), inclusive
+	To      time.Time // Capture date (falling back to mtime), exclusive
+}
+
+// cursor marks the last entry of a page by its sort key and path.
+// Folder listings return all folders before any photo, so Dir tells which of
+// the two the cursor points into.
+type cursor struct {
+	Dir  bool   `json:"d,omitempty"`
+	Num  int64  `json:"n,omitempty"` // Size or time key
+	Str  string `json:"s,omitempty"` // Name key
+	Path string `json:"p"`
+}
+
+// sortExpr returns the SQL expression ordering photos by sort
+func sortExpr(sort string) string {
+	switch sort {
+	case SortName:
+		return "name COLLATE NOCASE"
+	case SortSize:
+		return "size"
+	case SortTaken:
+		return takenExpr
+	}
+	return "mod_time"
+}
+
+// cursorFor builds the cursor pointing at r for the given sort
+func cursorFor(r Record, sort string) cursor {
+	c := cursor{Dir: r.IsDir, Path: r.Path}
+	switch sort {
+	case SortName:
+		c.Str = r.Name
+	case SortSize:
+		c.Num = r.Size
+	case SortTaken:
+		c.Num = r.EffectiveTime().UnixNano()
+	default:
+		c.Num = r.ModTime.UnixNano()
+	}
+	return c
+}
+
+// cursorKey returns the cursor value compared against sortExpr
+func cursorKey(c cursor, sort string) any {
+	if sort == SortName {
+		return c.Str
+	}
+	return c.Num
+}
+
+const recordColumns = "path, name, is_dir, size, mod_time, hash, width, height, exif, taken_at, meta_version, blurhash, color, edit"
+
+// takenExpr is the capture date with the mtime fallback, matching the photos_taken index
+const takenExpr = "(CASE WHEN taken_at > 0 THEN taken_at ELSE mod_time END)"
+
+// unixNano stores zero times as 0 instead of an out of range value
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+// parentDir returns the folder containing p, "" for the root
+func parentDir(p string) string {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return ""
+	}
+	return p[:i]
+}
+
+// escapeLike escapes the LIKE wildcards in s, to be used with ESCAPE '\'
+func escapeLike(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "%", `\%`)
+	return strings.ReplaceAll(s, "_", `\_`)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func scanRecords(rows *sql.Rows) ([]Record, error) {
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var r Record
+		var isDir int
+		var modTime, takenAt int64
+		if err := rows.Scan(&r.Path, &r.Name, &isDir, &r.Size, &modTime, &r.Hash, &r.Width, &r.Height, &r.Exif, &takenAt, &r.MetaVersion, &r.BlurHash, &r.Color, &r.Edit); err != nil {
+			return nil, err
+		}
+		r.IsDir = isDir == 1
+		r.ModTime = time.Unix(0, modTime)
+		if takenAt != 0 {
+			r.TakenAt = time.Unix(0, takenAt)
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// List returns one page of the alias listing and the cursor for the next page.
+// Folders come first by path, photos follow by q.Sort and q.Order with the path
+// breaking ties, so cursors stay stable under every ordering.
+func (s *Store) List(alias string, q Query) ([]Record, string, error) {
+	var after *cursor
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &c
+	}
+
+	// Fetch one extra row to know whether another page follows
+	want := q.Limit + 1
+	var records []Record
+
+	if !q.Recursive && (after == nil || after.Dir) {
+		query := "SELECT " + recordColumns + " FROM photos WHERE alias = ? AND is_dir = 1 AND dir = ?"
+		args := []any{alias, q.Dir}
+		if after != nil {
+			query += " AND path > ?"
+			args = append(args, after.Path)
+		}
+		query += " ORDER BY path LIMIT ?"
+		args = append(args, want)
+
+		rows, err := s.db.Query(query, args...)
+		if err != nil {
+			return nil, "", err
+		}
+		dirs, err := scanRecords(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		records = append(records, dirs...)
+		// Photos start from the beginning once the folders are exhausted
+		after = nil
+	}
+
+	if len(records) < want {
+		query := "SELECT " + recordColumns + " FROM photos WHERE alias = ? AND is_dir = 0"
+		args := []any{alias}
+		switch {
+		case !q.Recursive:
+			query += " AND dir = ?"
+			args = append(args, q.Dir)
+		case q.Dir != "":
+			query += ` AND (dir = ? OR dir LIKE ? ESCAPE '\')`
+			args = append(args, q.Dir, escapeLike(q.Dir)+"/%")
+		}
+		filter, filterArgs := filterClause(q)
+		query += filter
+		args = append(args, filterArgs...)
+
+		expr := sortExpr(q.Sort)
+		cmp, dir := "<", "DESC"
+		if q.Order == OrderAsc {
+			cmp, dir = ">", "ASC"
+		}
+		if after != nil {
+			key := cursorKey(*after, q.Sort)
+			query += " AND (" + expr + " " + cmp + " ? OR (" + expr + " = ? AND path > ?))"
+			args = append(args, key, key, after.Path)
+		}
+		query += " ORDER BY " + expr + " " + dir + ", path LIMIT ?"
+		args = append(args, want-len(records))
+
+		rows, err := s.db.Query(query, args...)
+		if err != nil {
+			return nil, "", err
+		}
+		photos, err := scanRecords(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		records = append(records, photos...)
+	}
+
+	next := ""
+	if len(records) > q.Limit {
+		records = records[:q.Limit]
+		if len(records) > 0 {
+			last := records[len(records)-1]
+			next = encodeCursor(cursorFor(last, q.Sort))
+		}
+	}
+	return records, next, nil
+}
+
+// filterClause returns the SQL conditions for the filters of q
+func filterClause(q Query) (string, []any) {
+	var clause string
+	var args []any
+
+	if len(q.Exts) > 0 {
+		var exts []string
+		for _, ext := range q.Exts {
+			exts = append(exts, `name LIKE ? ESCAPE '\'`)
+			args = append(args, "%."+escapeLike(strings.TrimPrefix(ext, ".")))
+		}
+		clause += " AND (" + strings.Join(exts, " OR ") + ")"
+	}
+	if q.MinSize > 0 {
+		clause += " AND size >= ?"
+		args = append(args, q.MinSize)
+	}
+	if q.MaxSize > 0 {
+		clause += " AND size <= ?"
+		args = append(args, q.MaxSize)
+	}
+	if !q.From.IsZero() {
+		clause += " AND " + takenExpr + " >= ?"
+		args = append(args, q.From.UnixNano())
+	}
+	if !q.To.IsZero() {
+		clause += " AND " + takenExpr + " < ?"
+		args = append(args, q.To.UnixNano())
+	}
+	return clause, args
+}
+
+// Get returns the indexed photo at path, ok is false if it is not indexed
+func (s *Store) Get(alias, p string) (r Record, ok bool, err error) {
+	rows, err := s.db.Query("SELECT "+recordColumns+" FROM photos WHERE alias = ? AND path = ? AND is_dir = 0", alias, p)
+	if err != nil {
+		return r, false, err
+	}
+	records, err := scanRecords(rows)
+	if err != nil || len(records) == 0 {
+		return r, false, err
+	}
+	return records[0], true, nil
+}
+
+// Count returns the number of photos indexed for an alias
+func (s *Store) Count(alias string) (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM photos WHERE alias = ? AND is_dir = 0", alias).Scan(&n)
+	return n, err
+}
+
+// ScannedAt returns when the alias last completed a scan, ok is false if it never did
+func (s *Store) ScannedAt(alias string) (t time.Time, ok bool, err error) {
+	var nanos int64
+	err = s.db.QueryRow("SELECT scanned_at FROM scans WHERE alias = ?", alias).Scan(&nanos)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, nanos), true, nil
+}
+
+type indexedRow struct {
+	size    int64
+	modTime int64
+	hash    string
+}
+
+// Sync replaces the index of an alias with the result of a full scan.
+// Unchanged rows keep their computed metadata, changed rows are reset so it
+// gets computed again, and rows missing from records are removed.
+func (s *Store) Sync(alias string, records []Record) (SyncResult, error) {
+	var result SyncResult
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	type rowKey struct {
+		path  string
+		isDir bool
+	}
+	existing := make(map[rowKey]indexedRow)
+
+	rows, err := tx.Query("SELECT path, is_dir, size, mod_time, hash FROM photos WHERE alias = ?", alias)
+	if err != nil {
+		return result, err
+	}
+	for rows.Next() {
+		var k rowKey
+		var isDir int
+		var row indexedRow
+		if err := rows.Scan(&k.path, &isDir, &row.size, &row.modTime, &row.hash); err != nil {
+			rows.Close()
+			return result, err
+		}
+		k.isDir = isDir == 1
+		existing[k] = row
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	insert, err := tx.Prepare(`INSERT INTO photos (alias, path, dir, name, is_dir, size, mod_time, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return result, err
+	}
+	defer insert.Close()
+
+	update, err := tx.Prepare(`UPDATE photos SET size = ?, mod_time = ?, hash = ?,
+		width = 0, height = 0, exif = '', taken_at = 0, meta_version = 0, blurhash = '', color = '', edit = ''
+		WHERE alias = ? AND path = ? AND is_dir = ?`)
+	if err != nil {
+		return result, err
+	}
+	defer update.Close()
+
+	remove, err := tx.Prepare("DELETE FROM photos WHERE alias = ? AND path = ? AND is_dir = ?")
+	if err != nil {
+		return result, err
+	}
+	defer remove.Close()
+
+	for _, r := range records {
+		k := rowKey{r.Path, r.IsDir}
+		modTime := r.ModTime.UnixNano()
+		row, ok := existing[k]
+		if !ok {
+			if _, err := insert.Exec(alias, r.Path, parentDir(r.Path), r.Name, boolInt(r.IsDir), r.Size, modTime, r.Hash); err != nil {
+				return result, err
+			}
+			if !r.IsDir {
+				result.Added = append(result.Added, r.Path)
+			}
+			continue
+		}
+		delete(existing, k)
+
+		changed := row.size != r.Size || row.modTime != modTime || (r.Hash != "" && r.Hash != row.hash)
+		if !changed {
+			continue
+		}
+		if _, err := update.Exec(r.Size, modTime, r.Hash, alias, r.Path, boolInt(r.IsDir)); err != nil {
+			return result, err
+		}
+		if !r.IsDir {
+			result.Updated = append(result.Updated, r.Path)
+		}
+	}
+
+	// Whatever was not seen by the scan is gone
+	for k := range existing {
+		if _, err := remove.Exec(alias, k.path, boolInt(k.isDir)); err != nil {
+			return result, err
+		}
+		if !k.isDir {
+			result.Removed = append(result.Removed, k.path)
+		}
+	}
+
+	if _, err := tx.Exec(`INSERT INTO scans (alias, scanned_at) VALUES (?, ?)
+		ON CONFLICT (alias) DO UPDATE SET scanned_at = excluded.scanned_at`, alias, time.Now().UnixNano()); err != nil {
+		return result, err
+	}
+
+	return result, tx.Commit()
+}
+
+// ensureDirs adds the folder rows for dir and all of its parents
+func ensureDirs(tx *sql.Tx, alias, dir string, modTime time.Time) error {
+	for ; dir != ""; dir = parentDir(dir) {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO photos (alias, path, dir, name, is_dir, mod_time)
+			VALUES (?, ?, ?, ?, 1, ?)`, alias, dir, parentDir(dir), path.Base(dir), modTime.UnixNano()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put adds or replaces a single photo, e.g. after an upload
+func (s *Store) Put(alias string, r Record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ensureDirs(tx, alias, parentDir(r.Path), r.ModTime); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO photos (alias, path, dir, name, is_dir, size, mod_time, hash)
+		VALUES (?, ?, ?, ?, 0, ?, ?, ?)
+		ON CONFLICT (alias, path, is_dir) DO UPDATE SET
+			size = excluded.size, mod_time = excluded.mod_time, hash = excluded.hash,
+			width = 0, height = 0, exif = '', taken_at = 0, meta_version = 0, blurhash = '', color = '', edit = ''`,
+		alias, r.Path, parentDir(r.Path), r.Name, r.Size, r.ModTime.UnixNano(), r.Hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PutDir adds a folder and its parents, e.g. when one appears on disk
+func (s *Store) PutDir(alias, dir string, modTime time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ensureDirs(tx, alias, dir, modTime); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Remove deletes a single photo from the index
+func (s *Store) Remove(alias, p string) error {
+	_, err := s.db.Exec("DELETE FROM photos WHERE alias = ? AND path = ? AND is_dir = 0", alias, p)
+	return err
+}
+
+// RemoveTree deletes p whether it is a photo or a folder, along with
+// everything below it. It returns the paths of the removed photos.
+func (s *Store) RemoveTree(alias, p string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const match = `alias = ? AND (path = ? OR path LIKE ? ESCAPE '\')`
+	args := []any{alias, p, escapeLike(p) + "/%"}
+
+	rows, err := tx.Query("SELECT path FROM photos WHERE is_dir = 0 AND "+match, args...)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for rows.Next() {
+		var photo string
+		if err := rows.Scan(&photo); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		removed = append(removed, photo)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM photos WHERE "+match, args...); err != nil {
+		return nil, err
+	}
+	return removed, tx.Commit()
+}
+
+// Move renames a photo within an alias, keeping its computed metadata
+func (s *Store) Move(alias, src, dest string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var modTime int64
+	err = tx.QueryRow("SELECT mod_time FROM photos WHERE alias = ? AND path = ? AND is_dir = 0", alias, src).Scan(&modTime)
+	if err == sql.ErrNoRows {
+		// Not indexed yet, the next scan picks it up
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := ensureDirs(tx, alias, parentDir(dest), time.Unix(0, modTime)); err != nil {
+		return err
+	}
+	// A move onto an existing name replaces it
+	if _, err := tx.Exec("DELETE FROM photos WHERE alias = ? AND path = ? AND is_dir = 0", alias, dest); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE photos SET path = ?, dir = ?, name = ? WHERE alias = ? AND path = ? AND is_dir = 0",
+		dest, parentDir(dest), path.Base(dest), alias, src); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PendingMeta returns photos whose metadata was computed by an older version
+func (s *Store) PendingMeta(alias string, version, limit int) ([]Record, error) {
+	rows, err := s.db.Query("SELECT "+recordColumns+" FROM photos WHERE alias = ? AND is_dir = 0 AND meta_version < ? LIMIT ?",
+		alias, version, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanRecords(rows)
+}
+
+// SetMeta stores the computed metadata of a photo. Unknown dimensions keep
+// those already stored, e.g. by SetPlaceholder.
+func (s *Store) SetMeta(alias, p string, m Meta, version int) error {
+	_, err := s.db.Exec(`UPDATE photos SET hash = ?,
+		width = CASE WHEN ? > 0 THEN ? ELSE width END, height = CASE WHEN ? > 0 THEN ? ELSE height END,
+		exif = ?, taken_at = ?, edit = ?, meta_version = ?
+		WHERE alias = ? AND path = ? AND is_dir = 0`,
+		m.Hash, m.Width, m.Width, m.Height, m.Height, m.Exif, unixNano(m.TakenAt), m.Edit, version, alias, p)
+	return err
+}
+
+// SetEdit stores the edit of a photo. Its size and placeholder are reset,
+// the next thumbnail fills them in for the edited photo.
+func (s *Store) SetEdit(alias, p, edit string) error {
+	_, err := s.db.Exec(`UPDATE photos SET edit = ?, width = 0, height = 0, blurhash = '', color = ''
+		WHERE alias = ? AND path = ? AND is_dir = 0`, edit, alias, p)
+	return err
+}
+
+// SetPlaceholder stores the placeholder of a photo, computed with its
+// thumbnail. Zero dimensions keep those already stored.
+func (s *Store) SetPlaceholder(alias, p, blurHash, color string, width, height int) error {
+	_, err := s.db.Exec(`UPDATE photos SET blurhash = ?, color = ?,
+		width = CASE WHEN ? > 0 THEN ? ELSE width END, height = CASE WHEN ? > 0 THEN ? ELSE height END
+		WHERE alias = ? AND path = ? AND is_dir = 0`,
+		blurHash, color, width, width, height, height, alias, p)
+	return err
+}
+
+// RenameAlias moves every row of an alias to its new name
+func (s *Store) RenameAlias(oldName, newName string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE photos SET alias = ? WHERE alias = ?", newName, oldName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE scans SET alias = ? WHERE alias = ?", newName, oldName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE shares SET alias = ? WHERE alias = ?", newName, oldName); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteAlias drops the whole index of an alias and its shares
+func (s *Store) DeleteAlias(alias string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM photos WHERE alias = ?", alias); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM scans WHERE alias = ?", alias); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM share_views WHERE share_id IN (SELECT id FROM shares WHERE alias = ?)", alias); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM shares WHERE alias = ?", alias); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
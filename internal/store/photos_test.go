@@ -0,0 +1,104 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func putPhoto(t *testing.T, s *Store, name string, size int64, modTime time.Time) {
+	t.Helper()
+	if err := s.Put("a", Record{Path: name, Name: name, Size: size, ModTime: modTime}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listPaths(t *testing.T, s *Store, q Query) ([]string, string) {
+	t.Helper()
+	records, next, err := s.List("a", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, r := range records {
+		paths = append(paths, r.Path)
+	}
+	return paths, next
+}
+
+// Pages continue after the last row seen, whatever was added or removed
+// in between: nothing is repeated or skipped that was there all along.
+func TestListCursorStable(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		sort, order string
+	}{
+		{SortModTime, OrderDesc},
+		{SortModTime, OrderAsc},
+		{SortTaken, OrderDesc},
+		{SortName, OrderAsc},
+		{SortName, OrderDesc},
+		{SortSize, OrderAsc},
+		{SortSize, OrderDesc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sort+"-"+tt.order, func(t *testing.T) {
+			s := openTestStore(t)
+			// Equal times and sizes, so ties are broken by path
+			for i := range 10 {
+				putPhoto(t, s, fmt.Sprintf("p%02d.jpg", i), int64(i%4), base.Add(time.Duration(i%3)*time.Hour))
+			}
+
+			q := Query{Recursive: true, Sort: tt.sort, Order: tt.order, Limit: 3}
+			seen, next := listPaths(t, s, q)
+			if len(seen) != 3 || next == "" {
+				t.Fatalf("first page = %v, next %q", seen, next)
+			}
+			last := seen[len(seen)-1]
+
+			// Rows at both ends of every order, one removed before and one after the cursor
+			putPhoto(t, s, "a_new.jpg", 0, base.Add(-time.Hour))
+			putPhoto(t, s, "z_new.jpg", 99, base.Add(24*time.Hour))
+			if err := s.Remove("a", seen[0]); err != nil {
+				t.Fatal(err)
+			}
+			all, _ := listPaths(t, s, Query{Recursive: true, Sort: tt.sort, Order: tt.order, Limit: 100})
+			rest := all[slices.Index(all, last)+1:]
+			unseen := rest[len(rest)/2]
+			if err := s.Remove("a", unseen); err != nil {
+				t.Fatal(err)
+			}
+			want := append(slices.Clone(seen), slices.DeleteFunc(slices.Clone(rest), func(p string) bool { return p == unseen })...)
+
+			for next != "" {
+				q.Cursor = next
+				var page []string
+				page, next = listPaths(t, s, q)
+				seen = append(seen, page...)
+			}
+			if !slices.Equal(seen, want) {
+				t.Errorf("pages = %v\nwant    %v", seen, want)
+			}
+		})
+	}
+}
+
+func TestListCursorInvalid(t *testing.T) {
+	s := openTestStore(t)
+	if _, _, err := s.List("a", Query{Cursor: "not a cursor", Limit: 10}); err == nil {
+		t.Error("invalid cursor accepted")
+	}
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Session is a login. Its ID is the hash of the random value in the cookie,
+// so the database alone can't be used to log in.
+type Session struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+}
+
+const sessionColumns = "id, username, created_at, last_seen, user_agent, ip"
+
+func scanSession(row interface{ Scan(...any) error }) (Session, error) {
+	var s Session
+	var createdAt, lastSeen int64
+	if err := row.Scan(&s.ID, &s.Username, &createdAt, &lastSeen, &s.UserAgent, &s.IP); err != nil {
+		return s, err
+	}
+	s.CreatedAt = time.Unix(0, createdAt)
+	s.LastSeen = time.Unix(0, lastSeen)
+	return s, nil
+}
+
+// Session looks up a login by its ID
+func (s *Store) Session(id string) (sess Session, ok bool, err error) {
+	sess, err = scanSession(s.db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return sess, false, nil
+	}
+	return sess, err == nil, err
+}
+
+// Sessions returns the logins of a user, the most recently used first
+func (s *Store) Sessions(username string) ([]Session, error) {
+	rows, err := s.db.Query("SELECT "+sessionColumns+" FROM sessions WHERE username = ? ORDER BY last_seen DESC", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// AddSession records a login
+func (s *Store) AddSession(sess Session) error {
+	_, err := s.db.Exec("INSERT INTO sessions ("+sessionColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+		sess.ID, sess.Username, sess.CreatedAt.UnixNano(), sess.LastSeen.UnixNano(), sess.UserAgent, sess.IP)
+	return err
+}
+
+// TouchSession records activity on a login
+func (s *Store) TouchSession(id string, lastSeen time.Time) error {
+	_, err := s.db.Exec("UPDATE sessions SET last_seen = ? WHERE id = ?", lastSeen.UnixNano(), id)
+	return err
+}
+
+// DeleteSession ends a login, sql.ErrNoRows if it does not exist
+func (s *Store) DeleteSession(id string) error {
+	return s.updateOne("DELETE FROM sessions WHERE id = ?", id)
+}
+
+// DeleteSessions ends every login of a user but the one with ID except
+func (s *Store) DeleteSessions(username, except string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE username = ? AND id != ?", username, except)
+	return err
+}
+
+// PruneSessions drops the logins unused since idleSince or created before createdSince
+func (s *Store) PruneSessions(idleSince, createdSince time.Time) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE last_seen < ? OR created_at < ?", idleSince.UnixNano(), createdSince.UnixNano())
+	return err
+}
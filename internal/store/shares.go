@@ -0,0 +1,174 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Kinds of share
+const (
+	ShareKindPhotos = "photos" // The listed photos of an alias
+	ShareKindFolder = "folder" // Everything below a folder of an alias
+	ShareKindAlias  = "alias"  // The whole alias
+)
+
+// Share is a public link to photos of an alias. Its ID is the hash of the
+// token in the link, the link itself is only known to its creator.
+type Share struct {
+	ID            string     `json:"id"`
+	Username      string     `json:"username"` // Who created it
+	Alias         string     `json:"alias"`
+	Dir           string     `json:"dir,omitempty"`
+	Paths         []string   `json:"paths,omitempty"`
+	PasswordHash  string     `json:"-"`
+	ExpiresAt     *time.Time `json:"expires_at"` // nil if it never expires
+	MaxViews      int        `json:"max_views"`  // 0 for no limit
+	Views         int        `json:"views"`
+	AllowDownload bool       `json:"allow_download"`
+	AllowOriginal bool       `json:"allow_original"` // Downloads may be the original files, metadata included
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Kind tells what a share points at
+func (s Share) Kind() string {
+	switch {
+	case len(s.Paths) > 0:
+		return ShareKindPhotos
+	case s.Dir != "":
+		return ShareKindFolder
+	}
+	return ShareKindAlias
+}
+
+// Expired reports whether the share has passed its expiry
+func (s Share) Expired() bool {
+	return s.ExpiresAt != nil && time.Now().After(*s.ExpiresAt)
+}
+
+const shareColumns = "id, username, alias, dir, paths, password_hash, expires_at, max_views, views, allow_download, allow_original, created_at"
+
+func scanShare(row interface{ Scan(...any) error }) (Share, error) {
+	var s Share
+	var paths string
+	var expiresAt, createdAt int64
+	var allowDownload, allowOriginal int
+	err := row.Scan(&s.ID, &s.Username, &s.Alias, &s.Dir, &paths, &s.PasswordHash,
+		&expiresAt, &s.MaxViews, &s.Views, &allowDownload, &allowOriginal, &createdAt)
+	if err != nil {
+		return s, err
+	}
+	if paths != "" {
+		if err := json.Unmarshal([]byte(paths), &s.Paths); err != nil {
+			return s, err
+		}
+	}
+	s.ExpiresAt = optionalTime(expiresAt)
+	s.AllowDownload = allowDownload != 0
+	s.AllowOriginal = allowOriginal != 0
+	s.CreatedAt = time.Unix(0, createdAt)
+	return s, nil
+}
+
+// Share looks up a share by its ID, the hash of its token
+func (s *Store) Share(id string) (sh Share, ok bool, err error) {
+	sh, err = scanShare(s.db.QueryRow("SELECT "+shareColumns+" FROM shares WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return sh, false, nil
+	}
+	return sh, err == nil, err
+}
+
+// Shares returns the shares created by a user, or all of them if username
+// is "", the newest first
+func (s *Store) Shares(username string) ([]Share, error) {
+	rows, err := s.db.Query("SELECT "+shareColumns+" FROM shares WHERE ? = '' OR username = ? ORDER BY created_at DESC", username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []Share
+	for rows.Next() {
+		sh, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, sh)
+	}
+	return shares, rows.Err()
+}
+
+// AddShare records a new share
+func (s *Store) AddShare(sh Share) error {
+	var paths string
+	if len(sh.Paths) > 0 {
+		data, err := json.Marshal(sh.Paths)
+		if err != nil {
+			return err
+		}
+		paths = string(data)
+	}
+	var expiresAt int64
+	if sh.ExpiresAt != nil {
+		expiresAt = sh.ExpiresAt.UnixNano()
+	}
+	_, err := s.db.Exec("INSERT INTO shares ("+shareColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?)",
+		sh.ID, sh.Username, sh.Alias, sh.Dir, paths, sh.PasswordHash,
+		expiresAt, sh.MaxViews, boolInt(sh.AllowDownload), boolInt(sh.AllowOriginal), sh.CreatedAt.UnixNano())
+	return err
+}
+
+// DeleteShare removes a share and its views, sql.ErrNoRows if it does not exist
+func (s *Store) DeleteShare(id string) error {
+	if _, err := s.db.Exec("DELETE FROM share_views WHERE share_id = ?", id); err != nil {
+		return err
+	}
+	return s.updateOne("DELETE FROM shares WHERE id = ?", id)
+}
+
+// DeleteShares removes every share created by a user
+func (s *Store) DeleteShares(username string) error {
+	if _, err := s.db.Exec("DELETE FROM share_views WHERE share_id IN (SELECT id FROM shares WHERE username = ?)", username); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM shares WHERE username = ?", username)
+	return err
+}
+
+// AddShareView counts a view of a share and records the grant hashed as id
+// that lets the viewer load its photos until expires. It reports false
+// without counting if the share has no views left.
+func (s *Store) AddShareView(shareID, id string, expires time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE shares SET views = views + 1 WHERE id = ? AND (max_views = 0 OR views < max_views)", shareID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec("INSERT INTO share_views (id, share_id, expires_at) VALUES (?, ?, ?)", id, shareID, expires.UnixNano()); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ShareView reports whether the grant hashed as id lets its holder into a share
+func (s *Store) ShareView(shareID, id string) (bool, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM share_views WHERE id = ? AND share_id = ? AND expires_at > ?",
+		id, shareID, time.Now().UnixNano()).Scan(&n)
+	return n > 0, err
+}
+
+// PruneShareViews drops the grants that have expired
+func (s *Store) PruneShareViews() error {
+	_, err := s.db.Exec("DELETE FROM share_views WHERE expires_at <= ?", time.Now().UnixNano())
+	return err
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite"
+)
+
+// Store is the persistent SQLite index shared by all aliases
+type Store struct {
+	db *sql.DB
+}
+
+// migrations are applied in order, PRAGMA user_version tracks how many ran
+var migrations = []string{
+	`CREATE TABLE photos (
+		alias        TEXT    NOT NULL,
+		path         TEXT    NOT NULL,
+		dir          TEXT    NOT NULL,
+		name         TEXT    NOT NULL,
+		is_dir       INTEGER NOT NULL DEFAULT 0,
+		size         INTEGER NOT NULL DEFAULT 0,
+		mod_time     INTEGER NOT NULL DEFAULT 0,
+		hash         TEXT    NOT NULL DEFAULT '',
+		width        INTEGER NOT NULL DEFAULT 0,
+		height       INTEGER NOT NULL DEFAULT 0,
+		exif         TEXT    NOT NULL DEFAULT '',
+		meta_version INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (alias, path, is_dir)
+	);
+	CREATE INDEX photos_dir ON photos (alias, dir, is_dir);
+	CREATE INDEX photos_mod_time ON photos (alias, is_dir, mod_time DESC, path);
+	CREATE TABLE scans (
+		alias      TEXT    PRIMARY KEY,
+		scanned_at INTEGER NOT NULL
+	);`,
+	`ALTER TABLE photos ADD COLUMN taken_at INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX photos_taken ON photos (alias, is_dir, (CASE WHEN taken_at > 0 THEN taken_at ELSE mod_time END) DESC, path);`,
+	`CREATE INDEX photos_name ON photos (alias, is_dir, name COLLATE NOCASE, path);
+	CREATE INDEX photos_size ON photos (alias, is_dir, size, path);`,
+	`ALTER TABLE photos ADD COLUMN blurhash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE photos ADD COLUMN color TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE photos ADD COLUMN edit TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE users (
+		username      TEXT    PRIMARY KEY COLLATE NOCASE,
+		password_hash TEXT    NOT NULL,
+		role          TEXT    NOT NULL,
+		created_at    INTEGER NOT NULL
+	);`,
+	`ALTER TABLE users ADD COLUMN user_groups TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE sessions (
+		id         TEXT    PRIMARY KEY,
+		username   TEXT    NOT NULL COLLATE NOCASE,
+		created_at INTEGER NOT NULL,
+		last_seen  INTEGER NOT NULL,
+		user_agent TEXT    NOT NULL,
+		ip         TEXT    NOT NULL
+	);
+	CREATE INDEX sessions_username ON sessions (username);`,
+	`CREATE TABLE tokens (
+		id         TEXT    PRIMARY KEY,
+		hash       TEXT    NOT NULL UNIQUE,
+		username   TEXT    NOT NULL COLLATE NOCASE,
+		name       TEXT    NOT NULL,
+		scopes     TEXT    NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		last_used  INTEGER NOT NULL
+	);
+	CREATE INDEX tokens_username ON tokens (username);`,
+	`CREATE TABLE shares (
+		id             TEXT    PRIMARY KEY,
+		username       TEXT    NOT NULL COLLATE NOCASE,
+		alias          TEXT    NOT NULL,
+		dir            TEXT    NOT NULL,
+		paths          TEXT    NOT NULL,
+		password_hash  TEXT    NOT NULL,
+		expires_at     INTEGER NOT NULL,
+		max_views      INTEGER NOT NULL,
+		views          INTEGER NOT NULL,
+		allow_download INTEGER NOT NULL,
+		created_at     INTEGER NOT NULL
+	);
+	CREATE INDEX shares_username ON shares (username);
+	CREATE TABLE share_views (
+		id         TEXT    PRIMARY KEY,
+		share_id   TEXT    NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX share_views_share ON share_views (share_id);`,
+	`ALTER TABLE shares ADD COLUMN allow_original INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// Open opens (or creates) the index database at path and migrates it
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *Store) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
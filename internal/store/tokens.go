@@ -0,0 +1,101 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Token is a personal API token. Only the hash of its secret is stored, the
+// secret is shown once when the token is created.
+type Token struct {
+	ID        string     `json:"id"`
+	Hash      string     `json:"-"`
+	Username  string     `json:"username"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"` // nil if it never expires
+	LastUsed  *time.Time `json:"last_used"`  // nil if it was never used
+}
+
+const tokenColumns = "id, hash, username, name, scopes, created_at, expires_at, last_used"
+
+func scanToken(row interface{ Scan(...any) error }) (Token, error) {
+	var t Token
+	var scopes string
+	var createdAt, expiresAt, lastUsed int64
+	if err := row.Scan(&t.ID, &t.Hash, &t.Username, &t.Name, &scopes, &createdAt, &expiresAt, &lastUsed); err != nil {
+		return t, err
+	}
+	t.Scopes = splitList(scopes)
+	t.CreatedAt = time.Unix(0, createdAt)
+	t.ExpiresAt = optionalTime(expiresAt)
+	t.LastUsed = optionalTime(lastUsed)
+	return t, nil
+}
+
+// optionalTime decodes a timestamp column where 0 means none
+func optionalTime(ns int64) *time.Time {
+	if ns == 0 {
+		return nil
+	}
+	t := time.Unix(0, ns)
+	return &t
+}
+
+// TokenByHash looks up a token by the hash of its secret
+func (s *Store) TokenByHash(hash string) (t Token, ok bool, err error) {
+	t, err = scanToken(s.db.QueryRow("SELECT "+tokenColumns+" FROM tokens WHERE hash = ?", hash))
+	if err == sql.ErrNoRows {
+		return t, false, nil
+	}
+	return t, err == nil, err
+}
+
+// Tokens returns the tokens of a user, the newest first
+func (s *Store) Tokens(username string) ([]Token, error) {
+	rows, err := s.db.Query("SELECT "+tokenColumns+" FROM tokens WHERE username = ? ORDER BY created_at DESC", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// AddToken records a new token
+func (s *Store) AddToken(t Token) error {
+	var expiresAt int64
+	if t.ExpiresAt != nil {
+		expiresAt = t.ExpiresAt.UnixNano()
+	}
+	_, err := s.db.Exec("INSERT INTO tokens ("+tokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, 0)",
+		t.ID, t.Hash, t.Username, t.Name, strings.Join(t.Scopes, ","), t.CreatedAt.UnixNano(), expiresAt)
+	return err
+}
+
+// TouchToken records a use of a token
+func (s *Store) TouchToken(id string, lastUsed time.Time) error {
+	_, err := s.db.Exec("UPDATE tokens SET last_used = ? WHERE id = ?", lastUsed.UnixNano(), id)
+	return err
+}
+
+// DeleteToken revokes a token of a user, sql.ErrNoRows if the user has no such token
+func (s *Store) DeleteToken(username, id string) error {
+	return s.updateOne("DELETE FROM tokens WHERE id = ? AND username = ?", id, username)
+}
+
+// DeleteTokens revokes every token of a user
+func (s *Store) DeleteTokens(username string) error {
+	_, err := s.db.Exec("DELETE FROM tokens WHERE username = ?", username)
+	return err
+}
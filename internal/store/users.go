@@ -0,0 +1,122 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrUserExists is returned by AddUser when the name is taken
+var ErrUserExists = errors.New("user already exists")
+
+// User is an account allowed to log in
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	Role         string    `json:"role"`
+	Groups       []string  `json:"groups"` // Named by alias access rules
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const userColumns = "username, password_hash, role, user_groups, created_at"
+
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var u User
+	var groups string
+	var createdAt int64
+	if err := row.Scan(&u.Username, &u.PasswordHash, &u.Role, &groups, &createdAt); err != nil {
+		return u, err
+	}
+	u.Groups = splitList(groups)
+	u.CreatedAt = time.Unix(0, createdAt)
+	return u, nil
+}
+
+// splitList decodes a comma separated column
+func splitList(s string) []string {
+	groups := []string{}
+	for _, g := range strings.Split(s, ",") {
+		if g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// Users returns every account ordered by name
+func (s *Store) Users() ([]User, error) {
+	rows, err := s.db.Query("SELECT " + userColumns + " FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// User looks up an account, names are case-insensitive
+func (s *Store) User(username string) (u User, ok bool, err error) {
+	u, err = scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return u, false, nil
+	}
+	return u, err == nil, err
+}
+
+// CountUsers returns the number of accounts with role, or of all accounts if role is ""
+func (s *Store) CountUsers(role string) (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE ? = '' OR role = ?", role, role).Scan(&n)
+	return n, err
+}
+
+// AddUser creates an account
+func (s *Store) AddUser(u User) error {
+	_, err := s.db.Exec("INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?, ?)",
+		u.Username, u.PasswordHash, u.Role, strings.Join(u.Groups, ","), time.Now().UnixNano())
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrUserExists
+	}
+	return err
+}
+
+// SetPassword replaces the password hash of an account
+func (s *Store) SetPassword(username, hash string) error {
+	return s.updateOne("UPDATE users SET password_hash = ? WHERE username = ?", hash, username)
+}
+
+// SetRole changes the role of an account
+func (s *Store) SetRole(username, role string) error {
+	return s.updateOne("UPDATE users SET role = ? WHERE username = ?", role, username)
+}
+
+// SetGroups replaces the groups of an account. Group names must not contain commas.
+func (s *Store) SetGroups(username string, groups []string) error {
+	return s.updateOne("UPDATE users SET user_groups = ? WHERE username = ?", strings.Join(groups, ","), username)
+}
+
+// DeleteUser removes an account
+func (s *Store) DeleteUser(username string) error {
+	return s.updateOne("DELETE FROM users WHERE username = ?", username)
+}
+
+// updateOne runs a statement on one row, sql.ErrNoRows if it does not exist
+func (s *Store) updateOne(query string, args ...any) error {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package thumb
+
+import (
+	"container/list"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache limits, see ConfigureCache. Zero means unlimited.
+var (
+	CacheDir      = "./cache/thumbnails"
+	CacheMaxBytes int64
+	CacheMaxAge   time.Duration
+)
+
+// tempPrefix marks thumbnails being written
+const tempPrefix = ".tmp-"
+
+// touchInterval limits how often a hit updates the file time on disk, which
+// carries the access order over restarts
+const touchInterval = time.Hour
+
+// cacheEntry is one thumbnail file
+type cacheEntry struct {
+	path    string
+	size    int64
+	used    time.Time // Last access
+	touched time.Time // Last time used was written to disk
+}
+
+// lru tracks the cached files from most to least recently used
+type lru struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	bytes   int64
+
+	hits      int64
+	misses    int64
+	evictions int64
+	generated int64
+	fetched   int64 // From the shared cache
+	genTime   time.Duration
+	genMax    time.Duration
+}
+
+var cache = &lru{order: list.New(), entries: make(map[string]*list.Element)}
+
+// CacheStats describes the thumbnail cache
+type CacheStats struct {
+	Dir       string  `json:"dir"`
+	Entries   int     `json:"entries"`
+	Bytes     int64   `json:"bytes"`
+	MaxBytes  int64   `json:"max_bytes"`
+	MaxAge    int64   `json:"max_age_seconds"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRate   float64 `json:"hit_rate"`
+	Evictions int64   `json:"evictions"`
+	Generated int64   `json:"generated"`
+	Fetched   int64   `json:"fetched"`
+	AvgGenMs  float64 `json:"avg_generation_ms"`
+	MaxGenMs  float64 `json:"max_generation_ms"`
+}
+
+// ConfigureCache sets where thumbnails are cached and how much of them is
+// kept, then loads what is already on disk
+func ConfigureCache(dir string, maxBytes int64, maxAge time.Duration) error {
+	if dir != "" {
+		CacheDir = dir
+	}
+	CacheMaxBytes = maxBytes
+	CacheMaxAge = maxAge
+
+	if err := os.MkdirAll(CacheDir, 0755); err != nil {
+		return err
+	}
+	return cache.load()
+}
+
+// load indexes the files in CacheDir, ordered by their file time
+func (c *lru) load() error {
+	var found []*cacheEntry
+	err := filepath.WalkDir(CacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			// Left behind by a crash
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		found = append(found, &cacheEntry{path: path, size: info.Size(), used: info.ModTime(), touched: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.bytes = 0
+	slices.SortFunc(found, func(a, b *cacheEntry) int { return a.used.Compare(b.used) })
+	for _, e := range found {
+		c.insert(e)
+	}
+	return nil
+}
+
+// insert adds e as the most recently used entry. Callers hold c.mu.
+func (c *lru) insert(e *cacheEntry) {
+	if old, ok := c.entries[e.path]; ok {
+		c.bytes -= old.Value.(*cacheEntry).size
+		c.order.Remove(old)
+	}
+	c.entries[e.path] = c.order.PushFront(e)
+	c.bytes += e.size
+}
+
+// hit records a cache hit on path
+func (c *lru) hit(path string) {
+	c.mu.Lock()
+	c.hits++
+	el, ok := c.entries[path]
+	if !ok {
+		c.mu.Unlock()
+		// Written by someone else, e.g. before the cache was loaded
+		if info, err := os.Stat(path); err == nil {
+			c.mu.Lock()
+			c.insert(&cacheEntry{path: path, size: info.Size(), used: time.Now(), touched: info.ModTime()})
+			c.mu.Unlock()
+		}
+		return
+	}
+
+	e := el.Value.(*cacheEntry)
+	now := time.Now()
+	e.used = now
+	c.order.MoveToFront(el)
+	touch := now.Sub(e.touched) > touchInterval
+	if touch {
+		e.touched = now
+	}
+	c.mu.Unlock()
+
+	if touch {
+		os.Chtimes(path, now, now)
+	}
+}
+
+func (c *lru) miss() {
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+}
+
+// added records a newly generated thumbnail and makes room for it
+func (c *lru) added(path string, took time.Duration) {
+	c.store(path, func() {
+		c.generated++
+		c.genTime += took
+		c.genMax = max(c.genMax, took)
+	})
+}
+
+// copied records a thumbnail fetched from the shared cache
+func (c *lru) copied(path string) {
+	c.store(path, func() { c.fetched++ })
+}
+
+// store indexes a new file, count updates the stats under c.mu
+func (c *lru) store(path string, count func()) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	c.insert(&cacheEntry{path: path, size: info.Size(), used: now, touched: now})
+	count()
+	victims := c.trim(path)
+	c.mu.Unlock()
+
+	removeFiles(victims)
+}
+
+// trim drops the least recently used entries until the cache fits
+// CacheMaxBytes and holds nothing older than CacheMaxAge. keep is never
+// dropped. It returns the files to remove. Callers hold c.mu.
+func (c *lru) trim(keep string) []string {
+	var victims []string
+	for el := c.order.Back(); el != nil; {
+		e := el.Value.(*cacheEntry)
+		prev := el.Prev()
+
+		tooBig := CacheMaxBytes > 0 && c.bytes > CacheMaxBytes
+		tooOld := CacheMaxAge > 0 && time.Since(e.used) > CacheMaxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		if e.path != keep {
+			c.order.Remove(el)
+			delete(c.entries, e.path)
+			c.bytes -= e.size
+			c.evictions++
+			victims = append(victims, e.path)
+		}
+		el = prev
+	}
+	return victims
+}
+
+// forget drops the entries of removed files, prefix matches whole folders
+func (c *lru) forget(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path, el := range c.entries {
+		if strings.HasPrefix(path, prefix) {
+			c.bytes -= el.Value.(*cacheEntry).size
+			c.order.Remove(el)
+			delete(c.entries, path)
+		}
+	}
+}
+
+func removeFiles(paths []string) {
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to evict thumbnail %s: %v", p, err)
+		}
+	}
+}
+
+// Stats returns the current state of the cache
+func Stats() CacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	s := CacheStats{
+		Dir:       CacheDir,
+		Entries:   len(cache.entries),
+		Bytes:     cache.bytes,
+		MaxBytes:  CacheMaxBytes,
+		MaxAge:    int64(CacheMaxAge.Seconds()),
+		Hits:      cache.hits,
+		Misses:    cache.misses,
+		Evictions: cache.evictions,
+		Generated: cache.generated,
+		Fetched:   cache.fetched,
+		MaxGenMs:  float64(cache.genMax.Microseconds()) / 1000,
+	}
+	if total := cache.hits + cache.misses; total > 0 {
+		s.HitRate = float64(cache.hits) / float64(total)
+	}
+	if cache.generated > 0 {
+		s.AvgGenMs = float64(cache.genTime.Microseconds()) / 1000 / float64(cache.generated)
+	}
+	return s
+}
+
+// JanitorLoop enforces the cache limits every interval, it never returns.
+// Generating a thumbnail already keeps the size in check, this catches the
+// age limit on an idle server.
+func JanitorLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		cache.mu.Lock()
+		victims := cache.trim("")
+		cache.mu.Unlock()
+
+		removeFiles(victims)
+		if len(victims) > 0 {
+			log.Printf("Evicted %d thumbnails from cache", len(victims))
+		}
+	}
+}
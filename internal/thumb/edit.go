@@ -0,0 +1,187 @@
+package thumb
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Edit is a non-destructive adjustment of a photo. It applies on top of the
+// EXIF orientation, in field order: rotate, flip, crop, then the tone.
+type Edit struct {
+	Rotate     int     `json:"rotate,omitempty"` // Clockwise degrees, a multiple of 90
+	FlipH      bool    `json:"flip_h,omitempty"` // Mirror left to right
+	FlipV      bool    `json:"flip_v,omitempty"` // Mirror top to bottom
+	Crop       *Crop   `json:"crop,omitempty"`
+	Exposure   float64 `json:"exposure,omitempty"`   // Stops, -5 to 5
+	Contrast   float64 `json:"contrast,omitempty"`   // Percent, -100 to 100
+	Saturation float64 `json:"saturation,omitempty"` // Percent, -100 to 100
+}
+
+// Crop is a rectangle in fractions of the rotated and flipped image, so it
+// does not depend on the resolution
+type Crop struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// minCropSize is the smallest width and height of a crop, in fractions of the image
+const minCropSize = 0.01
+
+// IsZero reports whether e leaves the photo unchanged
+func (e Edit) IsZero() bool {
+	return e.normalized() == Edit{}
+}
+
+// normalized folds equivalent edits together, e.g. a rotation by 360 or a
+// crop of the whole image
+func (e Edit) normalized() Edit {
+	e.Rotate = (e.Rotate%360 + 360) % 360
+	if e.Crop != nil && *e.Crop == (Crop{0, 0, 1, 1}) {
+		e.Crop = nil
+	}
+	return e
+}
+
+// Validate checks that every field is in range
+func (e Edit) Validate() error {
+	if e.Rotate%90 != 0 {
+		return fmt.Errorf("rotate must be a multiple of 90, got %d", e.Rotate)
+	}
+	if c := e.Crop; c != nil {
+		if c.X < 0 || c.Y < 0 || c.Width <= 0 || c.Height <= 0 || c.X+c.Width > 1 || c.Y+c.Height > 1 {
+			return fmt.Errorf("crop must lie within the image, in fractions of 0 to 1")
+		}
+		if c.Width < minCropSize || c.Height < minCropSize {
+			return fmt.Errorf("crop must be at least %g of the image wide and high", minCropSize)
+		}
+	}
+	if math.Abs(e.Exposure) > 5 {
+		return fmt.Errorf("exposure must be between -5 and 5, got %g", e.Exposure)
+	}
+	if math.Abs(e.Contrast) > 100 || math.Abs(e.Saturation) > 100 {
+		return fmt.Errorf("contrast and saturation must be between -100 and 100")
+	}
+	return nil
+}
+
+// String returns the canonical form of e, "" if it changes nothing. It
+// versions the thumbnails of edited photos.
+func (e Edit) String() string {
+	if e.IsZero() {
+		return ""
+	}
+	data, _ := json.Marshal(e.normalized())
+	return string(data)
+}
+
+// ParseEdit decodes an edit stored with String, "" is no edit
+func ParseEdit(s string) (Edit, error) {
+	var e Edit
+	if s == "" {
+		return e, nil
+	}
+	err := json.Unmarshal([]byte(s), &e)
+	return e, err
+}
+
+// Size returns the size of a width x height image after e
+func (e Edit) Size(width, height int) (int, int) {
+	e = e.normalized()
+	if e.Rotate == 90 || e.Rotate == 270 {
+		width, height = height, width
+	}
+	if c := e.Crop; c != nil {
+		_, width = c.span(c.X, c.Width, width)
+		_, height = c.span(c.Y, c.Height, height)
+	}
+	return width, height
+}
+
+// span returns the first pixel and the length of a crop along a side of
+// size pixels, at least one pixel and within the side
+func (c Crop) span(start, length float64, size int) (int, int) {
+	n := min(size, max(1, int(math.Round(length*float64(size)))))
+	first := min(size-n, int(math.Round(start*float64(size))))
+	return first, n
+}
+
+// Apply renders e on an upright image
+func (e Edit) Apply(img image.Image) image.Image {
+	e = e.normalized()
+	if e == (Edit{}) {
+		return img
+	}
+
+	switch e.Rotate {
+	case 90:
+		img = imaging.Rotate270(img) // imaging turns counter-clockwise
+	case 180:
+		img = imaging.Rotate180(img)
+	case 270:
+		img = imaging.Rotate90(img)
+	}
+	if e.FlipH {
+		img = imaging.FlipH(img)
+	}
+	if e.FlipV {
+		img = imaging.FlipV(img)
+	}
+
+	// The same pixels as Size, so the size in the index matches the rendering
+	if c := e.Crop; c != nil {
+		b := img.Bounds()
+		x, w := c.span(c.X, c.Width, b.Dx())
+		y, h := c.span(c.Y, c.Height, b.Dy())
+		img = imaging.Crop(img, image.Rect(x, y, x+w, y+h).Add(b.Min))
+	}
+
+	if e.Exposure != 0 {
+		img = exposure(img, e.Exposure)
+	}
+	if e.Contrast != 0 {
+		img = imaging.AdjustContrast(img, e.Contrast)
+	}
+	if e.Saturation != 0 {
+		img = imaging.AdjustSaturation(img, e.Saturation)
+	}
+	return img
+}
+
+// Bake writes the photo read from open with the edit of key applied, at full
+// size. Nothing is cached, the result usually becomes a new photo.
+func Bake(key Key, format Format, quality int, open func() (io.ReadCloser, error), w io.Writer) error {
+	return work(func() error {
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		src, err := imaging.Decode(r, imaging.AutoOrientation(true))
+		r.Close()
+		if err != nil {
+			return err
+		}
+		return encode(w, key.Edit.Apply(src), format, quality)
+	})
+}
+
+// exposure scales the light of img by 2^stops, in linear light so the
+// midtones move like a camera exposure would
+func exposure(img image.Image, stops float64) *image.NRGBA {
+	gain := math.Pow(2, stops)
+	var lut [256]uint8
+	for i := range lut {
+		linear := math.Pow(float64(i)/255, 2.2) * gain
+		lut[i] = uint8(math.Round(math.Min(1, math.Pow(linear, 1/2.2)) * 255))
+	}
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{lut[c.R], lut[c.G], lut[c.B], c.A}
+	})
+}
@@ -0,0 +1,184 @@
+package thumb
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+)
+
+func TestEditValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		edit Edit
+		ok   bool
+	}{
+		{"none", Edit{}, true},
+		{"everything", Edit{Rotate: -90, FlipH: true, Crop: &Crop{0.1, 0.2, 0.5, 0.8}, Exposure: -5, Contrast: 100, Saturation: -100}, true},
+		{"rotate not by quarters", Edit{Rotate: 45}, false},
+		{"crop past the edge", Edit{Crop: &Crop{0.5, 0, 0.6, 1}}, false},
+		{"crop before the edge", Edit{Crop: &Crop{-0.1, 0, 0.5, 0.5}}, false},
+		{"empty crop", Edit{Crop: &Crop{0, 0, 0, 1}}, false},
+		{"tiny crop", Edit{Crop: &Crop{0.5, 0.5, 0.001, 0.5}}, false},
+		{"smallest crop", Edit{Crop: &Crop{0.5, 0.5, minCropSize, minCropSize}}, true},
+		{"exposure", Edit{Exposure: 5.5}, false},
+		{"contrast", Edit{Contrast: -101}, false},
+		{"saturation", Edit{Saturation: 101}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.edit.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// Equivalent edits share one form, so they share thumbnails
+func TestEditString(t *testing.T) {
+	tests := []struct {
+		a, b Edit
+	}{
+		{Edit{Rotate: 360}, Edit{}},
+		{Edit{Crop: &Crop{0, 0, 1, 1}}, Edit{}},
+		{Edit{Rotate: -90}, Edit{Rotate: 270}},
+		{Edit{Rotate: 450, Exposure: 1}, Edit{Rotate: 90, Exposure: 1}},
+	}
+	for _, tt := range tests {
+		if tt.a.String() != tt.b.String() {
+			t.Errorf("%+v is %q, %+v is %q", tt.a, tt.a.String(), tt.b, tt.b.String())
+		}
+	}
+	if s := (Edit{Rotate: 360}).String(); s != "" {
+		t.Errorf("no-op edit is %q, want empty", s)
+	}
+
+	e := Edit{Rotate: 90, FlipV: true, Crop: &Crop{0.25, 0, 0.5, 1}, Contrast: 20}
+	parsed, err := ParseEdit(e.String())
+	if err != nil || parsed.String() != e.String() {
+		t.Errorf("ParseEdit(%q) = %+v, %v", e.String(), parsed, err)
+	}
+	if parsed, err := ParseEdit(""); err != nil || !parsed.IsZero() {
+		t.Errorf("ParseEdit(\"\") = %+v, %v", parsed, err)
+	}
+}
+
+// corners returns a 4x2 image with distinct top left and bottom right pixels
+func corners() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	img.Set(0, 0, color.NRGBA{R: 0xFF, A: 0xFF})
+	img.Set(3, 1, color.NRGBA{B: 0xFF, A: 0xFF})
+	return img
+}
+
+func TestEditApply(t *testing.T) {
+	red := color.NRGBA{R: 0xFF, A: 0xFF}
+	blue := color.NRGBA{B: 0xFF, A: 0xFF}
+
+	tests := []struct {
+		name          string
+		edit          Edit
+		width, height int
+		red, blue     image.Point
+	}{
+		{"none", Edit{}, 4, 2, image.Pt(0, 0), image.Pt(3, 1)},
+		{"clockwise", Edit{Rotate: 90}, 2, 4, image.Pt(1, 0), image.Pt(0, 3)},
+		{"half turn", Edit{Rotate: 180}, 4, 2, image.Pt(3, 1), image.Pt(0, 0)},
+		{"counter-clockwise", Edit{Rotate: -90}, 2, 4, image.Pt(0, 3), image.Pt(1, 0)},
+		{"mirrored", Edit{FlipH: true}, 4, 2, image.Pt(3, 0), image.Pt(0, 1)},
+		{"upside down", Edit{FlipV: true}, 4, 2, image.Pt(0, 1), image.Pt(3, 0)},
+		{"turned then mirrored", Edit{Rotate: 90, FlipH: true}, 2, 4, image.Pt(0, 0), image.Pt(1, 3)},
+		{"cropped", Edit{Crop: &Crop{0.5, 0.5, 0.5, 0.5}}, 2, 1, image.Pt(-1, -1), image.Pt(1, 0)},
+		{"turned then cropped", Edit{Rotate: 90, Crop: &Crop{0, 0.5, 1, 0.5}}, 2, 2, image.Pt(-1, -1), image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := tt.edit.Apply(corners())
+			b := img.Bounds()
+			if b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Fatalf("size %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+			if w, h := tt.edit.Size(4, 2); w != tt.width || h != tt.height {
+				t.Errorf("Size = %dx%d, want %dx%d", w, h, tt.width, tt.height)
+			}
+			for want, at := range map[color.NRGBA]image.Point{red: tt.red, blue: tt.blue} {
+				if at.X < 0 {
+					continue // Cropped away
+				}
+				if got := color.NRGBAModel.Convert(img.At(b.Min.X+at.X, b.Min.Y+at.Y)); got != want {
+					t.Errorf("pixel %v = %v, want %v", at, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Crops that don't fall on whole pixels render at the size the index reports
+func TestEditCropSize(t *testing.T) {
+	tests := []Crop{
+		{0.333, 0.333, 0.334, 0.334},
+		{0.05, 0.95, 0.95, 0.05},
+		{0.995, 0, minCropSize - 0.005, 1},
+		{0, 0, minCropSize, minCropSize},
+		{0.12345, 0.6789, 0.5, 0.3},
+	}
+	for _, c := range tests {
+		for _, size := range []image.Point{{10, 10}, {7, 3}, {1, 1}, {333, 101}} {
+			e := Edit{Crop: &c}
+			b := e.Apply(image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))).Bounds()
+			if w, h := e.Size(size.X, size.Y); w != b.Dx() || h != b.Dy() || w < 1 || h < 1 {
+				t.Errorf("crop %+v of %v: Size %dx%d, rendered %v", c, size, w, h, b.Size())
+			}
+		}
+	}
+}
+
+func TestEditTone(t *testing.T) {
+	gray := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	gray.Set(0, 0, color.NRGBA{0x80, 0x80, 0x80, 0xFF})
+	level := func(e Edit) uint8 {
+		return color.NRGBAModel.Convert(e.Apply(gray).At(0, 0)).(color.NRGBA).R
+	}
+
+	if l := level(Edit{Exposure: 1}); l <= 0x80 {
+		t.Errorf("one stop up is %#x, want brighter than 0x80", l)
+	}
+	if l := level(Edit{Exposure: -1}); l >= 0x80 {
+		t.Errorf("one stop down is %#x, want darker than 0x80", l)
+	}
+	if l := level(Edit{Exposure: 5}); l != 0xFF {
+		t.Errorf("five stops up is %#x, want clipped to white", l)
+	}
+	if img := (Edit{}).Apply(gray); img != image.Image(gray) {
+		t.Error("no edit copied the image")
+	}
+}
+
+func TestBake(t *testing.T) {
+	var src bytes.Buffer
+	if err := png.Encode(&src, corners()); err != nil {
+		t.Fatal(err)
+	}
+	open := func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(src.Bytes())), nil }
+	key := Key{Alias: "a", Path: "p.png", Edit: Edit{Rotate: 90, Crop: &Crop{0, 0, 1, 0.5}}}
+
+	var out bytes.Buffer
+	if err := Bake(key, PNG, Quality, open, &out); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+		t.Errorf("baked %v, want 2x2", b.Size())
+	}
+	if got := color.NRGBAModel.Convert(img.At(1, 0)); got != (color.NRGBA{R: 0xFF, A: 0xFF}) {
+		t.Errorf("top right pixel = %v, want the red corner", got)
+	}
+}
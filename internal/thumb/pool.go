@@ -0,0 +1,66 @@
+package thumb
+
+import (
+	"runtime"
+	"sync"
+)
+
+// workers bounds how many thumbnails are decoded and encoded at once.
+// Every slot can hold a full resolution image in memory.
+var workers = make(chan struct{}, runtime.NumCPU())
+
+// SetWorkers sets the generation concurrency, n <= 0 uses the number of CPUs.
+// It must be called before any thumbnail is generated.
+func SetWorkers(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	workers = make(chan struct{}, n)
+}
+
+// flight is a generation in progress that later requests for the same file wait on
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	flightsMu sync.Mutex
+	flights   = make(map[string]*flight)
+)
+
+// once runs fn for key unless a run for it is already in progress, in which
+// case it waits for that run and returns its error. leader reports whether
+// this call ran fn.
+func once(key string, fn func() error) (leader bool, err error) {
+	flightsMu.Lock()
+	if f, ok := flights[key]; ok {
+		flightsMu.Unlock()
+		<-f.done
+		return false, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	flights[key] = f
+	flightsMu.Unlock()
+
+	f.err = fn()
+
+	flightsMu.Lock()
+	delete(flights, key)
+	flightsMu.Unlock()
+	close(f.done)
+
+	return true, f.err
+}
+
+// Idle reports whether no thumbnail is being generated right now
+func Idle() bool {
+	return len(workers) == 0
+}
+
+// work runs fn in one of the worker slots, waiting for a free one
+func work(fn func() error) error {
+	workers <- struct{}{}
+	defer func() { <-workers }()
+	return fn()
+}
@@ -0,0 +1,191 @@
+package thumb
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCache points the cache to a new directory for the test
+func testCache(t *testing.T) {
+	dir := CacheDir
+	CacheDir = t.TempDir()
+	t.Cleanup(func() { CacheDir = dir })
+}
+
+// pngOpener returns an open func of a small PNG that counts its calls
+func pngOpener(t *testing.T, calls *atomic.Int32) func() (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 6))); err != nil {
+		t.Fatal(err)
+	}
+	return func() (io.ReadCloser, error) {
+		calls.Add(1)
+		time.Sleep(10 * time.Millisecond) // Long enough for every request to join
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+}
+
+// Concurrent requests for a thumbnail decode the photo once
+func TestGenerateOnce(t *testing.T) {
+	testCache(t)
+	SetWorkers(8) // Enough for every request to decode at once
+	t.Cleanup(func() { SetWorkers(0) })
+	var calls atomic.Int32
+	open := pngOpener(t, &calls)
+	key := Key{Alias: "a", Path: "p.png", Version: "1"}
+
+	var wg sync.WaitGroup
+	paths := make([]string, 8)
+	for i := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, _, err := Generate(key, Options{Size: 200, Format: JPEG}, open)
+			if err != nil {
+				t.Error(err)
+			}
+			paths[i] = path
+		}()
+	}
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("photo opened %d times, want once", n)
+	}
+	for _, path := range paths {
+		if path == "" || path != paths[0] {
+			t.Errorf("thumbnail paths %v differ", paths)
+			break
+		}
+	}
+
+	// Another variant is another generation
+	if _, _, err := Generate(key, Options{Size: 400, Format: JPEG}, open); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("photo opened %d times for two variants, want twice", n)
+	}
+}
+
+// A failed generation fails every request waiting on it, and is retried by the next one
+func TestGenerateError(t *testing.T) {
+	testCache(t)
+	failure := errors.New("unreadable")
+	var calls atomic.Int32
+	open := func() (io.ReadCloser, error) {
+		calls.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return nil, failure
+	}
+	key := Key{Alias: "a", Path: "p.png", Version: "1"}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := Generate(key, Options{}, open); !errors.Is(err, failure) {
+				t.Errorf("Generate error = %v, want %v", err, failure)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("photo opened %d times, want once", n)
+	}
+
+	if _, _, err := Generate(key, Options{}, open); !errors.Is(err, failure) || calls.Load() != 2 {
+		t.Errorf("retry error = %v after %d opens", err, calls.Load())
+	}
+}
+
+func TestOnceLeader(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var leaders atomic.Int32
+
+	var wg sync.WaitGroup
+	run := func() {
+		defer wg.Done()
+		leader, err := once("k", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		if leader {
+			leaders.Add(1)
+		}
+	}
+	wg.Add(1)
+	go run()
+	<-started
+	for range 3 {
+		wg.Add(1)
+		go run()
+	}
+	time.Sleep(10 * time.Millisecond) // Let the followers wait on the leader
+	close(release)
+	wg.Wait()
+
+	if n := leaders.Load(); n != 1 {
+		t.Errorf("%d leaders, want 1", n)
+	}
+	if len(flights) != 0 {
+		t.Errorf("flights left behind: %v", flights)
+	}
+}
+
+// No more than the configured number of generations run at once
+func TestWorkers(t *testing.T) {
+	SetWorkers(2)
+	t.Cleanup(func() { SetWorkers(0) })
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	running, peak := 0, 0
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work(func() error {
+				mu.Lock()
+				running++
+				peak = max(peak, running)
+				mu.Unlock()
+				<-release
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			})
+		}()
+	}
+	for {
+		mu.Lock()
+		n := running
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // Give a third one the chance to start
+	close(release)
+	wg.Wait()
+
+	if peak != 2 {
+		t.Errorf("%d generations at once, want 2", peak)
+	}
+}
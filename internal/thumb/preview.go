@@ -0,0 +1,58 @@
+package thumb
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// Preview is a low quality stand-in, like the thumbnail embedded in EXIF,
+// served while the real thumbnail is generated. It is always a JPEG.
+type Preview struct {
+	*bytes.Reader
+}
+
+// Close satisfies io.Closer like the cached thumbnail files do
+func (*Preview) Close() error {
+	return nil
+}
+
+// NewPreview turns an embedded JPEG thumbnail upright. Embedded thumbnails
+// carry no EXIF of their own, so nothing else would apply the orientation.
+func NewPreview(data []byte, orientation int) (*Preview, error) {
+	if orientation <= 1 {
+		return &Preview{bytes.NewReader(data)}, nil
+	}
+
+	src, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, orient(src, orientation), imaging.JPEG, imaging.JPEGQuality(Quality)); err != nil {
+		return nil, err
+	}
+	return &Preview{bytes.NewReader(buf.Bytes())}, nil
+}
+
+// orient applies an EXIF orientation (1-8) to img
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
@@ -0,0 +1,154 @@
+package thumb
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Fit modes of a Transform with both width and height
+const (
+	FitContain = "contain" // Scale down to fit inside, keeping the aspect ratio
+	FitCover   = "cover"   // Scale and crop to fill exactly, keeping the aspect ratio
+	FitFill    = "fill"    // Stretch to exactly the size
+)
+
+// Gravities name the anchor kept when FitCover crops
+var Gravities = map[string]imaging.Anchor{
+	"center":    imaging.Center,
+	"north":     imaging.Top,
+	"south":     imaging.Bottom,
+	"east":      imaging.Right,
+	"west":      imaging.Left,
+	"northeast": imaging.TopRight,
+	"northwest": imaging.TopLeft,
+	"southeast": imaging.BottomRight,
+	"southwest": imaging.BottomLeft,
+}
+
+// Transform describes an arbitrary rendition of a photo. Zero values keep
+// the original, e.g. no width scales by the height alone.
+type Transform struct {
+	Width   int
+	Height  int
+	Fit     string // FitContain if empty
+	Gravity string // One of Gravities, center if empty
+	Quality int    // Quality if 0, ignored for PNG
+	Format  Format
+	Rotate  int     // Clockwise degrees, a multiple of 90
+	Blur    float64 // Gaussian sigma
+}
+
+// String returns the canonical form of t, which names its cache file
+func (t Transform) String() string {
+	return fmt.Sprintf("w%d_h%d_%s_%s_q%d_r%d_b%g.%s", t.Width, t.Height, t.Fit, t.Gravity, t.Quality, t.Rotate, t.Blur, t.Format)
+}
+
+// withDefaults fills in the defaults of t
+func (t Transform) withDefaults() Transform {
+	if t.Fit == "" {
+		t.Fit = FitContain
+	}
+	if t.Gravity == "" {
+		t.Gravity = "center"
+	}
+	if t.Quality == 0 || t.Format == PNG {
+		t.Quality = Quality
+	}
+	if t.Format == "" {
+		t.Format = JPEG
+	}
+	t.Rotate = (t.Rotate%360 + 360) % 360
+	return t
+}
+
+// renditionFile returns where the rendition t of key is cached. It shares
+// the prefix of the thumbnails, so a changed or removed photo drops both.
+func renditionFile(key Key, t Transform) string {
+	return fmt.Sprintf("%s%s_r%s.%s", photoPrefix(key.Alias, key.Path), key.Tag(), hashOf(t.String())[:16], t.Format)
+}
+
+// Render returns the cached rendition t of key, or creates it from the image
+// read from open. Renditions live in the thumbnail cache and share its limits
+// and workers.
+func Render(key Key, t Transform, open func() (io.ReadCloser, error)) (string, error) {
+	t = t.withDefaults()
+	cachePath := renditionFile(key, t)
+
+	if _, err := os.Stat(cachePath); err == nil {
+		cache.hit(cachePath)
+		return cachePath, nil
+	}
+	cache.miss()
+
+	_, err := once(cachePath, func() error {
+		start := time.Now()
+		return work(func() error {
+			if _, err := os.Stat(cachePath); err == nil {
+				return nil
+			}
+			r, err := open()
+			if err != nil {
+				return err
+			}
+			src, err := imaging.Decode(r, imaging.AutoOrientation(true))
+			r.Close()
+			if err != nil {
+				return err
+			}
+
+			if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+				return err
+			}
+			evictExcept(key.Alias, key.Path, key.Tag())
+
+			if err := save(t.apply(key.Edit.Apply(src)), cachePath, t.Format, t.Quality); err != nil {
+				return err
+			}
+			cache.added(cachePath, time.Since(start))
+			return nil
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	return cachePath, nil
+}
+
+// apply renders t from an upright source image
+func (t Transform) apply(img image.Image) image.Image {
+	switch t.Rotate {
+	case 90:
+		img = imaging.Rotate270(img) // imaging turns counter-clockwise
+	case 180:
+		img = imaging.Rotate180(img)
+	case 270:
+		img = imaging.Rotate90(img)
+	}
+
+	b := img.Bounds()
+	switch {
+	case t.Width == 0 && t.Height == 0:
+	case t.Width == 0 || t.Height == 0:
+		// Scale by one side, never up
+		if (t.Width == 0 || t.Width < b.Dx()) && (t.Height == 0 || t.Height < b.Dy()) {
+			img = imaging.Resize(img, t.Width, t.Height, imaging.Lanczos)
+		}
+	case t.Fit == FitCover:
+		img = imaging.Fill(img, t.Width, t.Height, Gravities[t.Gravity], imaging.Lanczos)
+	case t.Fit == FitFill:
+		img = imaging.Resize(img, t.Width, t.Height, imaging.Lanczos)
+	default:
+		img = imaging.Fit(img, t.Width, t.Height, imaging.Lanczos)
+	}
+
+	if t.Blur > 0 {
+		img = imaging.Blur(img, t.Blur)
+	}
+	return img
+}
@@ -0,0 +1,100 @@
+package thumb
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Shared is a thumbnail store shared by several instances, like a bucket
+// all replicas of a deployment read from
+type Shared interface {
+	// Fetch returns the stored thumbnail, or an error matching fs.ErrNotExist
+	Fetch(key Key, opts Options) (io.ReadCloser, error)
+	// Store saves a thumbnail of size bytes read from r
+	Store(key Key, opts Options, r io.Reader, size int64) error
+}
+
+// FetchShared copies the thumbnail of key from shared into the local cache
+// without generating anything. It returns the cached path if shared had it.
+func FetchShared(key Key, opts Options, shared Shared) (string, bool) {
+	opts = normalize(opts)
+	cachePath := cacheFile(key, opts)
+
+	// Keyed apart from generations, which a quick lookup must not wait for.
+	// Both write by renaming, so racing one is harmless.
+	once(cachePath+"#shared", func() error {
+		if _, err := os.Stat(cachePath); err == nil {
+			return nil
+		}
+		if fetchShared(shared, key, opts, cachePath) {
+			cache.copied(cachePath)
+		}
+		return nil
+	})
+	if _, err := os.Stat(cachePath); err != nil {
+		return "", false
+	}
+	return cachePath, true
+}
+
+// fetchShared copies the thumbnail from shared into cachePath, it reports
+// whether there was one. Failures fall back to generating it.
+func fetchShared(shared Shared, key Key, opts Options, cachePath string) bool {
+	r, err := shared.Fetch(key, opts)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to fetch shared thumbnail of %s/%s: %v", key.Alias, key.Path, err)
+		}
+		return false
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return false
+	}
+	evictExcept(key.Alias, key.Path, key.Tag())
+
+	out, err := os.CreateTemp(filepath.Dir(cachePath), tempPrefix+"*")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(out.Name()) // No-op once renamed
+
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), cachePath)
+	}
+	if err != nil {
+		log.Printf("Failed to fetch shared thumbnail of %s/%s: %v", key.Alias, key.Path, err)
+		return false
+	}
+	return true
+}
+
+// storeShared uploads a generated thumbnail to shared in the background.
+// The file is opened right away, so it can be evicted meanwhile.
+func storeShared(shared Shared, key Key, opts Options, cachePath string) {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	go func() {
+		defer f.Close()
+		if err := shared.Store(key, opts, f, info.Size()); err != nil {
+			log.Printf("Failed to store shared thumbnail of %s/%s: %v", key.Alias, key.Path, err)
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package thumb
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+)
+
+// Summary describes a photo for listings, so clients can lay it out and show
+// a placeholder before its thumbnail loads
+type Summary struct {
+	Width    int    // Upright size of the original in pixels, 0 if unknown
+	Height   int    //
+	BlurHash string // https://blurha.sh
+	Color    string // Dominant colour as #rrggbb
+}
+
+// summaryEdge is the size the image is scaled to before it is summarized,
+// the placeholder holds far less detail than that anyway
+const summaryEdge = 32
+
+// summarize computes the Summary of an upright image, width and height are
+// those of the original
+func summarize(img image.Image, width, height int) Summary {
+	small := imaging.Fit(img, summaryEdge, summaryEdge, imaging.Box)
+
+	// More components along the longer side keep the detail per axis even
+	x, y := 4, 3
+	if height > width {
+		x, y = 3, 4
+	}
+	// Only fails on invalid components
+	hash, _ := blurhash.Encode(x, y, small)
+
+	return Summary{
+		Width:    width,
+		Height:   height,
+		BlurHash: hash,
+		Color:    dominantColor(small),
+	}
+}
+
+// dominantColor returns the average of the most common colour bucket of img.
+// Buckets of 4 bits per channel keep a large uniform area, like the sky,
+// from being averaged with everything else.
+func dominantColor(img *image.NRGBA) string {
+	type bucket struct {
+		n       int
+		r, g, b int
+	}
+	var buckets [4096]bucket
+
+	best := 0
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+		k := r>>4<<8 | g>>4<<4 | b>>4
+		bk := &buckets[k]
+		bk.n++
+		bk.r += r
+		bk.g += g
+		bk.b += b
+		if bk.n > buckets[best].n {
+			best = k
+		}
+	}
+
+	bk := buckets[best]
+	if bk.n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", bk.r/bk.n, bk.g/bk.n, bk.b/bk.n)
+}
+
+// SummarizeFile computes the Summary of a cached thumbnail, for photos whose
+// thumbnail was generated elsewhere. The size of the original is unknown.
+func SummarizeFile(cachePath string) (Summary, error) {
+	img, err := imaging.Open(cachePath)
+	if err != nil {
+		return Summary{}, err
+	}
+	return summarize(img, 0, 0), nil
+}
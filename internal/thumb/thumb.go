@@ -1,84 +1,278 @@
 package thumb
 
 import (
-	"bytes"
 	"crypto/md5"
 	"encoding/hex"
+	"fmt"
+	"image"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/disintegration/imaging"
+	"github.com/gen2brain/webp"
 )
 
+// Format is the encoding of a thumbnail
+type Format string
+
 const (
-	CacheDir = "./cache/thumbnails"
-	Size     = 400 
+	JPEG Format = "jpeg"
+	WebP Format = "webp"
+	PNG  Format = "png" // Renditions only, see Render
 )
 
-func init() {
-	os.MkdirAll(CacheDir, 0755)
+// ContentType returns the MIME type of thumbnails in format f
+func (f Format) ContentType() string {
+	return "image/" + string(f)
 }
 
-// GenerateFromFile creates a thumbnail from a local file path
-func GenerateFromFile(path string) (string, error) {
-	// Generate cache key based on file path and modification time (optional)
-	// For simplicity, just path for now. reliability can be improved later.
-	hash := md5.Sum([]byte(path))
-	key := hex.EncodeToString(hash[:])
-	cachePath := filepath.Join(CacheDir, key+".jpg")
+// Options selects the variant of a thumbnail
+type Options struct {
+	Size   int // Width in pixels, one of Sizes
+	Format Format
+}
 
-	// Check if exists
-	if _, err := os.Stat(cachePath); err == nil {
-		return cachePath, nil
+// Thumbnail settings, see Configure
+var (
+	Sizes   = []int{200, 400, 800, 1600}
+	Size    = 400 // Default width
+	Quality = 80
+	Formats = []Format{WebP, JPEG}
+)
+
+// Configure replaces the default settings. Zero values keep the defaults.
+func Configure(sizes []int, size, quality int, formats []Format) {
+	if len(sizes) > 0 {
+		Sizes = slices.Sorted(slices.Values(sizes))
+	}
+	if size > 0 {
+		Size = size
+	}
+	if quality > 0 {
+		Quality = quality
 	}
+	if len(formats) > 0 {
+		Formats = formats
+	}
+}
 
-	// Open source file
-	src, err := imaging.Open(path, imaging.AutoOrientation(true))
-	if err != nil {
-		return "", err
+// NearestSize returns the smallest configured size covering the requested
+// width, or the largest one. Only configured sizes are ever generated, so
+// arbitrary requests can't fill the cache.
+func NearestSize(width int) int {
+	if width <= 0 {
+		return Size
+	}
+	for _, s := range Sizes {
+		if s >= width {
+			return s
+		}
 	}
+	return Sizes[len(Sizes)-1]
+}
 
-	// Resize
-	dst := imaging.Resize(src, Size, 0, imaging.Lanczos)
+// Supports reports whether format f is enabled
+func Supports(f Format) bool {
+	return slices.Contains(Formats, f)
+}
 
-	// Save to cache
-	err = imaging.Save(dst, cachePath, imaging.JPEGQuality(80))
-	if err != nil {
-		return "", err
+// normalize fills in the defaults of opts
+func normalize(opts Options) Options {
+	opts.Size = NearestSize(opts.Size)
+	if opts.Format == "" {
+		opts.Format = JPEG
 	}
+	return opts
+}
+
+// Key identifies the source of a thumbnail. Version changes whenever the
+// content does (mtime and size, or the ETag), so a replaced file never gets
+// the thumbnail of its predecessor.
+type Key struct {
+	Alias   string
+	Path    string
+	Version string
+	Edit    Edit // Applied to the source, a changed edit is a new version too
+}
+
+// Tag is the short form of the version and edit, it starts the cached files
+// of each variant
+func (k Key) Tag() string {
+	return hashOf(k.Version + k.Edit.String())[:12]
+}
+
+func hashOf(s string) string {
+	hash := md5.Sum([]byte(s))
+	return hex.EncodeToString(hash[:])
+}
+
+// aliasDir holds the thumbnails of one alias, so it can be purged at once
+func aliasDir(alias string) string {
+	return filepath.Join(CacheDir, hashOf(alias))
+}
+
+// photoPrefix starts the file name of every cached variant of a photo
+func photoPrefix(alias, path string) string {
+	return filepath.Join(aliasDir(alias), hashOf(path)+"_")
+}
+
+// cacheFile returns where the thumbnail of key is cached
+func cacheFile(key Key, opts Options) string {
+	return fmt.Sprintf("%s%s_%d.%s", photoPrefix(key.Alias, key.Path), key.Tag(), opts.Size, opts.Format)
+}
+
+// Cached returns the path of the thumbnail of key if it is in the local cache
+func Cached(key Key, opts Options) (string, bool) {
+	cachePath := cacheFile(key, normalize(opts))
+	if _, err := os.Stat(cachePath); err != nil {
+		return "", false
+	}
+	cache.hit(cachePath)
+	return cachePath, true
+}
 
-	return cachePath, nil
+// Generate returns the cached thumbnail of key, or creates it from the image
+// read from open. summary describes the source image when this call generated
+// the thumbnail, it is nil when the thumbnail came from a cache.
+// Concurrent requests for the same thumbnail share one generation, which
+// waits for a free worker.
+func Generate(key Key, opts Options, open func() (io.ReadCloser, error)) (cachePath string, summary *Summary, err error) {
+	return GenerateShared(key, opts, open, nil)
 }
 
-// GenerateFromBytes creates a thumbnail from image bytes (for S3 provider)
-func GenerateFromBytes(data []byte, identifier string) (string, error) {
-	// Generate cache key based on identifier
-	hash := md5.Sum([]byte(identifier))
-	key := hex.EncodeToString(hash[:])
-	cachePath := filepath.Join(CacheDir, key+".jpg")
+// GenerateShared is Generate with a second cache level shared with other
+// instances. A thumbnail missing locally is fetched from shared before the
+// original is decoded, and what is generated is stored there. shared may be nil.
+func GenerateShared(key Key, opts Options, open func() (io.ReadCloser, error), shared Shared) (cachePath string, summary *Summary, err error) {
+	opts = normalize(opts)
+	cachePath = cacheFile(key, opts)
 
 	// Check if exists
 	if _, err := os.Stat(cachePath); err == nil {
-		return cachePath, nil
+		cache.hit(cachePath)
+		return cachePath, nil, nil
 	}
+	cache.miss()
 
-	// Decode image from bytes
-	src, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	_, err = once(cachePath, func() error {
+		if shared != nil && fetchShared(shared, key, opts, cachePath) {
+			cache.copied(cachePath)
+			return nil
+		}
+
+		start := time.Now()
+		err := work(func() error {
+			// A generation that just finished may have written it meanwhile
+			if _, err := os.Stat(cachePath); err == nil {
+				return nil
+			}
+			s, err := generate(key, opts, cachePath, open)
+			if err != nil {
+				return err
+			}
+			summary = &s
+			cache.added(cachePath, time.Since(start))
+			return nil
+		})
+		if err == nil && summary != nil && shared != nil {
+			storeShared(shared, key, opts, cachePath)
+		}
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return cachePath, summary, nil
+}
+
+// generate decodes the source image, writes its thumbnail to cachePath and
+// summarizes it
+func generate(key Key, opts Options, cachePath string, open func() (io.ReadCloser, error)) (Summary, error) {
+	r, err := open()
+	if err != nil {
+		return Summary{}, err
+	}
+	src, err := imaging.Decode(r, imaging.AutoOrientation(true))
+	r.Close()
 	if err != nil {
-		return "", err
+		return Summary{}, err
+	}
+	src = key.Edit.Apply(src)
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return Summary{}, err
+	}
+	// Variants of an older version are stale now
+	evictExcept(key.Alias, key.Path, key.Tag())
+
+	// Never upscale, small images are only re-encoded
+	dst := src
+	if src.Bounds().Dx() > opts.Size {
+		dst = imaging.Resize(src, opts.Size, 0, imaging.Lanczos)
+	}
+	if err := save(dst, cachePath, opts.Format, Quality); err != nil {
+		return Summary{}, err
+	}
+
+	// The thumbnail is plenty for the placeholder and far cheaper to scan
+	return summarize(dst, src.Bounds().Dx(), src.Bounds().Dy()), nil
+}
+
+// evictExcept removes the cached variants of a photo that don't belong to version
+func evictExcept(alias, path, version string) {
+	prefix := photoPrefix(alias, path)
+	matches, _ := filepath.Glob(prefix + "*")
+	for _, m := range matches {
+		if version == "" || !strings.HasPrefix(m, prefix+version+"_") {
+			os.Remove(m)
+			cache.forget(m)
+		}
 	}
+}
+
+// Evict removes every cached thumbnail of a photo
+func Evict(alias, path string) {
+	evictExcept(alias, path, "")
+}
 
-	// Resize
-	dst := imaging.Resize(src, Size, 0, imaging.Lanczos)
+// EvictAlias removes every cached thumbnail of an alias
+func EvictAlias(alias string) error {
+	cache.forget(aliasDir(alias) + string(filepath.Separator))
+	return os.RemoveAll(aliasDir(alias))
+}
 
-	// Save to cache
-	err = imaging.Save(dst, cachePath, imaging.JPEGQuality(80))
+// save encodes dst to cachePath. The file is written under a temporary name
+// and renamed into place, so a half-written thumbnail is never served.
+func save(dst image.Image, cachePath string, format Format, quality int) error {
+	out, err := os.CreateTemp(filepath.Dir(cachePath), tempPrefix+"*")
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer os.Remove(out.Name()) // No-op once renamed
 
-	return cachePath, nil
+	if err := encode(out, dst, format, quality); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), cachePath)
+}
+
+func encode(w io.Writer, img image.Image, format Format, quality int) error {
+	switch format {
+	case JPEG:
+		return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(quality))
+	case PNG:
+		return imaging.Encode(w, img, imaging.PNG)
+	default:
+		return webp.Encode(w, img, webp.Options{Quality: quality})
+	}
 }
 
 // OpenThumbnail returns a reader for the cached thumbnail file
@@ -95,6 +289,6 @@ func ClearCache() error {
 	for _, d := range dir {
 		os.RemoveAll(filepath.Join(CacheDir, d.Name()))
 	}
+	cache.forget("")
 	return nil
 }
-
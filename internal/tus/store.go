@@ -0,0 +1,318 @@
+package tus
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound       = errors.New("upload not found")
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+	ErrLocked         = errors.New("upload is being written")
+	ErrTooLarge       = errors.New("upload exceeds its declared length")
+	ErrCommitted      = errors.New("upload already saved")
+)
+
+// Info describes a staged upload. It is persisted as <id>.info next to the
+// <id>.bin data file so uploads survive a restart.
+type Info struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata"`
+	Owner    string            `json:"owner,omitempty"` // User who created it
+	Created  time.Time         `json:"created"`
+	Expires  time.Time         `json:"expires"`
+	SavedAs  string            `json:"saved_as,omitempty"` // Final name once committed to the provider
+}
+
+// Complete reports whether every byte of the upload has arrived
+func (i *Info) Complete() bool {
+	return i.Offset == i.Length
+}
+
+// Store stages partial uploads on the local disk
+type Store struct {
+	dir    string
+	expiry time.Duration
+
+	mu    sync.Mutex
+	locks map[string]bool
+}
+
+func NewStore(dir string, expiry time.Duration) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, expiry: expiry, locks: make(map[string]bool)}, nil
+}
+
+func (s *Store) infoPath(id string) string { return filepath.Join(s.dir, id+".info") }
+func (s *Store) dataPath(id string) string { return filepath.Join(s.dir, id+".bin") }
+
+// validID guards the file paths built from client supplied ids
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (s *Store) writeInfo(info *Info) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	// Write then rename, so a crash never leaves a torn info file
+	tmp := s.infoPath(info.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(info.ID))
+}
+
+// Create registers a new upload of length bytes by owner
+func (s *Store) Create(length int64, owner string, metadata map[string]string) (*Info, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	info := &Info{
+		ID:       hex.EncodeToString(b),
+		Length:   length,
+		Metadata: metadata,
+		Owner:    owner,
+		Created:  now,
+		Expires:  now.Add(s.expiry),
+	}
+
+	f, err := os.Create(s.dataPath(info.ID))
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	if err := s.writeInfo(info); err != nil {
+		os.Remove(s.dataPath(info.ID))
+		return nil, err
+	}
+	return info, nil
+}
+
+// Get returns the state of an upload
+func (s *Store) Get(id string) (*Info, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(s.infoPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var info Info
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	if time.Now().After(info.Expires) {
+		return nil, ErrNotFound
+	}
+	return &info, nil
+}
+
+// lock gives one request at a time write access to an upload
+func (s *Store) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks[id] {
+		return false
+	}
+	s.locks[id] = true
+	return true
+}
+
+func (s *Store) unlock(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locks, id)
+}
+
+// Append writes r at offset, which must match the current offset of the upload.
+// Whatever arrived before r failed is kept, so the client can resume from there.
+func (s *Store) Append(id string, offset int64, r io.Reader) (*Info, error) {
+	if !s.lock(id) {
+		return nil, ErrLocked
+	}
+	defer s.unlock(id)
+
+	info, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	// Its data is gone, only the info is kept to tell where it went
+	if info.SavedAs != "" {
+		return info, ErrCommitted
+	}
+	if offset != info.Offset {
+		return info, ErrOffsetMismatch
+	}
+
+	f, err := os.OpenFile(s.dataPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Read one byte past the declared length to detect oversized bodies
+	n, copyErr := io.Copy(f, io.LimitReader(r, info.Length-offset+1))
+	if offset+n > info.Length {
+		n = info.Length - offset
+		f.Truncate(info.Length)
+		copyErr = ErrTooLarge
+	}
+
+	info.Offset += n
+	info.Expires = time.Now().Add(s.expiry)
+	if err := s.writeInfo(info); err != nil {
+		return nil, err
+	}
+	return info, copyErr
+}
+
+// Open returns the staged data of an upload
+func (s *Store) Open(id string) (*os.File, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	return os.Open(s.dataPath(id))
+}
+
+// Commit runs save on the complete data of an upload and records the final name.
+// The staged data is dropped afterwards, the info stays until it expires so
+// clients can still look up where the file went.
+func (s *Store) Commit(id string, save func(io.Reader) (string, error)) (*Info, error) {
+	if !s.lock(id) {
+		return nil, ErrLocked
+	}
+	defer s.unlock(id)
+
+	info, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if info.SavedAs != "" {
+		return info, nil
+	}
+	if !info.Complete() {
+		return info, fmt.Errorf("upload %s is incomplete", id)
+	}
+
+	f, err := s.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	savedAs, err := save(f)
+	f.Close()
+	if err != nil {
+		return info, err
+	}
+
+	info.SavedAs = savedAs
+	if err := s.writeInfo(info); err != nil {
+		return info, err
+	}
+	os.Remove(s.dataPath(id))
+	return info, nil
+}
+
+// Terminate drops an upload and its data
+func (s *Store) Terminate(id string) error {
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	if !s.lock(id) {
+		return ErrLocked
+	}
+	defer s.unlock(id)
+
+	os.Remove(s.dataPath(id))
+	return os.Remove(s.infoPath(id))
+}
+
+// ExpireLoop removes expired uploads every interval, it never returns
+func (s *Store) ExpireLoop(interval time.Duration) {
+	for {
+		s.expire()
+		time.Sleep(interval)
+	}
+}
+
+func (s *Store) expire() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Failed to read upload dir: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok || !validID(id) {
+			continue
+		}
+		data, err := os.ReadFile(s.infoPath(id))
+		if err != nil {
+			continue
+		}
+		var info Info
+		if err := json.Unmarshal(data, &info); err != nil || time.Now().After(info.Expires) {
+			if !s.lock(id) {
+				continue
+			}
+			os.Remove(s.dataPath(id))
+			os.Remove(s.infoPath(id))
+			s.unlock(id)
+		}
+	}
+}
+
+// ParseMetadata decodes an Upload-Metadata header: comma separated pairs of
+// a key and an optional base64 encoded value
+func ParseMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %s", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -1,7 +1,7 @@
 import { useState, useEffect, useCallback } from 'react'
 import { QueryClient, QueryClientProvider } from '@tanstack/react-query'
 import { motion, AnimatePresence } from 'framer-motion'
-import { useAliases } from './api/hooks'
+import { useAliases, useLibraryEvents } from './api/hooks'
 import { apiClient } from './api/client'
 import { Header } from './components/Header'
 import { Gallery } from './components/Gallery'
@@ -40,6 +40,9 @@ function AppContent() {
   // Fetch aliases
   const { data: aliases, isLoading: aliasesLoading, refetch: refetchAliases } = useAliases()
 
+  // Live updates from the server
+  useLibraryEvents(isAuthenticated === true)
+
   // Auto-select first alias if none selected and aliases loaded
   useEffect(() => {
     if (!activeAlias && aliases?.length > 0) {
@@ -1,3 +1,4 @@
+import { useEffect } from 'react';
 import { useInfiniteQuery, useQuery, useMutation, useQueryClient } from '@tanstack/react-query';
 import { apiClient } from './client';
 
@@ -11,6 +12,17 @@ export const useAliases = () => {
   });
 };
 
+// The aliases with credentials and access rules, admins only
+export const useAliasConfigs = () => {
+  return useQuery({
+    queryKey: ['aliases', 'config'],
+    queryFn: async () => {
+      const { data } = await apiClient.get('/alias');
+      return data;
+    },
+  });
+};
+
 export const usePhotos = (alias) => {
   return useInfiniteQuery({
     queryKey: ['photos', alias],
@@ -21,6 +33,7 @@ export const usePhotos = (alias) => {
           alias: alias,
           cursor: pageParam,
           limit: 50,
+          recursive: true,
         },
       });
       return data;
@@ -30,6 +43,41 @@ export const usePhotos = (alias) => {
   });
 };
 
+// 订阅服务端事件流, 图库变化时刷新列表 (取代轮询)
+export const useLibraryEvents = (enabled) => {
+  const queryClient = useQueryClient();
+
+  useEffect(() => {
+    if (!enabled) return;
+
+    const source = new EventSource('/api/v1/events');
+    const timers = {};
+    // 批量变更时合并刷新
+    const refresh = (queryKey) => {
+      const id = JSON.stringify(queryKey);
+      clearTimeout(timers[id]);
+      timers[id] = setTimeout(() => queryClient.invalidateQueries({ queryKey }), 300);
+    };
+
+    const onPhoto = (e) => refresh(['photos', JSON.parse(e.data).alias]);
+    ['photo.added', 'photo.removed', 'photo.moved', 'photo.updated', 'scan.finished'].forEach((type) =>
+      source.addEventListener(type, onPhoto)
+    );
+    ['alias.added', 'alias.removed'].forEach((type) =>
+      source.addEventListener(type, () => refresh(['aliases']))
+    );
+    source.addEventListener('resync', () => {
+      refresh(['aliases']);
+      refresh(['photos']);
+    });
+
+    return () => {
+      source.close();
+      Object.values(timers).forEach(clearTimeout);
+    };
+  }, [enabled, queryClient]);
+};
+
 export const useDeletePhoto = () => {
     const queryClient = useQueryClient();
     
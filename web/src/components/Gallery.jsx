@@ -157,6 +157,7 @@ export function Gallery({ alias, onControlsReady }) {
                 onToggleSelectMode: () => isSelectMode ? exitSelectMode() : setIsSelectMode(true),
                 onBatchMove: handleBatchMove,
                 onBatchDelete: handleBatchDelete,
+                onBatchDownload: handleBatchDownload,
                 onDensityChange: setDensity,
                 onGapChange: setGap,
                 onViewModeToggle: () => {
@@ -259,6 +260,25 @@ export function Gallery({ alias, onControlsReady }) {
         }
     };
 
+    // 以表单提交下载, 浏览器直接接收流式 ZIP, 无需先缓存到内存
+    const handleBatchDownload = () => {
+        if (selectedPhotos.size === 0) return;
+        const form = document.createElement('form');
+        form.method = 'POST';
+        form.action = '/api/v1/download/zip';
+        const fields = [['alias', alias], ...allPhotos.filter(p => selectedPhotos.has(p.id)).map(p => ['path', p.path])];
+        for (const [name, value] of fields) {
+            const input = document.createElement('input');
+            input.type = 'hidden';
+            input.name = name;
+            input.value = value;
+            form.appendChild(input);
+        }
+        document.body.appendChild(form);
+        form.submit();
+        document.body.removeChild(form);
+    };
+
     const handleBatchMove = () => {
         if (selectedPhotos.size === 0) return;
         setShowMoveDialog(true);
@@ -28,6 +28,7 @@ export function Header({
         onToggleSelectMode,
         onBatchMove,
         onBatchDelete,
+        onBatchDownload,
         onDensityChange,
         onGapChange,
         onViewModeToggle,
@@ -86,6 +87,12 @@ export function Header({
                                         transition={{ duration: 0.2 }}
                                         className="flex items-center gap-2"
                                     >
+                                        <button
+                                            onClick={onBatchDownload}
+                                            className="px-3 py-1.5 text-sm rounded-full bg-neutral-100 text-neutral-600 hover:bg-neutral-200 transition-colors"
+                                        >
+                                            下载
+                                        </button>
                                         <button
                                             onClick={onBatchMove}
                                             className="px-3 py-1.5 text-sm rounded-full bg-neutral-100 text-neutral-600 hover:bg-neutral-200 transition-colors"
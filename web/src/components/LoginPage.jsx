@@ -3,6 +3,7 @@ import { motion } from 'framer-motion';
 import { apiClient } from '../api/client';
 
 export function LoginPage({ onLoginSuccess }) {
+    const [username, setUsername] = useState('');
     const [password, setPassword] = useState('');
     const [isLoading, setIsLoading] = useState(false);
     const [error, setError] = useState(false);
@@ -16,7 +17,8 @@ export function LoginPage({ onLoginSuccess }) {
         setError(false);
 
         try {
-            await apiClient.post('/auth/login', { password });
+            // 用户名留空时登录默认管理员账号
+            await apiClient.post('/auth/login', { username: username.trim(), password });
             onLoginSuccess();
         } catch (err) {
             setError(true);
@@ -45,6 +47,15 @@ export function LoginPage({ onLoginSuccess }) {
 
                 <form onSubmit={handleSubmit} className="space-y-6">
                     <div className="space-y-2">
+                        <input
+                            type="text"
+                            value={username}
+                            onChange={(e) => setUsername(e.target.value)}
+                            placeholder="用户名"
+                            autoComplete="username"
+                            className="w-full px-4 py-3 rounded-xl bg-white/60 border border-neutral-200 focus:border-brand-500 focus:ring-2 focus:ring-brand-100 outline-none transition-all placeholder:text-neutral-400"
+                            autoFocus
+                        />
                         <motion.div
                             animate={error ? { x: [-10, 10, -10, 10, 0] } : {}}
                             transition={{ type: "spring", stiffness: 500, damping: 25 }}
@@ -54,9 +65,9 @@ export function LoginPage({ onLoginSuccess }) {
                                 type={showPassword ? "text" : "password"}
                                 value={password}
                                 onChange={(e) => setPassword(e.target.value)}
-                                placeholder="请输入访问密码"
+                                placeholder="请输入密码"
+                                autoComplete="current-password"
                                 className={`w-full px-4 py-3 rounded-xl bg-white/60 border ${error ? 'border-red-300 focus:border-red-500 ring-2 ring-red-100' : 'border-neutral-200 focus:border-brand-500 focus:ring-2 focus:ring-brand-100'} outline-none transition-all placeholder:text-neutral-400`}
-                                autoFocus
                             />
                             <button
                                 type="button"
@@ -70,7 +81,7 @@ export function LoginPage({ onLoginSuccess }) {
                                 )}
                             </button>
                         </motion.div>
-                        {error && <p className="text-xs text-red-500 text-center font-medium">密码错误，请重试</p>}
+                        {error && <p className="text-xs text-red-500 text-center font-medium">用户名或密码错误，请重试</p>}
                     </div>
 
                     <button
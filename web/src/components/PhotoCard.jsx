@@ -91,6 +91,10 @@ export const PhotoCard = React.memo(function PhotoCard({
     const selectedClass = isSelected ? 'ring-4 ring-brand-500 ring-offset-2' : '';
     const opacityClass = isSelected ? 'opacity-80' : '';
 
+    // 多尺寸缩略图, 浏览器按屏幕密度选择
+    const thumbUrl = (size) =>
+        `/api/v1/thumb?alias=${encodeURIComponent(alias)}&path=${encodeURIComponent(photo.path)}&size=${size}`;
+
     // CSS trick: use group-XXX from parent? 
     // Gallery container will have `.gallery-select-mode`.
     // We can use `.gallery-select-mode &` in pure CSS, but with Tailwind:
@@ -115,6 +119,7 @@ export const PhotoCard = React.memo(function PhotoCard({
         <div
             data-photo-id={photo.id}
             className={`${containerBase} ${selectedClass} group/card`}
+            style={photo.color ? { backgroundColor: photo.color } : undefined}
             onClick={handleClick}
             onMouseDown={handleMouseDown}
             onMouseUp={clearLongPress}
@@ -126,8 +131,13 @@ export const PhotoCard = React.memo(function PhotoCard({
             onTouchCancel={clearLongPress}
         >
             <img
-                src={`/api/v1/thumb?alias=${encodeURIComponent(alias)}&path=${encodeURIComponent(photo.path)}`}
+                src={thumbUrl(400)}
+                srcSet={`${thumbUrl(400)} 400w, ${thumbUrl(800)} 800w, ${thumbUrl(1600)} 1600w`}
+                sizes="(max-width: 640px) 50vw, 25vw"
                 alt={photo.name}
+                // 已知尺寸时预留宽高比, 缩略图加载前布局不跳动
+                width={photo.width || undefined}
+                height={photo.height || undefined}
                 loading="lazy"
                 draggable="false"
                 className={`w-full h-auto block select-none transition-opacity ${variant === 'grid' ? 'h-full object-contain' : ''} ${opacityClass}`}
@@ -1,11 +1,11 @@
 import React, { useState } from 'react';
 import { motion, AnimatePresence } from 'framer-motion';
-import { useAliases, useAddAlias, useDeleteAlias, useUpdateAlias, useClearCache, useTestS3Connection } from '../api/hooks';
+import { useAliasConfigs, useAddAlias, useDeleteAlias, useUpdateAlias, useClearCache, useTestS3Connection } from '../api/hooks';
 import { useToast } from './ui/Toast';
 import { useAlertDialog } from './ui/AlertDialog';
 
 export function Settings() {
-    const { data: aliases, isLoading } = useAliases();
+    const { data: aliases, isLoading } = useAliasConfigs();
     const addAliasMutation = useAddAlias();
     const deleteAliasMutation = useDeleteAlias();
     const updateAliasMutation = useUpdateAlias();
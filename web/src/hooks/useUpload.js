@@ -11,8 +11,9 @@ export function useUpload({ alias, uploadMutation }) {
     const uploadFiles = useCallback(async (files) => {
         setUploadStatus('uploading');
         const formData = new FormData();
-        files.forEach(file => formData.append('files', file));
+        // alias 需要在文件之前，服务端按顺序流式读取表单
         formData.append('alias', alias);
+        files.forEach(file => formData.append('files', file));
         try {
             await uploadMutation.mutateAsync({ alias, formData });
             setUploadStatus('success');